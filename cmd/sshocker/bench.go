@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/lima-vm/sshocker/pkg/bench"
+	"github.com/lima-vm/sshocker/pkg/reversesshfs"
+	"github.com/lima-vm/sshocker/pkg/ssh"
+	"github.com/lima-vm/sshocker/pkg/util"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+var benchCommand = &cli.Command{
+	Name:      "bench",
+	Usage:     "Measure the throughput of the reverse sshfs mounts and the forwards",
+	ArgsUsage: "[USER@]HOST[:PORT]",
+	Action:    benchAction,
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "driver",
+			Usage: "SFTP server drivers to be benchmarked, \"builtin\" and \"openssh-sftp-server\" (when found) by default",
+		},
+		&cli.StringSliceFlag{
+			Name:  "preset",
+			Usage: "sshfs option presets to be benchmarked in addition to the default options, all the presets by default",
+		},
+		&cli.StringSliceFlag{
+			Name:  "sshfs-option",
+			Usage: "sshfs mount options to be benchmarked in addition to the default options and the presets",
+		},
+		&cli.StringFlag{
+			Name:  "sshfs-transport",
+			Usage: "transport of the SFTP session, \"stdio\" or \"direct\"",
+			Value: reversesshfs.TransportStdio,
+		},
+		&cli.StringFlag{
+			Name:  "size",
+			Usage: "size of the file read and written on the mounts, and sent over the forward",
+			Value: "64MiB",
+		},
+		&cli.IntFlag{
+			Name:  "files",
+			Usage: "number of the small files listed on the mounts",
+			Value: bench.DefaultSmallFiles,
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "output format, \"table\" or \"json\"",
+			Value: "table",
+		},
+		&cli.StringFlag{
+			Name:    "ssh-config",
+			Aliases: []string{"F"},
+			Usage:   "ssh config file",
+		},
+		&cli.BoolFlag{
+			Name:  "ssh-persist",
+			Usage: "enable ControlPersist, when no running session is found for the host",
+			Value: true,
+		},
+	},
+}
+
+// benchDrivers returns the drivers to be benchmarked by default.
+func benchDrivers() []reversesshfs.Driver {
+	res := []reversesshfs.Driver{reversesshfs.DriverBuiltin}
+	if _, err := reversesshfs.DetectOpensshSftpServer(); err != nil {
+		logrus.Infof("Skipping the %q driver: %v", reversesshfs.DriverOpensshSftpServer, err)
+	} else {
+		res = append(res, reversesshfs.DriverOpensshSftpServer)
+	}
+	return res
+}
+
+// benchMounts returns the combinations of the drivers and the option sets:
+// the default options, the presets, and sshfsOptions ("custom").
+func benchMounts(drivers []reversesshfs.Driver, presets []reversesshfs.Preset, sshfsOptions []string, transport reversesshfs.Transport) []bench.Mount {
+	optionSets := append([]reversesshfs.Preset{{Name: "default"}}, presets...)
+	if len(sshfsOptions) > 0 {
+		optionSets = append(optionSets, reversesshfs.Preset{Name: "custom", SSHFSOptions: sshfsOptions})
+	}
+	var res []bench.Mount
+	for _, d := range drivers {
+		for _, o := range optionSets {
+			res = append(res, bench.Mount{
+				Name:      d + "/" + o.Name,
+				Driver:    d,
+				Transport: transport,
+				SSHFSArgs: o.SSHFSArgs(),
+				SSHArgs:   o.SSHArgs(),
+			})
+		}
+	}
+	return res
+}
+
+func benchAction(clicontext *cli.Context) error {
+	if clicontext.NArg() != 1 {
+		return errors.New("expected exactly 1 argument: HOST")
+	}
+	host, port, err := parseHost(clicontext.Args().First())
+	if err != nil {
+		return err
+	}
+	format := clicontext.String("format")
+	if format != "table" && format != "json" {
+		return fmt.Errorf("unknown format %q", format)
+	}
+	size, err := util.ParseSize(clicontext.String("size"))
+	if err != nil {
+		return fmt.Errorf("cannot parse --size: %w", err)
+	}
+	if size <= 0 {
+		return fmt.Errorf("--size has to be positive, got %d", size)
+	}
+	files := clicontext.Int("files")
+	if files <= 0 {
+		return fmt.Errorf("--files has to be positive, got %d", files)
+	}
+	transport := clicontext.String("sshfs-transport")
+	switch transport {
+	case reversesshfs.TransportStdio, reversesshfs.TransportDirect:
+	default:
+		return fmt.Errorf("unknown sshfs transport %q", transport)
+	}
+	presets := reversesshfs.Presets()
+	if names := clicontext.StringSlice("preset"); len(names) > 0 {
+		presets = nil
+		for _, name := range names {
+			p, ok := reversesshfs.LookupPreset(name)
+			if !ok {
+				return fmt.Errorf("unknown preset %q, should be one of %v", name, reversesshfs.PresetNames())
+			}
+			presets = append(presets, p)
+		}
+	}
+	drivers := clicontext.StringSlice("driver")
+	if len(drivers) == 0 {
+		drivers = benchDrivers()
+	}
+	sshConfig := &ssh.SSHConfig{
+		ConfigFile: clicontext.String("ssh-config"),
+	}
+	controlPath, err := ssh.FindMaster(host, port, sshConfig)
+	if err != nil {
+		logrus.WithError(err).Debug("failed to find a running session")
+	}
+	if controlPath != "" {
+		logrus.Debugf("Reusing the master %q", controlPath)
+		sshConfig.ControlPath = controlPath
+	} else if clicontext.Bool("ssh-persist") {
+		sshConfig.Persist = true
+		if err := ssh.StartMaster(host, port, sshConfig); err != nil {
+			return err
+		}
+		defer func() {
+			if emErr := ssh.ExitMaster(host, port, sshConfig); emErr != nil {
+				logrus.WithError(emErr).Error("failed to exit the master")
+			}
+		}()
+	} else {
+		if transport == reversesshfs.TransportDirect {
+			return errors.New("--sshfs-transport=direct requires --ssh-persist")
+		}
+		logrus.Warn("Benchmarking without the master, the results include the time to establish the SSH connections")
+	}
+	res, err := bench.Run(bench.Options{
+		SSHConfig:  sshConfig,
+		Host:       host,
+		Port:       port,
+		Mounts:     benchMounts(drivers, presets, clicontext.StringSlice("sshfs-option"), transport),
+		FileSize:   size,
+		SmallFiles: files,
+	})
+	if err != nil {
+		return err
+	}
+	w := clicontext.App.Writer
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	return bench.WriteTable(w, res)
+}
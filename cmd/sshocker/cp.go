@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/lima-vm/sshocker/pkg/ssh"
+	"github.com/lima-vm/sshocker/pkg/transfer"
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	cpFlags = []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "recursive",
+			Aliases: []string{"r"},
+			Usage:   "Copy directories recursively",
+		},
+		&cli.StringFlag{
+			Name:    "ssh-config",
+			Aliases: []string{"F"},
+			Usage:   "ssh config file",
+		},
+		&cli.BoolFlag{
+			Name:  "ssh-persist",
+			Usage: "enable ControlPersist, when no running session is found for the host",
+			Value: true,
+		},
+	}
+	cpCommand = &cli.Command{
+		Name:      "cp",
+		Usage:     "Akin to `docker cp`",
+		ArgsUsage: "[-r] [USER@]HOST[:PORT]:SRC DST | [-r] SRC [USER@]HOST[:PORT]:DST",
+		Action:    cpAction,
+		Flags:     cpFlags,
+	}
+)
+
+// cpArg is a SRC or DST argument of `sshocker cp`.
+type cpArg struct {
+	Host string // Empty for local
+	Port int
+	Path string
+}
+
+// parseCpArg parses "[USER@]HOST[:PORT]:PATH" or "PATH".
+// Akin to `docker cp`, local paths containing ':' have to be prefixed with "./".
+func parseCpArg(s string) (cpArg, error) {
+	a := cpArg{Path: s}
+	if filepath.IsAbs(s) || strings.HasPrefix(s, ".") {
+		return a, nil
+	}
+	hostPort, p, ok := strings.Cut(s, ":")
+	if !ok || strings.Contains(hostPort, "/") {
+		return a, nil
+	}
+	if portStr, rest, ok := strings.Cut(p, ":"); ok && portStr != "" && strings.Trim(portStr, "0123456789") == "" {
+		hostPort += ":" + portStr
+		p = rest
+	}
+	var err error
+	a.Host, a.Port, err = parseHost(hostPort)
+	if err != nil {
+		return a, err
+	}
+	if a.Host == "" {
+		return a, fmt.Errorf("cannot parse %q: empty host", s)
+	}
+	if p == "" {
+		p = "."
+	}
+	a.Path = p
+	return a, nil
+}
+
+func cpAction(clicontext *cli.Context) error {
+	if clicontext.NArg() != 2 {
+		return errors.New("expected exactly 2 arguments: SRC DST")
+	}
+	src, err := parseCpArg(clicontext.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	dst, err := parseCpArg(clicontext.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	if (src.Host == "") == (dst.Host == "") {
+		return errors.New("exactly one of SRC and DST has to be remote ([USER@]HOST[:PORT]:PATH)")
+	}
+	remote := src
+	if dst.Host != "" {
+		remote = dst
+	}
+	sshConfig := &ssh.SSHConfig{
+		ConfigFile: clicontext.String("ssh-config"),
+	}
+	controlPath, err := ssh.FindMaster(remote.Host, remote.Port, sshConfig)
+	if err != nil {
+		logrus.WithError(err).Debug("failed to find a running session")
+	}
+	if controlPath != "" {
+		logrus.Debugf("Reusing the master %q", controlPath)
+		sshConfig.ControlPath = controlPath
+	} else if clicontext.Bool("ssh-persist") {
+		sshConfig.Persist = true
+		if err := ssh.StartMaster(remote.Host, remote.Port, sshConfig); err != nil {
+			return err
+		}
+		defer func() {
+			if emErr := ssh.ExitMaster(remote.Host, remote.Port, sshConfig); emErr != nil {
+				logrus.WithError(emErr).Error("failed to exit the master")
+			}
+		}()
+	}
+	recursive := clicontext.Bool("recursive")
+	var st transfer.Stat
+	if dst.Host != "" {
+		st, err = cpUpload(sshConfig, src.Path, dst, recursive)
+	} else {
+		st, err = cpDownload(sshConfig, src, dst.Path, recursive)
+	}
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Copied %v", st)
+	return nil
+}
+
+func cpUpload(sshConfig *ssh.SSHConfig, localPath string, dst cpArg, recursive bool) (transfer.Stat, error) {
+	fi, err := os.Stat(localPath)
+	if err != nil {
+		return transfer.Stat{}, err
+	}
+	if fi.IsDir() {
+		if !recursive {
+			return transfer.Stat{}, fmt.Errorf("%q is a directory (not copied), specify -r", localPath)
+		}
+		return transfer.UploadDir(dst.Host, dst.Port, sshConfig, localPath, dst.Path)
+	}
+	client, closeClient, err := ssh.NewSFTPClient(dst.Host, dst.Port, sshConfig)
+	if err != nil {
+		return transfer.Stat{}, err
+	}
+	defer closeClient()
+	remotePath := dst.Path
+	if isRemoteDir(client, remotePath) {
+		remotePath = path.Join(remotePath, filepath.Base(localPath))
+	}
+	n, err := transfer.Upload(client, localPath, remotePath)
+	return transfer.Stat{Files: 1, Bytes: n}, err
+}
+
+func cpDownload(sshConfig *ssh.SSHConfig, src cpArg, localPath string, recursive bool) (transfer.Stat, error) {
+	client, closeClient, err := ssh.NewSFTPClient(src.Host, src.Port, sshConfig)
+	if err != nil {
+		return transfer.Stat{}, err
+	}
+	if isRemoteDir(client, src.Path) {
+		_ = closeClient()
+		if !recursive {
+			return transfer.Stat{}, fmt.Errorf("%q (remote) is a directory (not copied), specify -r", src.Path)
+		}
+		return transfer.DownloadDir(src.Host, src.Port, sshConfig, src.Path, localPath)
+	}
+	defer closeClient()
+	if fi, err := os.Stat(localPath); err == nil && fi.IsDir() {
+		localPath = filepath.Join(localPath, path.Base(src.Path))
+	}
+	n, err := transfer.Download(client, src.Path, localPath)
+	return transfer.Stat{Files: 1, Bytes: n}, err
+}
+
+func isRemoteDir(client *sftp.Client, p string) bool {
+	fi, err := client.Stat(p)
+	return err == nil && fi.IsDir()
+}
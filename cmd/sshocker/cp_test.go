@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestParseCpArg(t *testing.T) {
+	testCases := map[string]cpArg{
+		"/tmp/foo":                   {Path: "/tmp/foo"},
+		"./a:b":                      {Path: "./a:b"},
+		"foo/bar:baz":                {Path: "foo/bar:baz"},
+		"foo":                        {Path: "foo"},
+		"example.com:/tmp/foo":       {Host: "example.com", Path: "/tmp/foo"},
+		"user@example.com:foo":       {Host: "user@example.com", Path: "foo"},
+		"user@example.com:":          {Host: "user@example.com", Path: "."},
+		"user@example.com:2222:/tmp": {Host: "user@example.com", Port: 2222, Path: "/tmp"},
+	}
+	for k, v := range testCases {
+		got, err := parseCpArg(k)
+		if err != nil {
+			t.Errorf("failed to parse %q: %v", k, err)
+			continue
+		}
+		if got != v {
+			t.Errorf("expected %+v, got %+v for %q", v, got, k)
+		}
+	}
+}
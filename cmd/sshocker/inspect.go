@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/lima-vm/sshocker/pkg/inspect"
+	"github.com/urfave/cli/v2"
+)
+
+var inspectCommand = &cli.Command{
+	Name:      "inspect",
+	Usage:     "Print the state and the metrics of the running `sshocker run` sessions in JSON",
+	ArgsUsage: "[PID...]",
+	Action:    inspectAction,
+}
+
+func inspectAction(clicontext *cli.Context) error {
+	states := []inspect.State{}
+	if clicontext.NArg() == 0 {
+		all, err := inspect.List()
+		if err != nil {
+			return err
+		}
+		states = append(states, all...)
+	}
+	for _, arg := range clicontext.Args().Slice() {
+		pid, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("cannot parse PID %q: %w", arg, err)
+		}
+		st, err := inspect.Query(pid)
+		if err != nil {
+			return fmt.Errorf("failed to inspect the session %d: %w", pid, err)
+		}
+		states = append(states, *st)
+	}
+	enc := json.NewEncoder(clicontext.App.Writer)
+	enc.SetIndent("", "    ")
+	return enc.Encode(states)
+}
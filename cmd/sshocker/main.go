@@ -40,7 +40,7 @@ func newApp() *cli.App {
 		}
 		return nil
 	}
-	app.Commands = []*cli.Command{runCommand}
+	app.Commands = []*cli.Command{runCommand, cpCommand, benchCommand, inspectCommand, presetsCommand, versionCommand}
 	app.Action = runAction
 	return app
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/lima-vm/sshocker/pkg/reversesshfs"
+	"github.com/urfave/cli/v2"
+)
+
+var presetsCommand = &cli.Command{
+	Name:   "presets",
+	Usage:  "List the sshfs option presets for `--mount ...,preset=NAME`",
+	Action: presetsAction,
+}
+
+func presetsAction(clicontext *cli.Context) error {
+	w := tabwriter.NewWriter(clicontext.App.Writer, 4, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSSHFS OPTIONS\tSSH OPTIONS\tDESCRIPTION")
+	for _, p := range reversesshfs.Presets() {
+		sshOpts := strings.Join(p.SSHOptions, " ")
+		if sshOpts == "" {
+			sshOpts = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Name, strings.Join(p.SSHFSOptions, " "), sshOpts, p.Description)
+	}
+	return w.Flush()
+}
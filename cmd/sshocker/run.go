@@ -3,15 +3,26 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"os"
 	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/lima-vm/sshocker/pkg/events"
+	"github.com/lima-vm/sshocker/pkg/inspect"
+	"github.com/lima-vm/sshocker/pkg/metrics"
 	"github.com/lima-vm/sshocker/pkg/mount"
+	"github.com/lima-vm/sshocker/pkg/notify"
+	"github.com/lima-vm/sshocker/pkg/reversesshfs"
 	"github.com/lima-vm/sshocker/pkg/ssh"
 	"github.com/lima-vm/sshocker/pkg/sshocker"
+	"github.com/lima-vm/sshocker/pkg/util"
+	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
 
@@ -31,7 +42,14 @@ var (
 			Name: "v",
 			Usage: "Mount a reverse SSHFS, " +
 				"e.g. `.:/mnt/ssh` to mount the current directory on the client onto /mnt/ssh on the server, " +
-				"append `:ro` for read-only mount",
+				"append `:ro` for read-only mount, `:notify` for propagating local file change notifications, " +
+				"`:overlay` for protecting the local directory with a copy-on-write overlay, " +
+				"or comma-separated options such as `:ro,notify`",
+		},
+		&cli.StringSliceFlag{
+			Name: "mount",
+			Usage: "Mount a directory, e.g. `type=sync,source=.,target=/mnt/sync,exclude=.git,pull-back`. " +
+				"The type is \"reverse-sshfs\" (default) or \"sync\"",
 		},
 		&cli.StringSliceFlag{
 			Name:  "p",
@@ -46,9 +64,14 @@ var (
 			Name:  "sshfs-option",
 			Usage: "Set sshfs mount options.",
 		},
+		&cli.StringSliceFlag{
+			Name:  "notify-ignore",
+			Usage: "gitignore-style patterns to be ignored by `-v ...:notify`",
+			Value: cli.NewStringSlice(notify.DefaultIgnore...),
+		},
 		&cli.StringFlag{
 			Name:  "driver",
-			Usage: "SFTP server driver. \"builtin\" (legacy) or \"openssh-sftp-server\" (robust and secure, recommended), automatically chosen by default",
+			Usage: "SFTP server driver. \"builtin\" (legacy), \"openssh-sftp-server\" (robust and secure, recommended), or \"exec:COMMAND [ARGS...]\", automatically chosen by default",
 			Value: "auto",
 		},
 		&cli.StringFlag{
@@ -56,6 +79,59 @@ var (
 			Usage: "OpenSSH SFTP Server binary, automatically chosen by default",
 			Value: "",
 		},
+		&cli.BoolFlag{
+			Name:  "sandbox",
+			Usage: "Confine the SFTP server process to the mounted directory with Landlock (Linux 5.13 or later)",
+		},
+		&cli.StringFlag{
+			Name:  "sshfs-transport",
+			Usage: "Transport of the SFTP sessions for sshfs. \"stdio\" (ssh stdio) or \"direct\" (over a Unix socket forwarded by the ssh master)",
+			Value: reversesshfs.TransportStdio,
+		},
+		&cli.BoolFlag{
+			Name:  "remote-sudo",
+			Usage: "Execute sshfs via `sudo -n` on the server, so that the reverse-sshfs mounts are accessible by the other users",
+		},
+		&cli.BoolFlag{
+			Name:  "multiplex",
+			Usage: "Serve the reverse-sshfs mounts in a single SSH session and SFTP server, instead of one per mount",
+		},
+		&cli.BoolFlag{
+			Name:  "overlay-commit",
+			Usage: "Apply the changes made on the overlay mounts to the local directories on exit",
+		},
+		&cli.BoolFlag{
+			Name:  "keep-mountpoint",
+			Usage: "Do not remove the remote mountpoint directories created by sshocker on exit",
+		},
+		&cli.StringFlag{
+			Name:  "forward-upstream-limit",
+			Usage: "Max bytes per second from the local clients to the remote, per `-p` forward, e.g. `1M`",
+		},
+		&cli.StringFlag{
+			Name:  "forward-downstream-limit",
+			Usage: "Max bytes per second from the remote to the local clients, per `-p` forward, e.g. `1M`",
+		},
+		&cli.StringFlag{
+			Name:  "metrics-listen",
+			Usage: "Serve the metrics of the mounts and the forwards in the Prometheus text format, e.g. `127.0.0.1:9100`",
+		},
+		&cli.StringSliceFlag{
+			Name:  "copy-out",
+			Usage: "Copy out the remote files after the command succeeded, e.g. `/build/dist/*.tar.gz:./dist`",
+		},
+		&cli.BoolFlag{
+			Name:  "copy-out-always",
+			Usage: "Copy out the remote files even when the command failed",
+		},
+		&cli.StringFlag{
+			Name:  "events",
+			Usage: "Emit lifecycle events in the specified format (\"json\")",
+		},
+		&cli.StringFlag{
+			Name:  "events-output",
+			Usage: "Destination of the events, e.g. `fd:3`, `unix:/tmp/sshocker-events.sock`, or a file path (required for --events)",
+		},
 	}
 	runCommand = &cli.Command{
 		Name:   "run",
@@ -111,6 +187,23 @@ func runAction(clicontext *cli.Context) error {
 		Driver:                  clicontext.String("driver"),
 		OpensshSftpServerBinary: clicontext.String("openssh-sftp-server"),
 	}
+	switch eventsFormat := clicontext.String("events"); eventsFormat {
+	case "":
+		// NOP
+	case "json":
+		if !clicontext.IsSet("events-output") {
+			// Not defaulted to stdout or stderr, as they are used by the remote command and the logs
+			return errors.New("--events=json requires --events-output, e.g., --events-output=fd:3")
+		}
+		w, err := openEventsOutput(clicontext.String("events-output"))
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		x.EventHandler = events.NewJSONHandler(w)
+	default:
+		return fmt.Errorf("unknown events format %q", eventsFormat)
+	}
 	if len(x.Command) > 0 && x.Command[0] == "--" {
 		x.Command = x.Command[1:]
 	}
@@ -119,8 +212,43 @@ func runAction(clicontext *cli.Context) error {
 		if err != nil {
 			return err
 		}
+		if m.Notify {
+			m.NotifyIgnore = clicontext.StringSlice("notify-ignore")
+		}
+		x.Mounts = append(x.Mounts, m)
+	}
+	for _, v := range clicontext.StringSlice("mount") {
+		m, err := parseFlagMount(v)
+		if err != nil {
+			return err
+		}
+		if m.Notify && len(m.NotifyIgnore) == 0 {
+			m.NotifyIgnore = clicontext.StringSlice("notify-ignore")
+		}
 		x.Mounts = append(x.Mounts, m)
 	}
+	for _, v := range clicontext.StringSlice("copy-out") {
+		co, err := parseFlagCopyOut(v)
+		if err != nil {
+			return err
+		}
+		x.CopyOuts = append(x.CopyOuts, co)
+	}
+	x.CopyOutAlways = clicontext.Bool("copy-out-always")
+	x.OverlayCommit = clicontext.Bool("overlay-commit")
+	x.KeepMountpoint = clicontext.Bool("keep-mountpoint")
+	x.Sandbox = clicontext.Bool("sandbox")
+	x.Multiplex = clicontext.Bool("multiplex")
+	x.RemoteSudo = clicontext.Bool("remote-sudo")
+	switch transport := clicontext.String("sshfs-transport"); transport {
+	case reversesshfs.TransportStdio, reversesshfs.TransportDirect:
+		if transport == reversesshfs.TransportDirect && !sshConfig.Persist {
+			return errors.New("--sshfs-transport=direct requires --ssh-persist")
+		}
+		x.Transport = transport
+	default:
+		return fmt.Errorf("unknown sshfs transport %q", transport)
+	}
 	for _, p := range clicontext.StringSlice("p") {
 		lforward, err := parseFlagP(p)
 		if err != nil {
@@ -128,9 +256,97 @@ func runAction(clicontext *cli.Context) error {
 		}
 		x.LForwards = append(x.LForwards, lforward)
 	}
+	for _, f := range []struct {
+		name  string
+		limit *int64
+	}{
+		{"forward-upstream-limit", &x.ForwardUpstreamLimit},
+		{"forward-downstream-limit", &x.ForwardDownstreamLimit},
+	} {
+		if v := clicontext.String(f.name); v != "" {
+			limit, err := util.ParseSize(v)
+			if err != nil {
+				return fmt.Errorf("cannot parse --%s: %w", f.name, err)
+			}
+			*f.limit = limit
+		}
+	}
+	// The metrics of the mounts are always collected for `sshocker inspect`
+	x.Metrics = metrics.NewRegistry()
+	if addr := clicontext.String("metrics-listen"); addr != "" {
+		// Serve the forwards by sshocker itself, so that their metrics are collected too
+		x.ForwardProxy = true
+		closeMetrics, err := serveMetrics(addr, x.Metrics)
+		if err != nil {
+			return err
+		}
+		defer closeMetrics()
+	}
+	if closeInspect, err := inspect.Serve(x.Inspect); err != nil {
+		// Not fatal, as the session itself does not need inspect
+		logrus.WithError(err).Warn("failed to serve the state for `sshocker inspect`")
+	} else {
+		defer closeInspect()
+	}
 	return x.Run()
 }
 
+// serveMetrics serves the metrics on "http://ADDR/metrics".
+func serveMetrics(addr string, reg *metrics.Registry) (func() error, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %q for the metrics: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", reg)
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.WithError(err).Warn("failed to serve the metrics")
+		}
+	}()
+	logrus.Debugf("Serving the metrics on http://%s/metrics", ln.Addr())
+	return srv.Close, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// openEventsOutput opens the destination of the events.
+// s is like "fd:3", "unix:/tmp/sshocker-events.sock", or a file path.
+func openEventsOutput(s string) (io.WriteCloser, error) {
+	switch {
+	case strings.HasPrefix(s, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(s, "fd:"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %q: %w", s, err)
+		}
+		f := os.NewFile(uintptr(fd), s)
+		if f == nil {
+			return nil, fmt.Errorf("invalid file descriptor %q", s)
+		}
+		if _, err := f.Stat(); err != nil {
+			return nil, fmt.Errorf("cannot use %q: %w", s, err)
+		}
+		// Do not close the file descriptor, as it may be stderr
+		return nopWriteCloser{f}, nil
+	case strings.HasPrefix(s, "unix:"):
+		return net.Dial("unix", strings.TrimPrefix(s, "unix:"))
+	case s == "":
+		return nil, errors.New("got empty events output")
+	default:
+		return os.OpenFile(s, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	}
+}
+
 func expandLocalPath(localPath string) (string, error) {
 	s := localPath
 	if s == "" {
@@ -149,6 +365,23 @@ func expandLocalPath(localPath string) (string, error) {
 	return filepath.Abs(s)
 }
 
+// parseFlagCopyOut parses --copy-out flag.
+// The local directory may contain ":" (e.g., `C:\dist`), but the remote glob may not.
+func parseFlagCopyOut(s string) (sshocker.CopyOut, error) {
+	var co sshocker.CopyOut
+	remoteGlob, localDir, ok := strings.Cut(s, ":")
+	if !ok || remoteGlob == "" || localDir == "" {
+		return co, fmt.Errorf("cannot parse %q, should be REMOTE_GLOB:LOCALDIR", s)
+	}
+	co.RemoteGlob = remoteGlob
+	var err error
+	co.LocalDir, err = expandLocalPath(localDir)
+	if err != nil {
+		return co, fmt.Errorf("cannot use %q: %w", s, err)
+	}
+	return co, nil
+}
+
 // parseFlagV parses -v flag, akin to `docker run -v` flags.
 func parseFlagV(s string) (mount.Mount, error) {
 	m := mount.Mount{
@@ -163,14 +396,24 @@ func parseFlagV(s string) (mount.Mount, error) {
 	case 3:
 		m.Source = split[0]
 		m.Destination = split[1]
-		if split[2] == "ro" {
-			m.Readonly = true
-		} else {
-			return m, fmt.Errorf("cannot parse %q: unknown option %q", s, split[2])
+		for _, o := range strings.Split(split[2], ",") {
+			switch o {
+			case "ro":
+				m.Readonly = true
+			case "notify":
+				m.Notify = true
+			case "overlay":
+				m.Overlay = true
+			default:
+				return m, fmt.Errorf("cannot parse %q: unknown option %q", s, o)
+			}
 		}
 	default:
 		return m, fmt.Errorf("cannot parse %q", s)
 	}
+	if m.Readonly && m.Overlay {
+		return m, fmt.Errorf("cannot parse %q: \"ro\" and \"overlay\" are mutually exclusive", s)
+	}
 	var err error
 	m.Source, err = expandLocalPath(m.Source)
 	if err != nil {
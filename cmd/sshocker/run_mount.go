@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lima-vm/sshocker/pkg/mount"
+	"github.com/lima-vm/sshocker/pkg/reversesshfs"
+	"github.com/lima-vm/sshocker/pkg/util"
+)
+
+// parseFlagMount parses --mount flag, akin to `docker run --mount` flags.
+// e.g., "type=sync,source=.,target=/mnt/sync,exclude=.git,pull-back"
+func parseFlagMount(s string) (mount.Mount, error) {
+	m := mount.Mount{
+		Type: mount.MountTypeReverseSSHFS,
+	}
+	for _, field := range strings.Split(s, ",") {
+		k, v, hasValue := strings.Cut(field, "=")
+		switch k {
+		case "type":
+			switch v {
+			case "reverse-sshfs":
+				m.Type = mount.MountTypeReverseSSHFS
+			case "sync":
+				m.Type = mount.MountTypeSync
+			default:
+				return m, fmt.Errorf("cannot parse %q: unknown mount type %q", s, v)
+			}
+		case "source", "src":
+			m.Source = v
+		case "target", "destination", "dst":
+			m.Destination = v
+		case "readonly", "ro":
+			if hasValue && v != "true" {
+				if v != "false" {
+					return m, fmt.Errorf("cannot parse %q: invalid value for %q: %q", s, k, v)
+				}
+				continue
+			}
+			m.Readonly = true
+		case "notify":
+			m.Notify = true
+		case "overlay":
+			m.Overlay = true
+		case "notify-ignore":
+			m.NotifyIgnore = append(m.NotifyIgnore, v)
+		case "include":
+			m.Include = append(m.Include, v)
+		case "exclude":
+			m.Exclude = append(m.Exclude, v)
+		case "gitignore":
+			m.Gitignore = true
+		case "audit-log":
+			m.AuditLog = v
+		case "audit-log-max-size":
+			size, err := util.ParseSize(v)
+			if err != nil {
+				return m, fmt.Errorf("cannot parse %q: %w", s, err)
+			}
+			m.AuditLogMaxSize = size
+		case "read-limit", "write-limit":
+			limit, err := util.ParseSize(v)
+			if err != nil {
+				return m, fmt.Errorf("cannot parse %q: %w", s, err)
+			}
+			if k == "read-limit" {
+				m.ReadLimit = limit
+			} else {
+				m.WriteLimit = limit
+			}
+		case "audit-log-max-backups":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return m, fmt.Errorf("cannot parse %q: invalid value for %q: %q", s, k, v)
+			}
+			m.AuditLogMaxBackups = n
+		case "uid-map":
+			if _, err := strconv.ParseUint(v, 10, 32); err != nil && v != "user" {
+				return m, fmt.Errorf("cannot parse %q: invalid value for %q: %q (should be \"user\" or a numeric UID)", s, k, v)
+			}
+			m.UIDMap = v
+		case "gid-map":
+			if _, err := strconv.ParseUint(v, 10, 32); err != nil {
+				return m, fmt.Errorf("cannot parse %q: invalid value for %q: %q (should be a numeric GID)", s, k, v)
+			}
+			m.GIDMap = v
+		case "umask":
+			if umask, err := strconv.ParseUint(v, 8, 32); err != nil || umask > 0o777 {
+				return m, fmt.Errorf("cannot parse %q: invalid value for %q: %q (should be an octal number such as \"022\")", s, k, v)
+			}
+			m.Umask = v
+		case "squash":
+			m.Squash = true
+		case "allow-other":
+			m.AllowOther = true
+		case "sftp-deny", "sftp-allow":
+			if v == "" {
+				return m, fmt.Errorf("cannot parse %q: %q requires an SFTP request name, e.g., %q", s, k, "remove")
+			}
+			if k == "sftp-deny" {
+				m.SFTPDeny = append(m.SFTPDeny, v)
+			} else {
+				m.SFTPAllow = append(m.SFTPAllow, v)
+			}
+		case "preset":
+			if _, ok := reversesshfs.LookupPreset(v); !ok {
+				return m, fmt.Errorf("cannot parse %q: unknown preset %q, should be one of %v", s, v, reversesshfs.PresetNames())
+			}
+			m.Preset = v
+		case "pull-back":
+			m.PullBack = true
+		default:
+			return m, fmt.Errorf("cannot parse %q: unknown option %q", s, k)
+		}
+	}
+	if m.Source == "" || m.Destination == "" {
+		return m, fmt.Errorf("cannot parse %q: source and target are required", s)
+	}
+	switch m.Type {
+	case mount.MountTypeReverseSSHFS:
+		if m.PullBack {
+			return m, fmt.Errorf("cannot parse %q: \"pull-back\" is supported only for \"type=sync\"", s)
+		}
+		if m.Readonly && m.Overlay {
+			return m, fmt.Errorf("cannot parse %q: \"readonly\" and \"overlay\" are mutually exclusive", s)
+		}
+		if m.Squash && (m.UIDMap != "" || m.GIDMap != "") {
+			return m, fmt.Errorf("cannot parse %q: \"squash\" cannot be combined with \"uid-map\" and \"gid-map\"", s)
+		}
+	case mount.MountTypeSync:
+		if m.Notify || m.Overlay || len(m.Include) > 0 || m.Gitignore || m.AuditLog != "" || m.ReadLimit != 0 || m.WriteLimit != 0 ||
+			m.UIDMap != "" || m.GIDMap != "" || m.Umask != "" || m.Squash || len(m.SFTPDeny) > 0 || len(m.SFTPAllow) > 0 || m.Preset != "" || m.AllowOther {
+			return m, fmt.Errorf("cannot parse %q: \"notify\", \"overlay\", \"include\", \"gitignore\", \"audit-log\", \"read-limit\", \"write-limit\", \"uid-map\", \"gid-map\", \"umask\", \"squash\", \"sftp-deny\", \"sftp-allow\", \"preset\", and \"allow-other\" are not supported for \"type=sync\"", s)
+		}
+		if m.Readonly && m.PullBack {
+			return m, errors.New("\"readonly\" and \"pull-back\" are mutually exclusive")
+		}
+	}
+	if (m.AuditLogMaxSize != 0 || m.AuditLogMaxBackups != 0) && m.AuditLog == "" {
+		return m, fmt.Errorf("cannot parse %q: \"audit-log-max-size\" and \"audit-log-max-backups\" require \"audit-log\"", s)
+	}
+	var err error
+	m.Source, err = expandLocalPath(m.Source)
+	if err != nil {
+		return m, fmt.Errorf("cannot use %q: %w", s, err)
+	}
+	if m.AuditLog != "" {
+		m.AuditLog, err = expandLocalPath(m.AuditLog)
+		if err != nil {
+			return m, fmt.Errorf("cannot use %q: %w", s, err)
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lima-vm/sshocker/pkg/mount"
+)
+
+func TestParseFlagMount(t *testing.T) {
+	testCases := map[string]*mount.Mount{
+		"source=/foo,target=/mnt/foo": {
+			Type:        mount.MountTypeReverseSSHFS,
+			Source:      "/foo",
+			Destination: "/mnt/foo",
+		},
+		"type=reverse-sshfs,src=/foo,dst=/mnt/foo,readonly,notify": {
+			Type:        mount.MountTypeReverseSSHFS,
+			Source:      "/foo",
+			Destination: "/mnt/foo",
+			Readonly:    true,
+			Notify:      true,
+		},
+		"source=/foo,target=/mnt/foo,overlay": {
+			Type:        mount.MountTypeReverseSSHFS,
+			Source:      "/foo",
+			Destination: "/mnt/foo",
+			Overlay:     true,
+		},
+		"source=/foo,target=/mnt/foo,include=src/,exclude=.env,exclude=secrets/,gitignore": {
+			Type:        mount.MountTypeReverseSSHFS,
+			Source:      "/foo",
+			Destination: "/mnt/foo",
+			Include:     []string{"src/"},
+			Exclude:     []string{".env", "secrets/"},
+			Gitignore:   true,
+		},
+		"source=/foo,target=/mnt/foo,audit-log=/var/log/foo.jsonl,audit-log-max-size=10M,audit-log-max-backups=3": {
+			Type:               mount.MountTypeReverseSSHFS,
+			Source:             "/foo",
+			Destination:        "/mnt/foo",
+			AuditLog:           "/var/log/foo.jsonl",
+			AuditLogMaxSize:    10 << 20,
+			AuditLogMaxBackups: 3,
+		},
+		"source=/foo,target=/mnt/foo,read-limit=1M,write-limit=512K": {
+			Type:        mount.MountTypeReverseSSHFS,
+			Source:      "/foo",
+			Destination: "/mnt/foo",
+			ReadLimit:   1 << 20,
+			WriteLimit:  512 << 10,
+		},
+		"source=/foo,target=/mnt/foo,uid-map=user,gid-map=100,umask=022": {
+			Type:        mount.MountTypeReverseSSHFS,
+			Source:      "/foo",
+			Destination: "/mnt/foo",
+			UIDMap:      "user",
+			GIDMap:      "100",
+			Umask:       "022",
+		},
+		"source=/foo,target=/mnt/foo,squash": {
+			Type:        mount.MountTypeReverseSSHFS,
+			Source:      "/foo",
+			Destination: "/mnt/foo",
+			Squash:      true,
+		},
+		"source=/foo,target=/mnt/foo,sftp-deny=remove,sftp-deny=rmdir,sftp-allow=open": {
+			Type:        mount.MountTypeReverseSSHFS,
+			Source:      "/foo",
+			Destination: "/mnt/foo",
+			SFTPDeny:    []string{"remove", "rmdir"},
+			SFTPAllow:   []string{"open"},
+		},
+		"source=/foo,target=/mnt/foo,allow-other,uid-map=1000": {
+			Type:        mount.MountTypeReverseSSHFS,
+			Source:      "/foo",
+			Destination: "/mnt/foo",
+			AllowOther:  true,
+			UIDMap:      "1000",
+		},
+		"source=/foo,target=/mnt/foo,preset=source-code": {
+			Type:        mount.MountTypeReverseSSHFS,
+			Source:      "/foo",
+			Destination: "/mnt/foo",
+			Preset:      "source-code",
+		},
+		"type=sync,source=/foo,target=/mnt/foo,exclude=.git,exclude=node_modules,pull-back": {
+			Type:        mount.MountTypeSync,
+			Source:      "/foo",
+			Destination: "/mnt/foo",
+			Exclude:     []string{".git", "node_modules"},
+			PullBack:    true,
+		},
+		"type=sync,source=/foo,target=/mnt/foo,readonly=false": {
+			Type:        mount.MountTypeSync,
+			Source:      "/foo",
+			Destination: "/mnt/foo",
+		},
+		"type=sync,source=/foo,target=/mnt/foo,readonly,pull-back":        nil,
+		"type=sync,source=/foo,target=/mnt/foo,notify":                    nil,
+		"source=/foo,target=/mnt/foo,pull-back":                           nil,
+		"source=/foo,target=/mnt/foo,readonly,overlay":                    nil,
+		"type=sync,source=/foo,target=/mnt/foo,overlay":                   nil,
+		"type=sync,source=/foo,target=/mnt/foo,gitignore":                 nil,
+		"source=/foo,target=/mnt/foo,audit-log-max-size=10M":              nil,
+		"source=/foo,target=/mnt/foo,audit-log=/a,audit-log-max-size=10X": nil,
+		"source=/foo,target=/mnt/foo,uid-map=nobody":                      nil,
+		"source=/foo,target=/mnt/foo,umask=999":                           nil,
+		"source=/foo,target=/mnt/foo,squash,uid-map=1000":                 nil,
+		"type=sync,source=/foo,target=/mnt/foo,squash":                    nil,
+		"type=sync,source=/foo,target=/mnt/foo,sftp-deny=remove":          nil,
+		"source=/foo,target=/mnt/foo,sftp-deny":                           nil,
+		"source=/foo,target=/mnt/foo,preset=fast":                         nil,
+		"type=sync,source=/foo,target=/mnt/foo,preset=media":              nil,
+		"type=sync,source=/foo,target=/mnt/foo,allow-other":               nil,
+		"type=nfs,source=/foo,target=/mnt/foo":                            nil,
+		"source=/foo":                                                     nil,
+		"source=/foo,target=/mnt/foo,foo=bar":                             nil,
+	}
+	for k, v := range testCases {
+		got, err := parseFlagMount(k)
+		if v == nil {
+			if err == nil {
+				t.Errorf("error is expected for %q", k)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed to parse %q: %v", k, err)
+			continue
+		}
+		expected := *v
+		expected.Source, _ = filepath.Abs(expected.Source)
+		if expected.AuditLog != "" {
+			expected.AuditLog, _ = filepath.Abs(expected.AuditLog)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %+v, got %+v for %q", expected, got, k)
+		}
+	}
+}
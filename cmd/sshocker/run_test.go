@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseFlagV(t *testing.T) {
+	type testCase struct {
+		s        string
+		readonly bool
+		notify   bool
+		overlay  bool
+		err      bool
+	}
+	testCases := []testCase{
+		{s: "/foo:/mnt/foo"},
+		{s: "/foo:/mnt/foo:ro", readonly: true},
+		{s: "/foo:/mnt/foo:notify", notify: true},
+		{s: "/foo:/mnt/foo:ro,notify", readonly: true, notify: true},
+		{s: "/foo:/mnt/foo:overlay", overlay: true},
+		{s: "/foo:/mnt/foo:ro,overlay", err: true},
+		{s: "/foo:/mnt/foo:rw", err: true},
+		{s: "/foo", err: true},
+	}
+	for i, tc := range testCases {
+		m, err := parseFlagV(tc.s)
+		if tc.err {
+			if err == nil {
+				t.Errorf("#%d: error is expected for %q", i, tc.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: failed to parse %q: %v", i, tc.s, err)
+			continue
+		}
+		if expected, _ := filepath.Abs("/foo"); m.Source != expected {
+			t.Errorf("#%d: expected source %q, got %q", i, expected, m.Source)
+		}
+		if m.Destination != "/mnt/foo" {
+			t.Errorf("#%d: expected destination %q, got %q", i, "/mnt/foo", m.Destination)
+		}
+		if m.Readonly != tc.readonly || m.Notify != tc.notify || m.Overlay != tc.overlay {
+			t.Errorf("#%d: expected readonly=%v notify=%v overlay=%v, got %+v", i, tc.readonly, tc.notify, tc.overlay, m)
+		}
+	}
+}
+
+func TestParseFlagCopyOut(t *testing.T) {
+	co, err := parseFlagCopyOut("/build/dist/*.tar.gz:/tmp/dist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if co.RemoteGlob != "/build/dist/*.tar.gz" {
+		t.Errorf("expected remote glob %q, got %q", "/build/dist/*.tar.gz", co.RemoteGlob)
+	}
+	if expected, _ := filepath.Abs("/tmp/dist"); co.LocalDir != expected {
+		t.Errorf("expected local dir %q, got %q", expected, co.LocalDir)
+	}
+	for _, s := range []string{"/build/dist", ":/tmp/dist", "/build/dist:"} {
+		if _, err := parseFlagCopyOut(s); err == nil {
+			t.Errorf("error is expected for %q", s)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/lima-vm/sshocker/pkg/reversesshfs"
+	"github.com/lima-vm/sshocker/pkg/version"
+	"github.com/urfave/cli/v2"
+)
+
+var versionCommand = &cli.Command{
+	Name:   "version",
+	Usage:  "Print the version",
+	Action: versionAction,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "verbose",
+			Usage: "also print the SFTP server driver chosen by default",
+		},
+	},
+}
+
+func versionAction(clicontext *cli.Context) error {
+	w := clicontext.App.Writer
+	fmt.Fprintf(w, "sshocker version %s\n", version.Version)
+	if !clicontext.Bool("verbose") {
+		return nil
+	}
+	fmt.Fprintf(w, "Available drivers: %v\n", reversesshfs.Drivers())
+	server, err := reversesshfs.DetectOpensshSftpServer()
+	if err != nil {
+		fmt.Fprintf(w, "Default driver: %s (%v)\n", reversesshfs.DriverBuiltin, err)
+		return nil
+	}
+	serverVersion := server.Version
+	if serverVersion == "" {
+		serverVersion = "unknown version"
+	}
+	fmt.Fprintf(w, "Default driver: %s\n", reversesshfs.DriverOpensshSftpServer)
+	fmt.Fprintf(w, "OpenSSH SFTP Server: %s (%s, flags: -%s)\n", server.Path, serverVersion, server.Flags)
+	return nil
+}
@@ -1,11 +1,13 @@
 module github.com/lima-vm/sshocker
 
-go 1.24.0
+go 1.25.0
 
 require (
+	github.com/fsnotify/fsnotify v1.10.1
 	github.com/pkg/sftp v1.13.10
 	github.com/sirupsen/logrus v1.9.4
 	github.com/urfave/cli/v2 v2.27.7
+	golang.org/x/sys v0.38.0
 )
 
 require (
@@ -14,5 +16,4 @@ require (
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20240521201337-686a1a2994c1 // indirect
 	golang.org/x/crypto v0.45.0 // indirect
-	golang.org/x/sys v0.38.0 // indirect
 )
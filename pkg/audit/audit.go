@@ -0,0 +1,179 @@
+// Package audit implements the access audit log of the mounts.
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+type Op = string
+
+const (
+	OpRead    = Op("read")
+	OpWrite   = Op("write")
+	OpSetstat = Op("setstat")
+	OpRename  = Op("rename")
+	OpRemove  = Op("remove")
+	OpRmdir   = Op("rmdir")
+	OpMkdir   = Op("mkdir")
+	OpSymlink = Op("symlink")
+	OpList    = Op("list")
+)
+
+// ResultOK is the Result of the successful operations.
+const ResultOK = "ok"
+
+// Record is an audit record.
+// Metadata lookups such as stat are not recorded.
+type Record struct {
+	Time   time.Time `json:"time"`
+	Op     Op        `json:"op"`
+	Path   string    `json:"path"`             // relative to the root of the mount, e.g., "/foo/bar"
+	Target string    `json:"target,omitempty"` // rename, symlink
+	Bytes  int64     `json:"bytes"`            // read, write
+	Result string    `json:"result"`           // ResultOK or the error string
+}
+
+// Handler receives audit records.
+// Handler may be called from multiple goroutines.
+type Handler = func(Record)
+
+// Emit calls h with rec, after filling rec.Time and rec.Result from err.
+// Emit is a no-op when h is nil.
+func Emit(h Handler, rec Record, err error) {
+	if h == nil {
+		return
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	if err != nil {
+		rec.Result = err.Error()
+	} else if rec.Result == "" {
+		rec.Result = ResultOK
+	}
+	h(rec)
+}
+
+// EmitTransfer emits the records for a closed file handle.
+// A record is emitted for each of reading and writing, when any byte was transferred.
+// Otherwise a record is emitted for defaultOp.
+func EmitTransfer(h Handler, path string, read, written int64, defaultOp Op, err error) {
+	if read == 0 && written == 0 {
+		Emit(h, Record{Op: defaultOp, Path: path}, err)
+		return
+	}
+	if read > 0 {
+		Emit(h, Record{Op: OpRead, Path: path, Bytes: read}, err)
+	}
+	if written > 0 {
+		Emit(h, Record{Op: OpWrite, Path: path, Bytes: written}, err)
+	}
+}
+
+// DefaultMaxBackups is the default number of the rotated files to be kept.
+const DefaultMaxBackups = 5
+
+// Logger writes the records to a file in the JSON Lines format.
+type Logger struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	mu         sync.Mutex
+	f          *os.File
+	size       int64
+}
+
+// NewLogger opens the file for appending the records.
+// The file is rotated to path.1, path.2, ..., when its size exceeds maxSize.
+// maxSize <= 0 disables the rotation. maxBackups <= 0 means DefaultMaxBackups.
+func NewLogger(path string, maxSize int64, maxBackups int) (*Logger, error) {
+	if maxBackups <= 0 {
+		maxBackups = DefaultMaxBackups
+	}
+	l := &Logger{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open the audit log %q: %w", l.path, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	l.f = f
+	l.size = fi.Size()
+	return nil
+}
+
+// rotate rotates the file. The file is reopened even on an error.
+func (l *Logger) rotate() error {
+	var errs []error
+	if err := l.f.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	l.f = nil
+	for i := l.maxBackups - 1; i >= 1; i-- {
+		old := fmt.Sprintf("%s.%d", l.path, i)
+		if err := os.Rename(old, fmt.Sprintf("%s.%d", l.path, i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		errs = append(errs, err)
+	}
+	if err := l.open(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Log writes rec. Errors are ignored, and Log is a no-op after Close.
+// Log implements Handler.
+func (l *Logger) Log(rec Record) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		_ = l.rotate()
+		if l.f == nil {
+			return
+		}
+	}
+	n, _ := l.f.Write(b)
+	l.size += int64(n)
+}
+
+// Close closes the file.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
@@ -0,0 +1,111 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func readRecords(t *testing.T, p string) []Record {
+	t.Helper()
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var res []Record
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, rec)
+	}
+	return res
+}
+
+func TestLogger(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "audit.log")
+	l, err := NewLogger(p, 300, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		Emit(l.Log, Record{Op: OpRead, Path: "/foo", Bytes: int64(i)}, nil)
+	}
+	Emit(l.Log, Record{Op: OpRemove, Path: "/bar"}, errors.New("permission denied"))
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l.Log(Record{Op: OpRead, Path: "/after-close"})
+
+	recs := readRecords(t, p)
+	last := recs[len(recs)-1]
+	if last.Op != OpRemove || last.Path != "/bar" || last.Result != "permission denied" {
+		t.Errorf("unexpected last record %+v", last)
+	}
+	for _, s := range []string{".1", ".2"} {
+		if _, err := os.Stat(p + s); err != nil {
+			t.Errorf("expected the rotated file: %v", err)
+		}
+	}
+	if _, err := os.Stat(p + ".3"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no more than 2 rotated files, got %v", err)
+	}
+	for _, s := range []string{"", ".1", ".2"} {
+		fi, err := os.Stat(p + s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > 300 {
+			t.Errorf("expected %q to be rotated, got size %d", p+s, fi.Size())
+		}
+	}
+}
+
+func TestOpensshLogWriter(t *testing.T) {
+	var recs []Record
+	h := func(rec Record) {
+		// Time is not compared
+		recs = append(recs, Record{Op: rec.Op, Path: rec.Path, Target: rec.Target, Bytes: rec.Bytes, Result: rec.Result})
+	}
+	var passthrough bytes.Buffer
+	w := NewOpensshLogWriter(h, "/home/user/repo", &passthrough)
+	log := "session opened for local user user from [UNKNOWN]\r\n" +
+		"open \"/home/user/repo/foo\" flags READ mode 0666\r\n" +
+		"close \"/home/user/repo/foo\" bytes read 42 written 0\r\n" +
+		"opendir \"/home/user/repo\"\r\n" +
+		"sftp-server: close \"/home/user/repo/bar\" bytes read 1 written 2\r\n" +
+		"posix-rename old \"/home/user/repo/a\" new \"/home/user/repo/b\"\r\n" +
+		"symlink old \"a\" new \"/home/user/repo/link\"\r\n" +
+		"set \"/etc/passwd\" mode 0644\r\n" +
+		"error: process_write: write failed\r\n"
+	// Split in the middle of a line
+	if _, err := w.Write([]byte(log[:50])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(log[50:])); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Record{
+		{Op: OpRead, Path: "/foo", Bytes: 42, Result: ResultOK},
+		{Op: OpList, Path: "/", Result: ResultOK},
+		{Op: OpRead, Path: "/bar", Bytes: 1, Result: ResultOK},
+		{Op: OpWrite, Path: "/bar", Bytes: 2, Result: ResultOK},
+		{Op: OpRename, Path: "/a", Target: "/b", Result: ResultOK},
+		{Op: OpSymlink, Path: "/link", Target: "a", Result: ResultOK},
+		{Op: OpSetstat, Path: "/etc/passwd", Result: ResultOK},
+	}
+	if !reflect.DeepEqual(recs, expected) {
+		t.Errorf("expected %+v, got %+v", expected, recs)
+	}
+	if passthrough.String() != "error: process_write: write failed\n" {
+		t.Errorf("unexpected passthrough %q", passthrough.String())
+	}
+}
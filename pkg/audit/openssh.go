@@ -0,0 +1,114 @@
+package audit
+
+import (
+	"bytes"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// OpensshLogLevel is the `sftp-server -l` log level for NewOpensshLogWriter.
+const OpensshLogLevel = "INFO"
+
+var (
+	opensshCloseRe   = regexp.MustCompile(`^close "(.*)" bytes read (\d+) written (\d+)$`)
+	opensshOpendirRe = regexp.MustCompile(`^opendir "(.*)"$`)
+	opensshRemoveRe  = regexp.MustCompile(`^remove name "(.*)"$`)
+	opensshRmdirRe   = regexp.MustCompile(`^rmdir name "(.*)"$`)
+	opensshMkdirRe   = regexp.MustCompile(`^mkdir name "(.*)" mode \d+$`)
+	opensshRenameRe  = regexp.MustCompile(`^(?:posix-)?rename old "(.*)" new "(.*)"$`)
+	opensshSymlinkRe = regexp.MustCompile(`^symlink old "(.*)" new "(.*)"$`)
+	opensshSetRe     = regexp.MustCompile(`^set "(.*)" (?:size|mode|modtime|owner|flags) .*$`)
+)
+
+// NewOpensshLogWriter returns a writer that parses the log of `sftp-server -e -l INFO`,
+// and emits the records to h.
+// The paths under root are converted to be relative to root.
+//
+// The error messages are written to passthrough, and the other unrecognized messages are logged for debugging.
+// Failed operations are not logged by sftp-server at the INFO level, so every record has ResultOK.
+func NewOpensshLogWriter(h Handler, root string, passthrough io.Writer) io.Writer {
+	return &opensshLogWriter{h: h, root: root, passthrough: passthrough}
+}
+
+type opensshLogWriter struct {
+	h           Handler
+	root        string
+	passthrough io.Writer
+	mu          sync.Mutex
+	buf         []byte
+}
+
+func (w *opensshLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.line(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *opensshLogWriter) rel(p string) string {
+	if w.root == "" || w.root == "/" {
+		return p
+	}
+	if p == w.root {
+		return "/"
+	}
+	if strings.HasPrefix(p, w.root+"/") {
+		return path.Clean(strings.TrimPrefix(p, w.root))
+	}
+	return p
+}
+
+func (w *opensshLogWriter) line(s string) {
+	s = strings.TrimRight(s, "\r")
+	// Strip "sftp-server: " prefix, if any
+	msg := s
+	if prog, rest, ok := strings.Cut(s, ": "); ok && !strings.Contains(prog, " ") && prog != "error" && prog != "fatal" {
+		msg = rest
+	}
+	if strings.HasPrefix(msg, "error: ") || strings.HasPrefix(msg, "fatal: ") {
+		_, _ = io.WriteString(w.passthrough, s+"\n")
+		return
+	}
+	if m := opensshCloseRe.FindStringSubmatch(msg); m != nil {
+		read, _ := strconv.ParseInt(m[2], 10, 64)
+		written, _ := strconv.ParseInt(m[3], 10, 64)
+		EmitTransfer(w.h, w.rel(m[1]), read, written, OpRead, nil)
+		return
+	}
+	var rec Record
+	if m := opensshOpendirRe.FindStringSubmatch(msg); m != nil {
+		rec = Record{Op: OpList, Path: m[1]}
+	} else if m := opensshRemoveRe.FindStringSubmatch(msg); m != nil {
+		rec = Record{Op: OpRemove, Path: m[1]}
+	} else if m := opensshRmdirRe.FindStringSubmatch(msg); m != nil {
+		rec = Record{Op: OpRmdir, Path: m[1]}
+	} else if m := opensshMkdirRe.FindStringSubmatch(msg); m != nil {
+		rec = Record{Op: OpMkdir, Path: m[1]}
+	} else if m := opensshRenameRe.FindStringSubmatch(msg); m != nil {
+		rec = Record{Op: OpRename, Path: m[1], Target: w.rel(m[2])}
+	} else if m := opensshSymlinkRe.FindStringSubmatch(msg); m != nil {
+		// sftp-server logs the link target as "old", and the link path as "new"
+		rec = Record{Op: OpSymlink, Path: m[2], Target: m[1]}
+	} else if m := opensshSetRe.FindStringSubmatch(msg); m != nil {
+		rec = Record{Op: OpSetstat, Path: m[1]}
+	} else {
+		logrus.Debugf("sftp-server: %s", msg)
+		return
+	}
+	rec.Path = w.rel(rec.Path)
+	Emit(w.h, rec, nil)
+}
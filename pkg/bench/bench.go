@@ -0,0 +1,387 @@
+// Package bench measures the throughput of the reverse sshfs mounts and the ssh channels used by the forwards.
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lima-vm/sshocker/pkg/reversesshfs"
+	"github.com/lima-vm/sshocker/pkg/ssh"
+	"github.com/lima-vm/sshocker/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultFileSize is the default of Options.FileSize.
+	DefaultFileSize = 64 << 20
+	// DefaultSmallFiles is the default of Options.SmallFiles.
+	DefaultSmallFiles = 1000
+	// DefaultRTTSamples is the default of Options.RTTSamples.
+	DefaultRTTSamples = 20
+
+	smallFileSize = 1 << 10
+	bigFileName   = "big"
+	smallDirName  = "small"
+)
+
+// Mount is a configuration of the reverse sshfs to be benchmarked.
+type Mount struct {
+	Name      string                 // e.g., "builtin/source-code"
+	Driver    reversesshfs.Driver    // "NAME[:ARG]" of a registered driver
+	Transport reversesshfs.Transport // Optional. TransportStdio (default) or TransportDirect.
+	SSHFSArgs []string               // Additional arguments of sshfs, e.g., []string{"-o", "cache=no"}
+	SSHArgs   []string               // Additional arguments of ssh for the sshfs session. See ReverseSSHFS.SSHAdditionalArgs.
+}
+
+// Options is the configuration of Run.
+type Options struct {
+	*ssh.SSHConfig
+	Host        string
+	Port        int
+	Mounts      []Mount
+	FileSize    int64 // Size of the file for the read and write benchmarks. 0 means DefaultFileSize.
+	SmallFiles  int   // Number of the files for the metadata benchmark. 0 means DefaultSmallFiles.
+	ForwardSize int64 // Bytes sent for the forward throughput benchmark. 0 means FileSize.
+	RTTSamples  int   // Number of the round trips for the forward RTT benchmark. 0 means DefaultRTTSamples.
+}
+
+// MountResult is the result of a Mount.
+// The rates are zero when the benchmark failed.
+type MountResult struct {
+	Name                   string   `json:"name"`
+	Driver                 string   `json:"driver"`
+	Transport              string   `json:"transport"`
+	SSHFSArgs              []string `json:"sshfsArgs,omitempty"`
+	SSHArgs                []string `json:"sshArgs,omitempty"`
+	ReadBytesPerSecond     float64  `json:"readBytesPerSecond"`
+	WriteBytesPerSecond    float64  `json:"writeBytesPerSecond"`
+	MetadataFilesPerSecond float64  `json:"metadataFilesPerSecond"` // `ls -lR` over the small files
+	Error                  string   `json:"error,omitempty"`
+}
+
+// ForwardResult is the result of the forward benchmarks, measured over an ssh channel of the same connection as the forwards.
+type ForwardResult struct {
+	BytesPerSecond float64       `json:"bytesPerSecond"`
+	RTT            time.Duration `json:"rtt"` // Median, in nanoseconds
+	Error          string        `json:"error,omitempty"`
+}
+
+// Result is the result of Run.
+type Result struct {
+	Host       string        `json:"host"`
+	FileSize   int64         `json:"fileSize"`
+	SmallFiles int           `json:"smallFiles"`
+	Overhead   time.Duration `json:"overhead"` // Time to execute an empty script, subtracted from the measured times. In nanoseconds.
+	Mounts     []MountResult `json:"mounts"`
+	Forward    ForwardResult `json:"forward"`
+}
+
+// Run generates a local tree, mounts it on a temporary remote directory with each of opts.Mounts,
+// and measures the remote read, write, and metadata operations with ssh.ExecuteScript.
+// A failure of a Mount is recorded in MountResult.Error, not returned.
+//
+// The measured times include the execution of ssh, so opts.SSHConfig should use a master (ControlPersist).
+func Run(opts Options) (*Result, error) {
+	if opts.SSHConfig == nil {
+		return nil, errors.New("got nil SSHConfig")
+	}
+	if opts.FileSize == 0 {
+		opts.FileSize = DefaultFileSize
+	}
+	if opts.SmallFiles == 0 {
+		opts.SmallFiles = DefaultSmallFiles
+	}
+	if opts.ForwardSize == 0 {
+		opts.ForwardSize = opts.FileSize
+	}
+	if opts.RTTSamples == 0 {
+		opts.RTTSamples = DefaultRTTSamples
+	}
+	localDir, err := os.MkdirTemp("", "sshocker-bench-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(localDir)
+	logrus.Debugf("Generating %d bytes and %d small files in %q", opts.FileSize, opts.SmallFiles, localDir)
+	if err := generateTree(localDir, opts.FileSize, opts.SmallFiles); err != nil {
+		return nil, fmt.Errorf("failed to generate the tree in %q: %w", localDir, err)
+	}
+	remoteDir, err := mkdirRemoteTemp(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if rmErr := rmdirRemoteTemp(opts, remoteDir); rmErr != nil {
+			logrus.WithError(rmErr).Warnf("failed to remove %q (remote)", remoteDir)
+		}
+	}()
+	res := &Result{
+		Host:       opts.Host,
+		FileSize:   opts.FileSize,
+		SmallFiles: opts.SmallFiles,
+	}
+	res.Overhead, err = measureOverhead(opts)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debugf("Overhead of executing a script: %v", res.Overhead)
+	for i, m := range opts.Mounts {
+		logrus.Infof("Benchmarking mount %q", m.Name)
+		mountpoint := fmt.Sprintf("%s/%d", remoteDir, i)
+		mr := benchMount(opts, m, localDir, remoteDir, mountpoint, res.Overhead)
+		if mr.Error != "" {
+			logrus.Warnf("Mount %q failed: %s", m.Name, mr.Error)
+		}
+		res.Mounts = append(res.Mounts, mr)
+	}
+	logrus.Info("Benchmarking forward")
+	res.Forward = benchForward(opts, res.Overhead)
+	return res, nil
+}
+
+// generateTree writes a file of fileSize bytes and smallFiles files of 1KiB into dir.
+// The contents are random, so that the ssh compression does not inflate the results.
+func generateTree(dir string, fileSize int64, smallFiles int) error {
+	r := rand.NewChaCha8([32]byte{})
+	f, err := os.Create(filepath.Join(dir, bigFileName))
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, r, fileSize); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	smallDir := filepath.Join(dir, smallDirName)
+	if err := os.Mkdir(smallDir, 0o755); err != nil {
+		return err
+	}
+	b := make([]byte, smallFileSize)
+	for i := range smallFiles {
+		_, _ = r.Read(b)
+		if err := os.WriteFile(filepath.Join(smallDir, fmt.Sprintf("%05d", i)), b, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mkdirRemoteTemp(opts Options) (string, error) {
+	script := `#!/bin/sh
+set -eu
+mktemp -d "${TMPDIR:-/tmp}/sshocker-bench.XXXXXXXXXX"
+`
+	stdout, _, err := ssh.ExecuteScript(opts.Host, opts.Port, opts.SSHConfig, script, "mkdir_remote_temp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create a temporary directory (remote): %w", err)
+	}
+	return strings.TrimSpace(stdout), nil
+}
+
+// rmdirRemoteTemp removes dir without recursion, so that a mountpoint left mounted by a failure
+// does not remove the local files.
+func rmdirRemoteTemp(opts Options, dir string) error {
+	script := fmt.Sprintf(`#!/bin/sh
+set -eu
+rm -f %s/src
+rmdir %s
+`, util.ShellQuote(dir), util.ShellQuote(dir))
+	_, _, err := ssh.ExecuteScript(opts.Host, opts.Port, opts.SSHConfig, script, "rmdir_remote_temp")
+	return err
+}
+
+// measureScript returns the time to execute script, excluding overhead.
+func measureScript(opts Options, script, scriptName string, overhead time.Duration) (time.Duration, error) {
+	begin := time.Now()
+	// The error contains stderr
+	if _, _, err := ssh.ExecuteScript(opts.Host, opts.Port, opts.SSHConfig, script, scriptName); err != nil {
+		return 0, err
+	}
+	return subtractOverhead(time.Since(begin), overhead), nil
+}
+
+// subtractOverhead subtracts overhead from d, unless d is not longer than overhead.
+func subtractOverhead(d, overhead time.Duration) time.Duration {
+	if d > overhead {
+		return d - overhead
+	}
+	return d
+}
+
+// measureOverhead returns the minimum time to execute an empty script.
+func measureOverhead(opts Options) (time.Duration, error) {
+	var res time.Duration
+	for i := range 3 {
+		d, err := measureScript(opts, "#!/bin/sh\n:\n", "overhead", 0)
+		if err != nil {
+			return 0, fmt.Errorf("failed to execute an empty script: %w", err)
+		}
+		if i == 0 || d < res {
+			res = d
+		}
+	}
+	return res, nil
+}
+
+func benchMount(opts Options, m Mount, localDir, remoteDir, mountpoint string, overhead time.Duration) MountResult {
+	mr := MountResult{
+		Name:      m.Name,
+		Driver:    m.Driver,
+		Transport: m.Transport,
+		SSHFSArgs: m.SSHFSArgs,
+		SSHArgs:   m.SSHArgs,
+	}
+	if mr.Transport == "" {
+		mr.Transport = reversesshfs.TransportStdio
+	}
+	if err := benchMountRates(opts, m, &mr, localDir, remoteDir, mountpoint, overhead); err != nil {
+		mr.Error = err.Error()
+	}
+	return mr
+}
+
+func benchMountRates(opts Options, m Mount, mr *MountResult, localDir, remoteDir, mountpoint string, overhead time.Duration) (retErr error) {
+	rsf := &reversesshfs.ReverseSSHFS{
+		SSHConfig:           opts.SSHConfig,
+		Driver:              m.Driver,
+		LocalPath:           localDir,
+		Host:                opts.Host,
+		Port:                opts.Port,
+		RemotePath:          mountpoint,
+		Transport:           m.Transport,
+		SSHFSAdditionalArgs: m.SSHFSArgs,
+		SSHAdditionalArgs:   m.SSHArgs,
+	}
+	if err := rsf.Prepare(); err != nil {
+		return fmt.Errorf("failed to prepare mounting %q (remote): %w", mountpoint, err)
+	}
+	if err := rsf.Start(); err != nil {
+		return fmt.Errorf("failed to mount %q (remote): %w", mountpoint, err)
+	}
+	defer func() {
+		if cErr := rsf.Close(); cErr != nil && retErr == nil {
+			retErr = fmt.Errorf("failed to unmount %q (remote): %w", mountpoint, cErr)
+		}
+	}()
+	q := func(elem ...string) string {
+		return util.ShellQuote(strings.Join(elem, "/"))
+	}
+	// The file read from the mount is kept in remoteDir as the source of the write benchmark
+	read := fmt.Sprintf("#!/bin/sh\nset -eu\ncat %s >%s\n", q(mountpoint, bigFileName), q(remoteDir, "src"))
+	d, err := measureScript(opts, read, "bench_read", overhead)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	mr.ReadBytesPerSecond = float64(opts.FileSize) / d.Seconds()
+	write := fmt.Sprintf("#!/bin/sh\nset -eu\ncp %s %s\n", q(remoteDir, "src"), q(mountpoint, "written"))
+	d, err = measureScript(opts, write, "bench_write", overhead)
+	_ = os.Remove(filepath.Join(localDir, "written"))
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	mr.WriteBytesPerSecond = float64(opts.FileSize) / d.Seconds()
+	metadata := fmt.Sprintf("#!/bin/sh\nset -eu\nls -lR %s >/dev/null\n", q(mountpoint, smallDirName))
+	d, err = measureScript(opts, metadata, "bench_metadata", overhead)
+	if err != nil {
+		return fmt.Errorf("metadata: %w", err)
+	}
+	mr.MetadataFilesPerSecond = float64(opts.SmallFiles) / d.Seconds()
+	return nil
+}
+
+// sshCommand returns `ssh HOST -- command`.
+func sshCommand(opts Options, command string) *exec.Cmd {
+	args := opts.SSHConfig.Args()
+	if opts.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(opts.Port))
+	}
+	args = append(args, opts.Host, "--", command)
+	return exec.Command(opts.SSHConfig.Binary(), args...)
+}
+
+func benchForward(opts Options, overhead time.Duration) ForwardResult {
+	var fr ForwardResult
+	var errs []error
+	if err := benchForwardThroughput(opts, &fr, overhead); err != nil {
+		errs = append(errs, fmt.Errorf("throughput: %w", err))
+	}
+	if err := benchForwardRTT(opts, &fr); err != nil {
+		errs = append(errs, fmt.Errorf("rtt: %w", err))
+	}
+	if err := errors.Join(errs...); err != nil {
+		fr.Error = err.Error()
+	}
+	return fr
+}
+
+func benchForwardThroughput(opts Options, fr *ForwardResult, overhead time.Duration) error {
+	cmd := sshCommand(opts, "cat >/dev/null")
+	cmd.Stdin = io.LimitReader(rand.NewChaCha8([32]byte{}), opts.ForwardSize)
+	logrus.Debugf("executing ssh for the forward throughput: %s %v", cmd.Path, cmd.Args)
+	begin := time.Now()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("out=%q: %w", string(out), err)
+	}
+	fr.BytesPerSecond = float64(opts.ForwardSize) / subtractOverhead(time.Since(begin), overhead).Seconds()
+	return nil
+}
+
+// benchForwardRTT measures the round trips of a byte echoed by the remote `cat`.
+// The first round trip is excluded, as it includes the execution of cat.
+func benchForwardRTT(opts Options, fr *ForwardResult) (retErr error) {
+	cmd := sshCommand(opts, "cat")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("executing ssh for the forward RTT: %s %v", cmd.Path, cmd.Args)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		_ = stdin.Close()
+		if wErr := cmd.Wait(); wErr != nil && retErr == nil {
+			retErr = wErr
+		}
+	}()
+	b := []byte{'x'}
+	var samples []time.Duration
+	for i := range opts.RTTSamples + 1 {
+		begin := time.Now()
+		if _, err := stdin.Write(b); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(stdout, b); err != nil {
+			return err
+		}
+		if i > 0 {
+			samples = append(samples, time.Since(begin))
+		}
+	}
+	fr.RTT = median(samples)
+	return nil
+}
+
+func median(samples []time.Duration) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+	return sorted[len(sorted)/2]
+}
@@ -0,0 +1,97 @@
+package bench
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateTree(t *testing.T) {
+	dir := t.TempDir()
+	if err := generateTree(dir, 3<<20+1, 10); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, bigFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 3<<20+1 {
+		t.Errorf("expected %d bytes, got %d", 3<<20+1, fi.Size())
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, smallDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 10 {
+		t.Errorf("expected 10 small files, got %d", len(entries))
+	}
+	b, err := os.ReadFile(filepath.Join(dir, smallDirName, "00009"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != smallFileSize {
+		t.Errorf("expected %d bytes, got %d", smallFileSize, len(b))
+	}
+}
+
+func TestMedian(t *testing.T) {
+	testCases := []struct {
+		samples  []time.Duration
+		expected time.Duration
+	}{
+		{nil, 0},
+		{[]time.Duration{3, 1, 2}, 2},
+		{[]time.Duration{4, 1, 3, 2}, 3},
+	}
+	for _, tc := range testCases {
+		if got := median(tc.samples); got != tc.expected {
+			t.Errorf("median(%v): expected %v, got %v", tc.samples, tc.expected, got)
+		}
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	res := &Result{
+		FileSize:   1 << 20,
+		SmallFiles: 10,
+		Mounts: []MountResult{
+			{
+				Name:                   "builtin/default",
+				Driver:                 "builtin",
+				Transport:              "stdio",
+				ReadBytesPerSecond:     100 << 20,
+				WriteBytesPerSecond:    50 << 20,
+				MetadataFilesPerSecond: 1234,
+			},
+			{
+				Name:      "openssh-sftp-server/custom",
+				Driver:    "openssh-sftp-server",
+				Transport: "stdio",
+				SSHFSArgs: []string{"-o", "cache=no"},
+				Error:     "failed",
+			},
+		},
+		Forward: ForwardResult{BytesPerSecond: 200 << 20, RTT: 1500 * time.Microsecond},
+	}
+	var b bytes.Buffer
+	if err := WriteTable(&b, res); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(b.String(), "\n")
+	expected := []string{
+		"MOUNT DRIVER TRANSPORT READ WRITE METADATA ERROR",
+		"builtin/default builtin stdio 100.0 MiB/s 50.0 MiB/s 1234 files/s -",
+		"openssh-sftp-server/custom openssh-sftp-server stdio - - - failed",
+		"",
+		"Forward: 200.0 MiB/s, RTT 1.5ms",
+	}
+	for i, exp := range expected {
+		// The columns are compared regardless of the padding
+		if got := strings.Join(strings.Fields(lines[i]), " "); got != exp {
+			t.Errorf("line %d: expected %q, got %q", i, exp, got)
+		}
+	}
+}
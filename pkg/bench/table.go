@@ -0,0 +1,52 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// WriteTable writes res as a table for humans.
+func WriteTable(w io.Writer, res *Result) error {
+	tw := tabwriter.NewWriter(w, 4, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "MOUNT\tDRIVER\tTRANSPORT\tREAD\tWRITE\tMETADATA\tERROR")
+	for _, m := range res.Mounts {
+		errStr := m.Error
+		if errStr == "" {
+			errStr = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", m.Name, m.Driver, m.Transport,
+			formatBytesRate(m.ReadBytesPerSecond), formatBytesRate(m.WriteBytesPerSecond), formatFilesRate(m.MetadataFilesPerSecond), errStr)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\nForward: %s, RTT %s", formatBytesRate(res.Forward.BytesPerSecond), formatRTT(res.Forward.RTT))
+	if res.Forward.Error != "" {
+		fmt.Fprintf(w, " (%s)", res.Forward.Error)
+	}
+	_, err := fmt.Fprintf(w, "\n(file size: %d bytes, small files: %d, script overhead: %v)\n", res.FileSize, res.SmallFiles, res.Overhead.Round(time.Microsecond))
+	return err
+}
+
+func formatBytesRate(bytesPerSecond float64) string {
+	if bytesPerSecond == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f MiB/s", bytesPerSecond/(1<<20))
+}
+
+func formatFilesRate(filesPerSecond float64) string {
+	if filesPerSecond == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f files/s", filesPerSecond)
+}
+
+func formatRTT(rtt time.Duration) string {
+	if rtt == 0 {
+		return "-"
+	}
+	return rtt.Round(time.Microsecond).String()
+}
@@ -0,0 +1,70 @@
+// Package events defines the lifecycle events emitted by sshocker.
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+type Type = string
+
+const (
+	TypeMountStarting = Type("mount-starting")
+	TypeMountReady    = Type("mount-ready")
+	TypeMountFailed   = Type("mount-failed")
+	TypeMountClosed   = Type("mount-closed")
+	TypeForwardReady  = Type("forward-ready")
+	TypeMasterStarted = Type("master-started")
+	TypeMasterExited  = Type("master-exited")
+	TypeCommandExited = Type("command-exited")
+)
+
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       Type      `json:"type"`
+	Host       string    `json:"host,omitempty"`
+	Port       int       `json:"port,omitempty"`
+	LocalPath  string    `json:"localPath,omitempty"`  // mount events
+	RemotePath string    `json:"remotePath,omitempty"` // mount events
+	Forward    string    `json:"forward,omitempty"`    // forward events, in the `ssh -L` syntax
+	ExitCode   *int      `json:"exitCode,omitempty"`   // command-exited
+	Error      string    `json:"error,omitempty"`
+}
+
+// Handler receives events.
+// Handler may be called from multiple goroutines.
+type Handler = func(Event)
+
+// Emit calls h with ev, after filling ev.Time.
+// Emit is a no-op when h is nil.
+func Emit(h Handler, ev Event) {
+	if h == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	h(ev)
+}
+
+// NewJSONHandler returns a Handler that writes events to w in the JSON Lines format.
+// Write errors are ignored.
+func NewJSONHandler(w io.Writer) Handler {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(ev Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		_ = enc.Encode(ev)
+	}
+}
+
+// NewChannelHandler returns a Handler that sends events to ch.
+// The handler blocks when ch is full.
+func NewChannelHandler(ch chan<- Event) Handler {
+	return func(ev Event) {
+		ch <- ev
+	}
+}
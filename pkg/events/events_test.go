@@ -0,0 +1,24 @@
+package events
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestNewJSONHandler(t *testing.T) {
+	var b bytes.Buffer
+	h := NewJSONHandler(&b)
+	exitCode := 42
+	Emit(h, Event{
+		Time:     time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+		Type:     TypeCommandExited,
+		Host:     "example.com",
+		ExitCode: &exitCode,
+	})
+	expected := `{"time":"2021-01-02T03:04:05Z","type":"command-exited","host":"example.com","exitCode":42}` + "\n"
+	if got := b.String(); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	Emit(nil, Event{Type: TypeCommandExited})
+}
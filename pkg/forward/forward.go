@@ -0,0 +1,176 @@
+// Package forward implements the local port forwarding on the Go side,
+// as an alternative to `ssh -L`.
+//
+// Each connection is forwarded via `ssh -W`, which reuses the master connection when ControlPersist is enabled.
+// Unlike `ssh -L`, the connections can be observed and controlled by sshocker.
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lima-vm/sshocker/pkg/metrics"
+	"github.com/lima-vm/sshocker/pkg/ratelimit"
+	"github.com/lima-vm/sshocker/pkg/ssh"
+	"github.com/sirupsen/logrus"
+)
+
+// ParseForward parses the `ssh -L` syntax "LOCALIP:LOCALPORT:REMOTEHOST:REMOTEPORT",
+// and returns the local address and the remote address.
+func ParseForward(forward string) (string, string, error) {
+	split := strings.Split(forward, ":")
+	if len(split) != 4 {
+		return "", "", fmt.Errorf("cannot parse %q, should be LOCALIP:LOCALPORT:REMOTEHOST:REMOTEPORT", forward)
+	}
+	for _, port := range []string{split[1], split[3]} {
+		if _, err := strconv.Atoi(port); err != nil {
+			return "", "", fmt.Errorf("cannot parse %q: invalid port %q", forward, port)
+		}
+	}
+	return net.JoinHostPort(split[0], split[1]), net.JoinHostPort(split[2], split[3]), nil
+}
+
+// Proxy forwards the local connections to the remote address.
+type Proxy struct {
+	*ssh.SSHConfig
+	Host    string
+	Port    int
+	Forward string           // `ssh -L` syntax, "LOCALIP:LOCALPORT:REMOTEHOST:REMOTEPORT"
+	Metrics *metrics.Forward // Optional
+	// Optional. The max bytes per second, shared by the connections.
+	UpstreamLimit   int64 // from the local clients to the remote
+	DownstreamLimit int64 // from the remote to the local clients
+	upLimiter       *ratelimit.Limiter
+	downLimiter     *ratelimit.Limiter
+	remote          string
+	ln              net.Listener
+	wg              sync.WaitGroup
+	mu              sync.Mutex
+	conns           map[net.Conn]*exec.Cmd
+	closing         bool
+}
+
+// Start starts listening on the local address.
+func (p *Proxy) Start() error {
+	if p.SSHConfig == nil {
+		return errors.New("got nil SSHConfig")
+	}
+	local, remote, err := ParseForward(p.Forward)
+	if err != nil {
+		return err
+	}
+	p.remote = remote
+	p.upLimiter = ratelimit.New(p.UpstreamLimit)
+	p.downLimiter = ratelimit.New(p.DownstreamLimit)
+	p.ln, err = net.Listen("tcp", local)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %q: %w", local, err)
+	}
+	p.conns = make(map[net.Conn]*exec.Cmd)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.serve()
+	}()
+	return nil
+}
+
+func (p *Proxy) serve() {
+	for {
+		c, err := p.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logrus.WithError(err).Warnf("failed to accept a connection for %q", p.Forward)
+			}
+			return
+		}
+		if p.Metrics != nil {
+			c = p.Metrics.TrackConn(c)
+		}
+		p.mu.Lock()
+		if p.closing {
+			p.mu.Unlock()
+			_ = c.Close()
+			return
+		}
+		p.conns[c] = nil
+		p.mu.Unlock()
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer func() {
+				p.mu.Lock()
+				delete(p.conns, c)
+				p.mu.Unlock()
+				_ = c.Close()
+			}()
+			if err := p.handle(c); err != nil {
+				logrus.WithError(err).Debugf("failed to forward a connection for %q", p.Forward)
+			}
+		}()
+	}
+}
+
+func (p *Proxy) handle(c net.Conn) error {
+	args := p.SSHConfig.Args()
+	if p.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(p.Port))
+	}
+	args = append(args, "-W", p.remote, p.Host)
+	cmd := exec.Command(p.SSHConfig.Binary(), args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("executing ssh for forwarding a connection for %q: %s %v", p.Forward, cmd.Path, cmd.Args)
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		return net.ErrClosed
+	}
+	if err := cmd.Start(); err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	p.conns[c] = cmd
+	p.mu.Unlock()
+	go func() {
+		_, _ = io.Copy(stdin, ratelimit.NewReader(c, p.upLimiter))
+		_ = stdin.Close()
+	}()
+	_, copyErr := io.Copy(ratelimit.NewWriter(c, p.downLimiter), stdout)
+	// Unblock the copy from c
+	_ = c.Close()
+	return errors.Join(copyErr, cmd.Wait())
+}
+
+// Close stops listening, and closes the connections.
+func (p *Proxy) Close() error {
+	if p.ln == nil {
+		return nil
+	}
+	err := p.ln.Close()
+	p.mu.Lock()
+	p.closing = true
+	for c, cmd := range p.conns {
+		_ = c.Close()
+		if cmd != nil {
+			_ = cmd.Process.Kill()
+		}
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+	return err
+}
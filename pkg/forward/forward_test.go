@@ -0,0 +1,34 @@
+package forward
+
+import "testing"
+
+func TestParseForward(t *testing.T) {
+	type testCase struct {
+		forward string
+		local   string
+		remote  string
+		err     bool
+	}
+	testCases := []testCase{
+		{forward: "0.0.0.0:8080:localhost:80", local: "0.0.0.0:8080", remote: "localhost:80"},
+		{forward: "127.0.0.1:2222:10.0.0.1:22", local: "127.0.0.1:2222", remote: "10.0.0.1:22"},
+		{forward: "8080:localhost:80", err: true},
+		{forward: "0.0.0.0:http:localhost:80", err: true},
+	}
+	for i, tc := range testCases {
+		local, remote, err := ParseForward(tc.forward)
+		if tc.err {
+			if err == nil {
+				t.Errorf("#%d: error is expected for %q", i, tc.forward)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: failed to parse %q: %v", i, tc.forward, err)
+			continue
+		}
+		if local != tc.local || remote != tc.remote {
+			t.Errorf("#%d: expected %q and %q, got %q and %q", i, tc.local, tc.remote, local, remote)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Package fswatch watches a local directory tree recursively, and reports the changed paths in batches.
+package fswatch
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/lima-vm/sshocker/pkg/pathfilter"
+	"github.com/sirupsen/logrus"
+)
+
+const DefaultDebounce = 200 * time.Millisecond
+
+// Watcher watches Root recursively.
+type Watcher struct {
+	Root     string
+	Filter   *pathfilter.Filter // Optional. Matched paths are ignored.
+	Debounce time.Duration      // Defaults to DefaultDebounce
+	// Callback is called with the slash-separated relative paths that have been created, written, removed, or renamed.
+	// Pure attribute changes are not reported.
+	// Callback is not called concurrently.
+	Callback func(paths []string)
+
+	w       *fsnotify.Watcher
+	done    chan struct{}
+	wg      sync.WaitGroup
+	closeMu sync.Once
+}
+
+// Start starts watching.
+func (w *Watcher) Start() error {
+	if w.Callback == nil {
+		return errors.New("got nil Callback")
+	}
+	if w.Debounce == 0 {
+		w.Debounce = DefaultDebounce
+	}
+	var err error
+	w.w, err = fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.addRecursive(w.Root); err != nil {
+		_ = w.w.Close()
+		return err
+	}
+	w.done = make(chan struct{})
+	w.wg.Add(1)
+	go w.loop()
+	return nil
+}
+
+func (w *Watcher) rel(p string) (string, bool) {
+	rel, err := filepath.Rel(w.Root, p)
+	if err != nil {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+func (w *Watcher) addRecursive(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p != dir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if rel, ok := w.rel(p); ok && rel != "." && w.Filter.Match(rel, true) {
+			return filepath.SkipDir
+		}
+		if err := w.w.Add(p); err != nil {
+			logrus.WithError(err).Warnf("failed to watch %q", p)
+		}
+		return nil
+	})
+}
+
+func (w *Watcher) loop() {
+	defer w.wg.Done()
+	pending := make(map[string]struct{})
+	// The batch is flushed after Debounce of quietness, or after maxDelay since the first change
+	maxDelay := 10 * w.Debounce
+	var first time.Time
+	timer := time.NewTimer(w.Debounce)
+	timer.Stop()
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		paths := make([]string, 0, len(pending))
+		for p := range pending {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		pending = make(map[string]struct{})
+		w.Callback(paths)
+	}
+	for {
+		select {
+		case <-w.done:
+			flush()
+			return
+		case ev, ok := <-w.w.Events:
+			if !ok {
+				flush()
+				return
+			}
+			if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) && !ev.Has(fsnotify.Remove) && !ev.Has(fsnotify.Rename) {
+				continue
+			}
+			rel, ok := w.rel(ev.Name)
+			if !ok || rel == "." {
+				continue
+			}
+			isDir := false
+			if st, err := os.Lstat(ev.Name); err == nil {
+				isDir = st.IsDir()
+			}
+			if w.Filter.Match(rel, isDir) {
+				continue
+			}
+			if len(pending) == 0 {
+				first = time.Now()
+			}
+			if isDir && ev.Has(fsnotify.Create) {
+				if err := w.addRecursive(ev.Name); err != nil {
+					logrus.WithError(err).Warnf("failed to watch %q", ev.Name)
+				}
+				// Report the files created before the watch was added
+				_ = filepath.WalkDir(ev.Name, func(p string, d fs.DirEntry, err error) error {
+					if err != nil {
+						return nil
+					}
+					r, ok := w.rel(p)
+					if !ok {
+						return nil
+					}
+					if w.Filter.Match(r, d.IsDir()) {
+						if d.IsDir() {
+							return filepath.SkipDir
+						}
+						return nil
+					}
+					pending[r] = struct{}{}
+					return nil
+				})
+			}
+			pending[rel] = struct{}{}
+			timer.Reset(min(w.Debounce, time.Until(first.Add(maxDelay))))
+		case err, ok := <-w.w.Errors:
+			if !ok {
+				flush()
+				return
+			}
+			logrus.WithError(err).Warnf("error while watching %q", w.Root)
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// Close stops watching, after flushing the pending changes.
+func (w *Watcher) Close() error {
+	var err error
+	w.closeMu.Do(func() {
+		if w.done != nil {
+			close(w.done)
+			w.wg.Wait()
+		}
+		if w.w != nil {
+			err = w.w.Close()
+		}
+	})
+	return err
+}
@@ -0,0 +1,134 @@
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/lima-vm/sshocker/pkg/pathfilter"
+)
+
+const testTimeout = 10 * time.Second
+
+// startWatcher starts a Watcher for root, and returns the channel of the batches.
+func startWatcher(t *testing.T, root string, exclude []string, debounce time.Duration) <-chan []string {
+	t.Helper()
+	filter, err := pathfilter.New(exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan []string, 100)
+	w := &Watcher{
+		Root:     root,
+		Filter:   filter,
+		Debounce: debounce,
+		Callback: func(paths []string) {
+			ch <- paths
+		},
+	}
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := w.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return ch
+}
+
+func writeFile(t *testing.T, p, content string) {
+	t.Helper()
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// collect receives the batches until all of the expected paths are reported, and returns the reported paths.
+func collect(t *testing.T, ch <-chan []string, expected ...string) []string {
+	t.Helper()
+	seen := make(map[string]struct{})
+	timeout := time.After(testTimeout)
+	for {
+		missing := false
+		for _, p := range expected {
+			if _, ok := seen[p]; !ok {
+				missing = true
+			}
+		}
+		if !missing {
+			break
+		}
+		select {
+		case paths := <-ch:
+			for _, p := range paths {
+				seen[p] = struct{}{}
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %v, got %v", expected, seen)
+		}
+	}
+	res := make([]string, 0, len(seen))
+	for p := range seen {
+		res = append(res, p)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestWatcherCoalesce(t *testing.T) {
+	root := t.TempDir()
+	// Long enough for slow CI hosts
+	ch := startWatcher(t, root, nil, time.Second)
+	for i := range 10 {
+		writeFile(t, filepath.Join(root, "a.txt"), string(rune('a'+i)))
+	}
+	writeFile(t, filepath.Join(root, "b.txt"), "b")
+	select {
+	case paths := <-ch:
+		// The writes within the debounce period are reported in a single batch, without duplicates
+		if expected := []string{"a.txt", "b.txt"}; !reflect.DeepEqual(paths, expected) {
+			t.Errorf("expected %v, got %v", expected, paths)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out")
+	}
+}
+
+func TestWatcherNewDirectory(t *testing.T) {
+	root := t.TempDir()
+	ch := startWatcher(t, root, nil, 100*time.Millisecond)
+	sub := filepath.Join(root, "sub", "nested")
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(sub, "early.txt"), "early")
+	// The files created before the watch is added are reported too
+	collect(t, ch, "sub", "sub/nested/early.txt")
+	// The new directory is watched recursively
+	writeFile(t, filepath.Join(sub, "late.txt"), "late")
+	collect(t, ch, "sub/nested/late.txt")
+}
+
+func TestWatcherExclude(t *testing.T) {
+	root := t.TempDir()
+	ch := startWatcher(t, root, []string{"ignored/", "*.log"}, 100*time.Millisecond)
+	if err := os.Mkdir(filepath.Join(root, "ignored"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "ignored", "file"), "ignored")
+	writeFile(t, filepath.Join(root, "debug.log"), "ignored")
+	writeFile(t, filepath.Join(root, "keep.txt"), "keep")
+	if got, expected := collect(t, ch, "keep.txt"), []string{"keep.txt"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	// Not reported after the existing directory is excluded either
+	writeFile(t, filepath.Join(root, "ignored", "file2"), "ignored")
+	writeFile(t, filepath.Join(root, "keep2.txt"), "keep")
+	if got, expected := collect(t, ch, "keep2.txt"), []string{"keep2.txt"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,159 @@
+// Package inspect exposes the state of the running `sshocker run` sessions to `sshocker inspect`.
+//
+// Each session serves its [State] in JSON on a Unix socket "PID.sock" in [Dir].
+package inspect
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lima-vm/sshocker/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// State is the state of a session.
+type State struct {
+	PID      int               `json:"pid"`
+	Host     string            `json:"host"`
+	Port     int               `json:"port,omitempty"`
+	Command  []string          `json:"command,omitempty"`
+	Mounts   []Mount           `json:"mounts"`
+	Forwards []string          `json:"forwards"`          // In the `ssh -L` syntax
+	Metrics  *metrics.Snapshot `json:"metrics,omitempty"` // The forwards have the metrics only when they are served by sshocker
+}
+
+// Mount is the state of a mount.
+type Mount struct {
+	Type                 string `json:"type"`
+	Source               string `json:"source"`
+	Destination          string `json:"destination"`                    // Resolved, e.g., "/home/user/src"
+	RequestedDestination string `json:"requestedDestination,omitempty"` // Set when Destination was resolved from "~", "$HOME", or the templates, e.g., "~/src"
+	Readonly             bool   `json:"readonly,omitempty"`
+}
+
+// queryTimeout is the timeout for reading the state from a session.
+const queryTimeout = 5 * time.Second
+
+// Dir returns the directory of the sockets of the sessions.
+// "$XDG_RUNTIME_DIR/sshocker" is used when XDG_RUNTIME_DIR is set,
+// otherwise "sshocker/sessions" in the user cache directory.
+func Dir() (string, error) {
+	if d := os.Getenv("XDG_RUNTIME_DIR"); d != "" {
+		return filepath.Join(d, "sshocker"), nil
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "sshocker", "sessions"), nil
+}
+
+// Serve serves the state returned by f on "PID.sock" in [Dir], until the returned function is called.
+func Serve(f func() State) (func() error, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	sock := filepath.Join(dir, strconv.Itoa(os.Getpid())+".sock")
+	// Left by a crashed session with the same PID
+	if err := os.Remove(sock); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %q for inspect: %w", sock, err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					logrus.WithError(err).Warn("failed to accept the connection for inspect")
+				}
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = conn.SetDeadline(time.Now().Add(queryTimeout))
+				if err := json.NewEncoder(conn).Encode(f()); err != nil {
+					logrus.WithError(err).Debug("failed to write the state for inspect")
+				}
+			}()
+		}
+	}()
+	logrus.Debugf("Serving the state for inspect on %q", sock)
+	// The socket file is removed by Close
+	return ln.Close, nil
+}
+
+// Query returns the state of the session with the PID.
+func Query(pid int) (*State, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	return query(filepath.Join(dir, strconv.Itoa(pid)+".sock"))
+}
+
+func query(sock string) (*State, error) {
+	conn, err := net.DialTimeout("unix", sock, queryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(queryTimeout)); err != nil {
+		return nil, err
+	}
+	var st State
+	if err := json.NewDecoder(conn).Decode(&st); err != nil {
+		return nil, fmt.Errorf("failed to read the state from %q: %w", sock, err)
+	}
+	return &st, nil
+}
+
+// List returns the states of the running sessions, sorted by the PID.
+// The sockets left by the crashed sessions are removed.
+func List() ([]State, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	ents, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var res []State
+	for _, ent := range ents {
+		if _, err := strconv.Atoi(strings.TrimSuffix(ent.Name(), ".sock")); err != nil || !strings.HasSuffix(ent.Name(), ".sock") {
+			continue
+		}
+		sock := filepath.Join(dir, ent.Name())
+		st, err := query(sock)
+		if err != nil {
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				logrus.Debugf("Removing the stale socket %q", sock)
+				_ = os.Remove(sock)
+			} else {
+				logrus.WithError(err).Warnf("failed to inspect %q", sock)
+			}
+			continue
+		}
+		res = append(res, *st)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].PID < res[j].PID })
+	return res, nil
+}
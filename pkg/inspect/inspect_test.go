@@ -0,0 +1,67 @@
+package inspect
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestServe(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs XDG_RUNTIME_DIR and Unix sockets")
+	}
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	dir, err := Dir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := State{
+		PID:      os.Getpid(),
+		Host:     "example.com",
+		Mounts:   []Mount{{Type: "reverse-sshfs", Source: "/src", Destination: "/home/user/src", RequestedDestination: "~/src"}},
+		Forwards: []string{"0.0.0.0:8080:localhost:80"},
+	}
+	closeServer, err := Serve(func() State { return expected })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeServer()
+	st, err := Query(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*st, expected) {
+		t.Errorf("expected %+v, got %+v", expected, *st)
+	}
+
+	// A socket left by a crashed session
+	stale := filepath.Join(dir, "1.sock")
+	ln, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+	states, err := List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(states, []State{expected}) {
+		t.Errorf("expected %+v, got %+v", []State{expected}, states)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected the stale socket to be removed, got %v", err)
+	}
+
+	if err := closeServer(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Query(os.Getpid()); err == nil {
+		t.Error("expected an error after closing the server")
+	}
+}
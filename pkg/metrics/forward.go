@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Forward is the metrics of a forward.
+type Forward struct {
+	forward           string
+	Connections       atomic.Int64 // total
+	ActiveConnections atomic.Int64
+	UpstreamBytes     atomic.Int64 // from the local clients to the remote
+	DownstreamBytes   atomic.Int64 // from the remote to the local clients
+}
+
+// TrackConn counts the connection and its bytes.
+// The returned connection decrements ActiveConnections on Close.
+func (f *Forward) TrackConn(c net.Conn) net.Conn {
+	f.Connections.Add(1)
+	f.ActiveConnections.Add(1)
+	return &trackedConn{Conn: c, f: f}
+}
+
+func (f *Forward) writeText(tw *textWriter) {
+	base := []label{{"forward", f.forward}}
+	tw.header("sshocker_forward_connections_total", "counter", "Connections accepted by the forward.")
+	tw.counter("sshocker_forward_connections_total", base, f.Connections.Load())
+	tw.header("sshocker_forward_active_connections", "gauge", "Active connections of the forward.")
+	tw.counter("sshocker_forward_active_connections", base, f.ActiveConnections.Load())
+	tw.header("sshocker_forward_bytes_total", "counter", "Bytes transferred by the forward.")
+	tw.counter("sshocker_forward_bytes_total", append(base, label{"direction", "upstream"}), f.UpstreamBytes.Load())
+	tw.counter("sshocker_forward_bytes_total", append(base, label{"direction", "downstream"}), f.DownstreamBytes.Load())
+}
+
+type trackedConn struct {
+	net.Conn
+	f      *Forward
+	closed atomic.Bool
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.f.UpstreamBytes.Add(int64(n))
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.f.DownstreamBytes.Add(int64(n))
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	if !c.closed.Swap(true) {
+		c.f.ActiveConnections.Add(-1)
+	}
+	return c.Conn.Close()
+}
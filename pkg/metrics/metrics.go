@@ -0,0 +1,174 @@
+// Package metrics collects the I/O metrics of the mounts and the forwards,
+// and exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets is the upper bounds of the latency histograms, in seconds.
+var LatencyBuckets = [...]float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Histogram is a latency histogram with LatencyBuckets.
+type Histogram struct {
+	counts [len(LatencyBuckets) + 1]atomic.Int64 // the last one is for +Inf
+	count  atomic.Int64
+	sumNs  atomic.Int64
+}
+
+// Observe records d.
+func (h *Histogram) Observe(d time.Duration) {
+	sec := d.Seconds()
+	i := sort.SearchFloat64s(LatencyBuckets[:], sec)
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	h.sumNs.Add(int64(d))
+}
+
+// Count returns the number of the observations.
+func (h *Histogram) Count() int64 {
+	return h.count.Load()
+}
+
+// Registry holds the metrics of the mounts and the forwards.
+type Registry struct {
+	mu       sync.Mutex
+	mounts   []*Mount
+	forwards []*Forward
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// NewMount registers the metrics of a mount.
+// NewMount is nil-safe; nil is returned for a nil registry.
+func (r *Registry) NewMount(localPath, remotePath string) *Mount {
+	if r == nil {
+		return nil
+	}
+	m := newMount(localPath, remotePath)
+	r.mu.Lock()
+	r.mounts = append(r.mounts, m)
+	r.mu.Unlock()
+	return m
+}
+
+// NewForward registers the metrics of a forward.
+// forward conforms to the `ssh -L` syntax.
+// NewForward is nil-safe; nil is returned for a nil registry.
+func (r *Registry) NewForward(forward string) *Forward {
+	if r == nil {
+		return nil
+	}
+	f := &Forward{forward: forward}
+	r.mu.Lock()
+	r.forwards = append(r.forwards, f)
+	r.mu.Unlock()
+	return f
+}
+
+type label struct {
+	k, v string
+}
+
+func formatLabels(labels ...label) string {
+	var b strings.Builder
+	b.WriteString("{")
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(l.k)
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(l.v))
+		b.WriteString(`"`)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+type family struct {
+	name, typ, help string
+	lines           []string
+}
+
+// textWriter groups the samples by the metric family, as required by the text format.
+type textWriter struct {
+	families []*family
+	byName   map[string]*family
+	cur      *family
+}
+
+// header switches the current family.
+func (tw *textWriter) header(name, typ, help string) {
+	f, ok := tw.byName[name]
+	if !ok {
+		f = &family{name: name, typ: typ, help: help}
+		tw.byName[name] = f
+		tw.families = append(tw.families, f)
+	}
+	tw.cur = f
+}
+
+// sample appends a sample to the current family.
+func (tw *textWriter) sample(name string, labels []label, v string) {
+	tw.cur.lines = append(tw.cur.lines, name+formatLabels(labels...)+" "+v)
+}
+
+func (tw *textWriter) counter(name string, labels []label, v int64) {
+	tw.sample(name, labels, strconv.FormatInt(v, 10))
+}
+
+func (tw *textWriter) histogram(name, help string, labels []label, h *Histogram) {
+	tw.header(name, "histogram", help)
+	s := h.snapshot()
+	for _, b := range s.Buckets {
+		tw.counter(name+"_bucket", append(labels, label{"le", b.LE}), b.Count)
+	}
+	tw.sample(name+"_sum", labels, strconv.FormatFloat(s.SumSeconds, 'g', -1, 64))
+	tw.counter(name+"_count", labels, h.Count())
+}
+
+func (tw *textWriter) flush(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range tw.families {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, l := range f.lines {
+			fmt.Fprintln(bw, l)
+		}
+	}
+	return bw.Flush()
+}
+
+// WriteText writes the metrics in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	mounts := append([]*Mount{}, r.mounts...)
+	forwards := append([]*Forward{}, r.forwards...)
+	r.mu.Unlock()
+	tw := &textWriter{byName: make(map[string]*family)}
+	for _, m := range mounts {
+		m.writeText(tw)
+	}
+	for _, f := range forwards {
+		f.writeText(tw)
+	}
+	return tw.flush(w)
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = r.WriteText(w)
+}
@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/lima-vm/sshocker/pkg/util"
+	"github.com/pkg/sftp"
+)
+
+func TestPacketParser(t *testing.T) {
+	packet := func(typ byte, payload ...uint32) []byte {
+		b := binary.BigEndian.AppendUint32(nil, uint32(1+4*len(payload)))
+		b = append(b, typ)
+		for _, x := range payload {
+			b = binary.BigEndian.AppendUint32(b, x)
+		}
+		return b
+	}
+	var stream []byte
+	stream = append(stream, packet(sshFxpVersion, 3)...)
+	stream = append(stream, packet(17, 42, 0xdeadbeef)...)  // SSH_FXP_STAT with id 42
+	stream = append(stream, packet(sshFxpStatus, 43, 2)...) // SSH_FXP_STATUS with id 43 and SSH_FX_NO_SUCH_FILE
+	stream = append(stream, packet(sshFxpStatus, 44)...)    // truncated SSH_FXP_STATUS
+	stream = append(stream, packet(103, 45, 1, 2, 3, 4)...) // SSH_FXP_DATA with id 45
+	type result struct {
+		typ        byte
+		id, status uint32
+	}
+	expected := []result{{17, 42, 0}, {sshFxpStatus, 43, 2}, {sshFxpStatus, 44, 0}, {103, 45, 0}}
+	// Feed the stream in chunks of various sizes
+	for chunk := 1; chunk <= len(stream); chunk++ {
+		var got []result
+		p := &packetParser{cb: func(typ byte, id, status uint32) {
+			got = append(got, result{typ, id, status})
+		}}
+		for b := stream; len(b) > 0; {
+			n := min(chunk, len(b))
+			p.feed(b[:n])
+			b = b[n:]
+		}
+		if len(got) != len(expected) {
+			t.Fatalf("chunk %d: expected %v, got %v", chunk, expected, got)
+		}
+		for i := range expected {
+			if got[i] != expected[i] {
+				t.Errorf("chunk %d: #%d: expected %v, got %v", chunk, i, expected[i], got[i])
+			}
+		}
+	}
+}
+
+func TestMount(t *testing.T) {
+	reg := NewRegistry()
+	m := reg.NewMount("/home/user/repo", "/mnt/repo")
+	serverConn, clientConn := net.Pipe()
+	stdio := &util.RWC{
+		ReadCloser:  m.TapRequestReader(serverConn),
+		WriteCloser: m.TapResponseWriter(serverConn),
+	}
+	server := sftp.NewRequestServer(stdio, sftp.InMemHandler())
+	go server.Serve() //nolint:errcheck
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := client.Create("/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Stat("/nonexistent"); err == nil {
+		t.Fatal("expected an error for a nonexistent file")
+	}
+	_ = client.Close()
+	_ = server.Close()
+
+	for name, expected := range map[string]int64{"open": 1, "write": 1, "close": 1} {
+		if got := m.Op(name).Count.Load(); got != expected {
+			t.Errorf("expected %d %q operations, got %d", expected, name, got)
+		}
+		if got := m.Op(name).Latency.Count(); got != expected {
+			t.Errorf("expected %d %q latency observations, got %d", expected, name, got)
+		}
+	}
+	if got := m.Op("stat").Errors.Load() + m.Op("lstat").Errors.Load(); got != 1 {
+		t.Errorf("expected 1 stat error, got %d", got)
+	}
+	if m.RequestBytes.Load() == 0 || m.ResponseBytes.Load() == 0 {
+		t.Errorf("expected non-zero bytes, got %d and %d", m.RequestBytes.Load(), m.ResponseBytes.Load())
+	}
+
+	fw := reg.NewForward("127.0.0.1:8080:localhost:80")
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	tc := fw.TrackConn(c1)
+	_ = tc.Close()
+	_ = tc.Close()
+
+	var b bytes.Buffer
+	if err := reg.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	text := b.String()
+	for _, s := range []string{
+		"# TYPE sshocker_mount_bytes_total counter\n",
+		`sshocker_mount_operations_total{local="/home/user/repo",remote="/mnt/repo",op="write"} 1` + "\n",
+		`sshocker_mount_operation_duration_seconds_bucket{local="/home/user/repo",remote="/mnt/repo",op="write",le="+Inf"} 1` + "\n",
+		`sshocker_forward_connections_total{forward="127.0.0.1:8080:localhost:80"} 1` + "\n",
+		`sshocker_forward_active_connections{forward="127.0.0.1:8080:localhost:80"} 0` + "\n",
+	} {
+		if !strings.Contains(text, s) {
+			t.Errorf("expected %q in the output, got %s", s, text)
+		}
+	}
+	if n := strings.Count(text, "# TYPE sshocker_mount_operation_duration_seconds histogram"); n != 1 {
+		t.Errorf("expected the histogram header to appear once, got %d", n)
+	}
+}
@@ -0,0 +1,253 @@
+package metrics
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SFTP packet types. See draft-ietf-secsh-filexfer-02.
+const (
+	sshFxpInit    = 1
+	sshFxpVersion = 2
+	sshFxpStatus  = 101
+)
+
+// sshFxOK and sshFxEOF are the status codes that are not counted as errors.
+const (
+	sshFxOK  = 0
+	sshFxEOF = 1
+)
+
+var sftpOps = map[byte]string{
+	3:   "open",
+	4:   "close",
+	5:   "read",
+	6:   "write",
+	7:   "lstat",
+	8:   "fstat",
+	9:   "setstat",
+	10:  "fsetstat",
+	11:  "opendir",
+	12:  "readdir",
+	13:  "remove",
+	14:  "mkdir",
+	15:  "rmdir",
+	16:  "realpath",
+	17:  "stat",
+	18:  "rename",
+	19:  "readlink",
+	20:  "symlink",
+	200: "extended",
+}
+
+// Op is the metrics of an SFTP operation.
+type Op struct {
+	Count   atomic.Int64
+	Errors  atomic.Int64
+	Latency Histogram // from receiving the request to sending the response
+}
+
+// Mount is the metrics of a mount.
+//
+// The metrics are collected by tapping the SFTP stream between sshfs and the SFTP server,
+// so they are available for any driver.
+type Mount struct {
+	localPath     string
+	remotePath    string
+	RequestBytes  atomic.Int64 // received from sshfs
+	ResponseBytes atomic.Int64 // sent to sshfs
+	mu            sync.Mutex
+	ops           map[string]*Op
+	pending       map[uint32]pendingRequest
+}
+
+type pendingRequest struct {
+	op    string
+	start time.Time
+}
+
+func newMount(localPath, remotePath string) *Mount {
+	return &Mount{
+		localPath:  localPath,
+		remotePath: remotePath,
+		ops:        make(map[string]*Op),
+		pending:    make(map[uint32]pendingRequest),
+	}
+}
+
+// Op returns the metrics of the operation, such as "read".
+func (m *Mount) Op(name string) *Op {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.op(name)
+}
+
+func (m *Mount) op(name string) *Op {
+	o, ok := m.ops[name]
+	if !ok {
+		o = &Op{}
+		m.ops[name] = o
+	}
+	return o
+}
+
+func (m *Mount) onRequest(typ byte, id uint32) {
+	name, ok := sftpOps[typ]
+	if !ok {
+		name = "unknown"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.op(name).Count.Add(1)
+	m.pending[id] = pendingRequest{op: name, start: time.Now()}
+}
+
+func (m *Mount) onResponse(typ byte, id uint32, status uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	req, ok := m.pending[id]
+	if !ok {
+		return
+	}
+	delete(m.pending, id)
+	o := m.op(req.op)
+	o.Latency.Observe(time.Since(req.start))
+	if typ == sshFxpStatus && status != sshFxOK && status != sshFxEOF {
+		o.Errors.Add(1)
+	}
+}
+
+// TapRequestReader returns a reader that counts the requests read from r.
+func (m *Mount) TapRequestReader(r io.ReadCloser) io.ReadCloser {
+	return &tapReader{ReadCloser: r, p: &packetParser{cb: func(typ byte, id, _ uint32) { m.onRequest(typ, id) }}, n: &m.RequestBytes}
+}
+
+// TapResponseReader returns a reader that counts the responses read from r.
+func (m *Mount) TapResponseReader(r io.ReadCloser) io.ReadCloser {
+	return &tapReader{ReadCloser: r, p: &packetParser{cb: m.onResponse}, n: &m.ResponseBytes}
+}
+
+// TapResponseWriter returns a writer that counts the responses written to w.
+func (m *Mount) TapResponseWriter(w io.WriteCloser) io.WriteCloser {
+	return &tapWriter{WriteCloser: w, p: &packetParser{cb: m.onResponse}, n: &m.ResponseBytes}
+}
+
+func (m *Mount) writeText(tw *textWriter) {
+	base := []label{{"local", m.localPath}, {"remote", m.remotePath}}
+	tw.header("sshocker_mount_bytes_total", "counter", "Bytes transferred on the SFTP stream of the mount.")
+	tw.counter("sshocker_mount_bytes_total", append(base, label{"direction", "request"}), m.RequestBytes.Load())
+	tw.counter("sshocker_mount_bytes_total", append(base, label{"direction", "response"}), m.ResponseBytes.Load())
+	m.mu.Lock()
+	names := make([]string, 0, len(m.ops))
+	for name := range m.ops {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+	sort.Strings(names)
+	tw.header("sshocker_mount_operations_total", "counter", "SFTP operations on the mount.")
+	for _, name := range names {
+		tw.counter("sshocker_mount_operations_total", append(base, label{"op", name}), m.Op(name).Count.Load())
+	}
+	tw.header("sshocker_mount_operation_errors_total", "counter", "Failed SFTP operations on the mount.")
+	for _, name := range names {
+		tw.counter("sshocker_mount_operation_errors_total", append(base, label{"op", name}), m.Op(name).Errors.Load())
+	}
+	for _, name := range names {
+		tw.histogram("sshocker_mount_operation_duration_seconds", "Latency of the SFTP operations on the mount, measured on the client side of the mount.",
+			append(base, label{"op", name}), &m.Op(name).Latency)
+	}
+}
+
+// packetParser parses the SFTP packets incrementally, and calls cb with the type, the request ID,
+// and the status code (for SSH_FXP_STATUS) of each packet.
+// SSH_FXP_INIT and SSH_FXP_VERSION are skipped, as they lack the request ID.
+type packetParser struct {
+	cb     func(typ byte, id, status uint32)
+	header [4 + 1 + 4 + 4]byte // length, type, id, and status
+	hlen   int
+	skip   int64 // remaining bytes of the current packet
+}
+
+func (p *packetParser) fill(b []byte, want int) []byte {
+	n := copy(p.header[p.hlen:want], b)
+	p.hlen += n
+	return b[n:]
+}
+
+func (p *packetParser) feed(b []byte) {
+	for len(b) > 0 {
+		if p.skip > 0 {
+			n := min(int64(len(b)), p.skip)
+			p.skip -= n
+			b = b[n:]
+			continue
+		}
+		if p.hlen < 5 {
+			if b = p.fill(b, 5); p.hlen < 5 {
+				continue
+			}
+		}
+		total := int64(binary.BigEndian.Uint32(p.header[:4])) + 4
+		typ := p.header[4]
+		want := 5
+		switch typ {
+		case sshFxpInit, sshFxpVersion:
+		case sshFxpStatus:
+			want = 13
+		default:
+			want = 9
+		}
+		want = int(max(min(int64(want), total), 5))
+		if p.hlen < want {
+			if b = p.fill(b, want); p.hlen < want {
+				continue
+			}
+		}
+		if want >= 9 {
+			var status uint32
+			if want >= 13 {
+				status = binary.BigEndian.Uint32(p.header[9:13])
+			}
+			p.cb(typ, binary.BigEndian.Uint32(p.header[5:9]), status)
+		}
+		p.skip = total - int64(want)
+		p.hlen = 0
+	}
+}
+
+type tapReader struct {
+	io.ReadCloser
+	p *packetParser
+	n *atomic.Int64
+}
+
+func (r *tapReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 {
+		r.n.Add(int64(n))
+		r.p.feed(b[:n])
+	}
+	return n, err
+}
+
+type tapWriter struct {
+	io.WriteCloser
+	mu sync.Mutex
+	p  *packetParser
+	n  *atomic.Int64
+}
+
+func (w *tapWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.WriteCloser.Write(b)
+	if n > 0 {
+		w.n.Add(int64(n))
+		w.p.feed(b[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+)
+
+// Snapshot is a point-in-time copy of the metrics in a [Registry], for `sshocker inspect`.
+type Snapshot struct {
+	Mounts   []MountSnapshot   `json:"mounts"`
+	Forwards []ForwardSnapshot `json:"forwards"`
+}
+
+// MountSnapshot is a point-in-time copy of [Mount].
+type MountSnapshot struct {
+	LocalPath     string                `json:"localPath"`
+	RemotePath    string                `json:"remotePath"`
+	RequestBytes  int64                 `json:"requestBytes"`
+	ResponseBytes int64                 `json:"responseBytes"`
+	Ops           map[string]OpSnapshot `json:"ops,omitempty"` // By the operation, such as "read"
+}
+
+// OpSnapshot is a point-in-time copy of [Op].
+type OpSnapshot struct {
+	Count   int64             `json:"count"`
+	Errors  int64             `json:"errors"`
+	Latency HistogramSnapshot `json:"latency"`
+}
+
+// HistogramSnapshot is a point-in-time copy of [Histogram].
+type HistogramSnapshot struct {
+	Buckets    []BucketSnapshot `json:"buckets"` // Cumulative, as in the Prometheus text format
+	SumSeconds float64          `json:"sumSeconds"`
+}
+
+// BucketSnapshot is a bucket of [HistogramSnapshot].
+type BucketSnapshot struct {
+	LE    string `json:"le"` // The upper bound in seconds, or "+Inf"
+	Count int64  `json:"count"`
+}
+
+// ForwardSnapshot is a point-in-time copy of [Forward].
+type ForwardSnapshot struct {
+	Forward           string `json:"forward"`
+	Connections       int64  `json:"connections"`
+	ActiveConnections int64  `json:"activeConnections"`
+	UpstreamBytes     int64  `json:"upstreamBytes"`
+	DownstreamBytes   int64  `json:"downstreamBytes"`
+}
+
+// Snapshot returns a point-in-time copy of the metrics.
+// Snapshot is nil-safe; nil is returned for a nil registry.
+func (r *Registry) Snapshot() *Snapshot {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	mounts := append([]*Mount{}, r.mounts...)
+	forwards := append([]*Forward{}, r.forwards...)
+	r.mu.Unlock()
+	s := &Snapshot{
+		Mounts:   make([]MountSnapshot, 0, len(mounts)),
+		Forwards: make([]ForwardSnapshot, 0, len(forwards)),
+	}
+	for _, m := range mounts {
+		s.Mounts = append(s.Mounts, m.snapshot())
+	}
+	for _, f := range forwards {
+		s.Forwards = append(s.Forwards, ForwardSnapshot{
+			Forward:           f.forward,
+			Connections:       f.Connections.Load(),
+			ActiveConnections: f.ActiveConnections.Load(),
+			UpstreamBytes:     f.UpstreamBytes.Load(),
+			DownstreamBytes:   f.DownstreamBytes.Load(),
+		})
+	}
+	return s
+}
+
+func (m *Mount) snapshot() MountSnapshot {
+	s := MountSnapshot{
+		LocalPath:     m.localPath,
+		RemotePath:    m.remotePath,
+		RequestBytes:  m.RequestBytes.Load(),
+		ResponseBytes: m.ResponseBytes.Load(),
+		Ops:           make(map[string]OpSnapshot),
+	}
+	m.mu.Lock()
+	names := make([]string, 0, len(m.ops))
+	for name := range m.ops {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+	for _, name := range names {
+		o := m.Op(name)
+		s.Ops[name] = OpSnapshot{
+			Count:   o.Count.Load(),
+			Errors:  o.Errors.Load(),
+			Latency: o.Latency.snapshot(),
+		}
+	}
+	return s
+}
+
+func (h *Histogram) snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Buckets:    make([]BucketSnapshot, 0, len(LatencyBuckets)+1),
+		SumSeconds: float64(h.sumNs.Load()) / float64(time.Second),
+	}
+	var cum int64
+	for i := range len(LatencyBuckets) + 1 {
+		cum += h.counts[i].Load()
+		le := "+Inf"
+		if i < len(LatencyBuckets) {
+			le = strconv.FormatFloat(LatencyBuckets[i], 'g', -1, 64)
+		}
+		s.Buckets = append(s.Buckets, BucketSnapshot{LE: le, Count: cum})
+	}
+	return s
+}
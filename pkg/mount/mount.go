@@ -5,11 +5,32 @@ type MountType = int
 const (
 	MountTypeInvalid MountType = iota
 	MountTypeReverseSSHFS
+	MountTypeSync
 )
 
 type Mount struct {
-	Type        MountType
-	Source      string
-	Destination string
-	Readonly    bool
+	Type               MountType
+	Source             string
+	Destination        string
+	Readonly           bool
+	Notify             bool     // Propagate local file change notifications into the mount
+	NotifyIgnore       []string // gitignore-style patterns ignored by Notify
+	Overlay            bool     // MountTypeReverseSSHFS only. Protect the local directory with a copy-on-write overlay
+	Include            []string // MountTypeReverseSSHFS only. gitignore-style patterns of the files to be visible
+	Exclude            []string // gitignore-style patterns to be hidden from the mount, or excluded from the synchronization
+	Gitignore          bool     // MountTypeReverseSSHFS only. Hide the paths ignored by the .gitignore files
+	PullBack           bool     // MountTypeSync only. Pull back the remote changes on exit
+	AuditLog           string   // MountTypeReverseSSHFS only. Path of the audit log file
+	AuditLogMaxSize    int64    // Rotate AuditLog when exceeding the size in bytes. 0 disables the rotation
+	AuditLogMaxBackups int      // Number of the rotated AuditLog files to be kept
+	ReadLimit          int64    // MountTypeReverseSSHFS only. Max bytes per second read by the remote. 0 means unlimited
+	WriteLimit         int64    // MountTypeReverseSSHFS only. Max bytes per second written by the remote. 0 means unlimited
+	UIDMap             string   // MountTypeReverseSSHFS only. "user", or the remote UID to own the files
+	GIDMap             string   // MountTypeReverseSSHFS only. The remote GID to own the files
+	Umask              string   // MountTypeReverseSSHFS only. Octal umask applied to the file modes
+	Squash             bool     // MountTypeReverseSSHFS only. Make the files owned by the remote user
+	SFTPDeny           []string // MountTypeReverseSSHFS only. SFTP requests denied by the openssh-sftp-server driver, e.g., "remove"
+	SFTPAllow          []string // MountTypeReverseSSHFS only. SFTP requests allowed by the openssh-sftp-server driver
+	Preset             string   // MountTypeReverseSSHFS only. Name of the sshfs option preset, e.g., "source-code"
+	AllowOther         bool     // MountTypeReverseSSHFS only. Allow the other remote users to access the mount
 }
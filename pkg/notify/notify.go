@@ -0,0 +1,88 @@
+// Package notify propagates local file change notifications into reverse SSHFS mounts.
+//
+// sshfs does not deliver inotify events for the changes made on the client side,
+// so Notifier watches the local directory and replays the changes on the remote
+// by touching the affected paths with their own timestamps (`touch -c -r FILE FILE`).
+// This triggers attribute-change events for the remote watchers, without modifying the content.
+package notify
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/lima-vm/sshocker/pkg/fswatch"
+	"github.com/lima-vm/sshocker/pkg/pathfilter"
+	"github.com/lima-vm/sshocker/pkg/ssh"
+	"github.com/lima-vm/sshocker/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultIgnore is the default list of the ignored patterns.
+var DefaultIgnore = []string{".git", "node_modules"}
+
+type Notifier struct {
+	*ssh.SSHConfig
+	LocalPath  string
+	Host       string
+	Port       int
+	RemotePath string
+	Ignore     []string      // gitignore-style patterns
+	Debounce   time.Duration // Optional
+	watcher    *fswatch.Watcher
+}
+
+func (n *Notifier) Start() error {
+	filter, err := pathfilter.New(n.Ignore)
+	if err != nil {
+		return err
+	}
+	n.watcher = &fswatch.Watcher{
+		Root:     n.LocalPath,
+		Filter:   filter,
+		Debounce: n.Debounce,
+		Callback: n.replay,
+	}
+	logrus.Debugf("watching %q for propagating notifications onto %q (remote)", n.LocalPath, n.RemotePath)
+	return n.watcher.Start()
+}
+
+func (n *Notifier) replay(paths []string) {
+	scriptName := "replay-notifications"
+	script := generateReplayScript(n.RemotePath, paths)
+	logrus.Debugf("replaying %d notifications on %q (remote)", len(paths), n.RemotePath)
+	stdout, stderr, err := ssh.ExecuteScript(n.Host, n.Port, n.SSHConfig, script, scriptName)
+	logrus.Debugf("executed script %q, stdout=%q, stderr=%q, err=%v", scriptName, stdout, stderr, err)
+	if err != nil {
+		logrus.WithError(err).Warnf("failed to replay notifications on %q (remote)", n.RemotePath)
+	}
+}
+
+// generateReplayScript generates the script for touching the paths.
+// For removed paths, the parent directories are touched.
+func generateReplayScript(remotePath string, paths []string) string {
+	var b strings.Builder
+	b.WriteString(`#!/bin/sh
+set -u
+t() {
+  if [ -e "$1" ] || [ -L "$1" ]; then
+    touch -c -h -r "$1" "$1" 2>/dev/null || touch -c -r "$1" "$1"
+  else
+    d="$(dirname "$1")"
+    [ -d "$d" ] && touch -c -r "$d" "$d"
+  fi
+}
+`)
+	for _, p := range paths {
+		b.WriteString("t " + util.ShellQuote(path.Join(remotePath, p)) + "\n")
+	}
+	b.WriteString("exit 0\n")
+	return b.String()
+}
+
+func (n *Notifier) Close() error {
+	if n.watcher == nil {
+		return nil
+	}
+	return n.watcher.Close()
+}
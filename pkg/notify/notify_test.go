@@ -0,0 +1,18 @@
+package notify
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateReplayScript(t *testing.T) {
+	script := generateReplayScript("/mnt/foo", []string{"a.txt", "dir/it's.go"})
+	for _, expected := range []string{
+		"t '/mnt/foo/a.txt'\n",
+		`t '/mnt/foo/dir/it'\''s.go'` + "\n",
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("expected %q to be contained in %q", expected, script)
+		}
+	}
+}
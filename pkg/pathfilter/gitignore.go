@@ -0,0 +1,79 @@
+package pathfilter
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// ReadGitignore reads the ".gitignore" files in fsys, and returns the patterns relative to the root of fsys.
+// The patterns in the nested ".gitignore" files are rewritten to be scoped to their directories.
+// The directories ignored by the parent ".gitignore" files and the ".git" directories are not traversed.
+func ReadGitignore(fsys fs.FS) ([]string, error) {
+	var patterns []string
+	f := &Filter{}
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p != "." && errors.Is(err, fs.ErrPermission) {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if p != "." && (d.Name() == ".git" || f.Match(p, true)) {
+			return fs.SkipDir
+		}
+		b, err := fs.ReadFile(fsys, path.Join(p, ".gitignore"))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		sc := bufio.NewScanner(strings.NewReader(string(b)))
+		for sc.Scan() {
+			s := scopeGitignorePattern(p, sc.Text())
+			if s == "" {
+				continue
+			}
+			if err := f.Add(s); err != nil {
+				return err
+			}
+			patterns = append(patterns, s)
+		}
+		return sc.Err()
+	})
+	return patterns, err
+}
+
+// scopeGitignorePattern rewrites the pattern in dir/.gitignore to be relative to the root.
+// Returns an empty string for empty lines and comments.
+func scopeGitignorePattern(dir, s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.HasPrefix(s, "#") {
+		return ""
+	}
+	if dir == "." {
+		return s
+	}
+	var negate string
+	if strings.HasPrefix(s, "!") {
+		negate = "!"
+		s = s[1:]
+	}
+	var dirOnly string
+	if strings.HasSuffix(s, "/") {
+		dirOnly = "/"
+		s = strings.TrimRight(s, "/")
+	}
+	if strings.Contains(s, "/") {
+		s = dir + "/" + strings.TrimPrefix(s, "/")
+	} else {
+		s = dir + "/**/" + s
+	}
+	return negate + s + dirOnly
+}
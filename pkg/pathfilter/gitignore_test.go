@@ -0,0 +1,43 @@
+package pathfilter
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestReadGitignore(t *testing.T) {
+	fsys := fstest.MapFS{
+		".gitignore":              {Data: []byte("# comment\n*.log\n/build/\n\n")},
+		"build/.gitignore":        {Data: []byte("ignored\n")},
+		"web/.gitignore":          {Data: []byte("node_modules/\n/dist\n!keep.log\n")},
+		"web/src/index.js":        {Data: []byte("")},
+		".git/info/.gitignore":    {Data: []byte("ignored\n")},
+		"web/node_modules/foo.js": {Data: []byte("")},
+	}
+	patterns, err := ReadGitignore(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"*.log", "/build/", "web/**/node_modules/", "web/dist", "!web/**/keep.log"}
+	if !reflect.DeepEqual(patterns, expected) {
+		t.Fatalf("expected %q, got %q", expected, patterns)
+	}
+	f, err := New(patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, expected := range map[string]bool{
+		"a.log":                   true,
+		"web/keep.log":            false,
+		"web/dist/app.js":         true,
+		"dist":                    false,
+		"web/node_modules/foo.js": true,
+		"node_modules/foo.js":     false,
+		"web/src/index.js":        false,
+	} {
+		if got := f.Match(p, false); got != expected {
+			t.Errorf("expected %v, got %v for %q", expected, got, p)
+		}
+	}
+}
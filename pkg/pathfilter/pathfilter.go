@@ -0,0 +1,173 @@
+// Package pathfilter implements gitignore-style path patterns.
+package pathfilter
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type pattern struct {
+	raw      string
+	re       *regexp.Regexp
+	negate   bool // "!foo"
+	dirOnly  bool // "foo/"
+	anchored bool // contains a slash, except the trailing one
+}
+
+// Filter matches slash-separated relative paths against gitignore-style patterns.
+//
+// The following syntax is supported:
+//   - "foo" matches "foo" in any directory
+//   - "/foo" and "foo/bar" are relative to the root
+//   - "foo/" matches directories only
+//   - "*", "?", and "[...]" match characters except "/"
+//   - "**" matches zero or more directories
+//   - "!foo" negates the pattern. The last matching pattern wins.
+//
+// A path is also matched when any of its parent directories is matched,
+// as in gitignore.
+type Filter struct {
+	patterns []pattern
+}
+
+// New parses the patterns. Empty patterns and comments ("#...") are ignored.
+func New(patterns []string) (*Filter, error) {
+	f := &Filter{}
+	for _, s := range patterns {
+		if err := f.Add(s); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Add parses and appends the pattern.
+func (f *Filter) Add(s string) error {
+	p := pattern{raw: s}
+	s = strings.TrimSpace(s)
+	if s == "" || strings.HasPrefix(s, "#") {
+		return nil
+	}
+	if strings.HasPrefix(s, "!") {
+		p.negate = true
+		s = s[1:]
+	}
+	if strings.HasSuffix(s, "/") {
+		p.dirOnly = true
+		s = strings.TrimRight(s, "/")
+	}
+	if strings.Contains(s, "/") {
+		p.anchored = true
+		s = strings.TrimPrefix(s, "/")
+	}
+	if s == "" {
+		return fmt.Errorf("invalid pattern %q", p.raw)
+	}
+	re, err := regexp.Compile("^" + globToRegexp(s) + "$")
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", p.raw, err)
+	}
+	p.re = re
+	f.patterns = append(f.patterns, p)
+	return nil
+}
+
+// Escape escapes the special characters in the literal name, so that the name can be used in a pattern.
+// Trailing spaces cannot be escaped.
+func Escape(name string) string {
+	var b strings.Builder
+	for _, c := range name {
+		if strings.ContainsRune(`\*?[!#`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Empty returns true if f has no pattern.
+func (f *Filter) Empty() bool {
+	return f == nil || len(f.patterns) == 0
+}
+
+// Match returns true if the slash-separated relative path p or its parent directory is matched.
+// isDir specifies whether p is a directory.
+func (f *Filter) Match(p string, isDir bool) bool {
+	if f.Empty() {
+		return false
+	}
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return false
+	}
+	components := strings.Split(p, "/")
+	for i := range components {
+		prefix := strings.Join(components[:i+1], "/")
+		prefixIsDir := isDir || i < len(components)-1
+		if f.matchExact(prefix, prefixIsDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchExact returns the result of the last matching pattern, without considering the parent directories.
+func (f *Filter) matchExact(p string, isDir bool) bool {
+	matched := false
+	for _, pat := range f.patterns {
+		if pat.dirOnly && !isDir {
+			continue
+		}
+		target := p
+		if !pat.anchored {
+			target = path.Base(p)
+		}
+		if pat.re.MatchString(target) {
+			matched = !pat.negate
+		}
+	}
+	return matched
+}
+
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**/") {
+				b.WriteString("(.*/)?")
+				i += 2
+			} else if strings.HasPrefix(glob[i:], "**") {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
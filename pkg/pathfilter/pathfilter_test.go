@@ -0,0 +1,45 @@
+package pathfilter
+
+import "testing"
+
+func TestFilter(t *testing.T) {
+	type testCase struct {
+		patterns []string
+		path     string
+		isDir    bool
+		expected bool
+	}
+	testCases := []testCase{
+		{patterns: []string{".git"}, path: ".git", isDir: true, expected: true},
+		{patterns: []string{".git"}, path: ".git/objects/aa", expected: true},
+		{patterns: []string{"node_modules"}, path: "web/node_modules/foo/index.js", expected: true},
+		{patterns: []string{"node_modules"}, path: "web/node_modules_foo", expected: false},
+		{patterns: []string{"/build"}, path: "build/out", expected: true},
+		{patterns: []string{"/build"}, path: "src/build", expected: false},
+		{patterns: []string{"secrets/"}, path: "secrets", isDir: false, expected: false},
+		{patterns: []string{"secrets/"}, path: "secrets/key", expected: true},
+		{patterns: []string{"*.log"}, path: "a/b/c.log", expected: true},
+		{patterns: []string{"*.log", "!keep.log"}, path: "a/keep.log", expected: false},
+		{patterns: []string{".git/objects"}, path: ".git/objects/aa", expected: true},
+		{patterns: []string{".git/objects"}, path: "sub/.git/objects", isDir: true, expected: false},
+		{patterns: []string{"**/.git/objects"}, path: "sub/.git/objects", isDir: true, expected: true},
+		{patterns: []string{"a/**/z"}, path: "a/z", expected: true},
+		{patterns: []string{"a/**/z"}, path: "a/b/c/z", expected: true},
+		{patterns: []string{".env*"}, path: ".env.local", expected: true},
+		{patterns: []string{"file[0-9]"}, path: "file1", expected: true},
+		{patterns: []string{"# comment", ""}, path: "# comment", expected: false},
+		{patterns: nil, path: "foo", expected: false},
+		{patterns: []string{"/" + Escape("#a*[b]?!.txt")}, path: "#a*[b]?!.txt", expected: true},
+		{patterns: []string{"/" + Escape("a*.txt")}, path: "ab.txt", expected: false},
+	}
+	for i, tc := range testCases {
+		f, err := New(tc.patterns)
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		if got := f.Match(tc.path, tc.isDir); got != tc.expected {
+			t.Errorf("#%d: expected %v, got %v for %q with %v", i, tc.expected, got, tc.path, tc.patterns)
+		}
+	}
+}
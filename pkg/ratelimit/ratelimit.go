@@ -0,0 +1,138 @@
+// Package ratelimit implements the bandwidth limiting of the streams.
+package ratelimit
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// minBurst is the minimum burst size in bytes.
+const minBurst = 1024
+
+// Limiter is a token bucket limiter of bytes per second.
+// Limiter is safe for concurrent use. A nil Limiter does not limit anything.
+type Limiter struct {
+	rate   float64 // bytes per second
+	burst  int
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// New returns a limiter of bytesPerSec.
+// nil is returned when bytesPerSec <= 0.
+func New(bytesPerSec int64) *Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	// Allow bursts of 250ms
+	burst := int(max(bytesPerSec/4, minBurst))
+	return &Limiter{
+		rate:   float64(bytesPerSec),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Burst returns the max number of bytes that can be passed to WaitN.
+func (l *Limiter) Burst() int {
+	return l.burst
+}
+
+// WaitN blocks until n bytes are allowed.
+// n should not exceed Burst.
+func (l *Limiter) WaitN(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, float64(l.burst))
+	l.last = now
+	// Reserve the tokens, so that the concurrent callers wait in order
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+type reader struct {
+	io.Reader
+	l *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > r.l.burst {
+		p = p[:r.l.burst]
+	}
+	n, err := r.Reader.Read(p)
+	r.l.WaitN(n)
+	return n, err
+}
+
+type writer struct {
+	io.Writer
+	l *Limiter
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), w.l.burst)]
+		w.l.WaitN(len(chunk))
+		n, err := w.Writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// NewReader returns a reader limited by l.
+// r is returned as is when l is nil.
+func NewReader(r io.Reader, l *Limiter) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{Reader: r, l: l}
+}
+
+// NewWriter returns a writer limited by l.
+// w is returned as is when l is nil.
+func NewWriter(w io.Writer, l *Limiter) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &writer{Writer: w, l: l}
+}
+
+// NewReadCloser is similar to NewReader, but preserves Close.
+func NewReadCloser(r io.ReadCloser, l *Limiter) io.ReadCloser {
+	if l == nil {
+		return r
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{NewReader(r, l), r}
+}
+
+// NewWriteCloser is similar to NewWriter, but preserves Close.
+func NewWriteCloser(w io.WriteCloser, l *Limiter) io.WriteCloser {
+	if l == nil {
+		return w
+	}
+	return struct {
+		io.Writer
+		io.Closer
+	}{NewWriter(w, l), w}
+}
@@ -0,0 +1,48 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	if New(0) != nil {
+		t.Fatal("expected nil for unlimited")
+	}
+	const (
+		rate = 64 * 1024
+		size = 48 * 1024
+	)
+	l := New(rate)
+	data := bytes.Repeat([]byte("x"), size)
+	begin := time.Now()
+	var dst bytes.Buffer
+	n, err := io.Copy(NewWriter(&dst, l), NewReader(bytes.NewReader(data), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(begin)
+	if n != size || dst.Len() != size {
+		t.Fatalf("expected %d bytes, got %d", size, n)
+	}
+	// The first burst (rate/4) is free, so the rest takes (size - rate/4) / rate seconds
+	expected := time.Duration(float64(size-rate/4) / rate * float64(time.Second))
+	if elapsed < expected*9/10 {
+		t.Errorf("expected at least %v, took %v", expected, elapsed)
+	}
+
+	begin = time.Now()
+	n, err = io.Copy(io.Discard, NewReader(bytes.NewReader(data), New(rate)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed = time.Since(begin)
+	if n != size {
+		t.Fatalf("expected %d bytes, got %d", size, n)
+	}
+	if elapsed < expected*9/10 {
+		t.Errorf("expected at least %v, took %v", expected, elapsed)
+	}
+}
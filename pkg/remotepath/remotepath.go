@@ -0,0 +1,79 @@
+// Package remotepath resolves the remote paths relative to the remote home directory,
+// and the templated remote paths.
+package remotepath
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/lima-vm/sshocker/pkg/ssh"
+	"github.com/sirupsen/logrus"
+)
+
+// Vars is the set of the values for resolving the remote paths.
+type Vars struct {
+	RemoteHome string // $HOME of the remote user, e.g., "/home/foo"
+	User       string // Name of the remote user, e.g., "foo"
+}
+
+// NeedsResolve returns true if p contains "~", "$HOME", or templates.
+func NeedsResolve(p string) bool {
+	return p == "~" || strings.HasPrefix(p, "~/") ||
+		strings.Contains(p, "$HOME") || strings.Contains(p, "${HOME}") ||
+		strings.Contains(p, "{{")
+}
+
+// Resolve resolves the following notations in p, and returns the absolute path:
+//   - "~" and "~/" as the prefix
+//   - "$HOME" and "${HOME}"
+//   - "{{.RemoteHome}}" and "{{.User}}"
+func Resolve(p string, vars Vars) (string, error) {
+	tmpl, err := template.New(p).Option("missingkey=error").Parse(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %q: %w", p, err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("failed to execute %q: %w", p, err)
+	}
+	s := b.String()
+	if s == "~" || strings.HasPrefix(s, "~/") {
+		s = vars.RemoteHome + strings.TrimPrefix(s, "~")
+	}
+	s = strings.ReplaceAll(s, "${HOME}", vars.RemoteHome)
+	s = strings.ReplaceAll(s, "$HOME", vars.RemoteHome)
+	if !path.IsAbs(s) {
+		return "", fmt.Errorf("%q is resolved to a relative path %q", p, s)
+	}
+	return path.Clean(s), nil
+}
+
+// Query queries the remote host for [Vars].
+func Query(host string, port int, c *ssh.SSHConfig) (*Vars, error) {
+	const scriptName = "query-remote-vars"
+	script := `#!/bin/sh
+set -eu
+echo "${HOME}"
+id -un
+`
+	stdout, stderr, err := ssh.ExecuteScript(host, port, c, script, scriptName)
+	logrus.Debugf("executed script %q, stdout=%q, stderr=%q, err=%v", scriptName, stdout, stderr, err)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 2 {
+		return nil, fmt.Errorf("unexpected output of script %q: %q", scriptName, stdout)
+	}
+	vars := &Vars{
+		RemoteHome: lines[0],
+		User:       lines[1],
+	}
+	if !path.IsAbs(vars.RemoteHome) {
+		return nil, fmt.Errorf("the remote home directory %q is not an absolute path", vars.RemoteHome)
+	}
+	return vars, nil
+}
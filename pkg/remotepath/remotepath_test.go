@@ -0,0 +1,54 @@
+package remotepath
+
+import "testing"
+
+func TestResolve(t *testing.T) {
+	vars := Vars{RemoteHome: "/home/foo", User: "foo"}
+	testCases := map[string]string{
+		"~":                          "/home/foo",
+		"~/src":                      "/home/foo/src",
+		"$HOME/src":                  "/home/foo/src",
+		"${HOME}/src/":               "/home/foo/src",
+		"{{.RemoteHome}}/src":        "/home/foo/src",
+		"/mnt/{{.User}}/src":         "/mnt/foo/src",
+		"/mnt/~foo":                  "/mnt/~foo",
+		"/mnt/sshocker":              "/mnt/sshocker",
+		"src":                        "",
+		"~foo/src":                   "",
+		"{{.Unknown}}/src":           "",
+		"{{.RemoteHome":              "",
+		"{{.RemoteHome}}/{{.User}}/": "/home/foo/foo",
+	}
+	for p, expected := range testCases {
+		got, err := Resolve(p, vars)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", p, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", p, err)
+			continue
+		}
+		if got != expected {
+			t.Errorf("%q: expected %q, got %q", p, expected, got)
+		}
+	}
+}
+
+func TestNeedsResolve(t *testing.T) {
+	testCases := map[string]bool{
+		"~":                   true,
+		"~/src":               true,
+		"$HOME/src":           true,
+		"{{.RemoteHome}}/src": true,
+		"/mnt/src":            false,
+		"/mnt/~foo":           false,
+	}
+	for p, expected := range testCases {
+		if got := NeedsResolve(p); got != expected {
+			t.Errorf("%q: expected %v, got %v", p, expected, got)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package reversesshfs
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lima-vm/sshocker/pkg/ssh"
+	"github.com/lima-vm/sshocker/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Transport is the transport of the SFTP session between the driver and the remote sshfs.
+type Transport = string
+
+const (
+	// TransportStdio pipes the SFTP session through the stdio of the ssh process executing `sshfs -o slave`.
+	TransportStdio = Transport("stdio") // Default
+	// TransportDirect listens on a local Unix socket, and forwards a remote Unix socket to it over the ssh master.
+	// The remote socket is created in a private temporary directory, so that only the remote user (and root) can connect to it.
+	// The remote sshfs connects to the socket with `-o ssh_command`, via a script executing socat or `nc -U`.
+	// The session is still encrypted by ssh between the hosts, but the ssh process and the pipes for each mount are not needed.
+	TransportDirect = Transport("direct")
+)
+
+// directAcceptTimeout is the timeout for the remote sshfs to connect to the forwarded socket.
+const directAcceptTimeout = 30 * time.Second
+
+// directSetupScript creates the private remote directory for TransportDirect, and prints its path.
+//
+// The directory contains the forwarded socket "sftp.sock", and the script "connect" executed by sshfs as `-o ssh_command`.
+// The script ignores the ssh arguments appended by sshfs, and relays its stdio to the socket.
+const directSetupScript = `#!/bin/sh
+set -eu
+if ! command -v socat >/dev/null 2>&1 && ! command -v nc >/dev/null 2>&1; then
+  echo >&2 "transport \"direct\" requires socat or nc (with -U) on the remote host"
+  exit 1
+fi
+umask 077
+dir=$(mktemp -d "${TMPDIR:-/tmp}/sshocker-direct-XXXXXXXXXX")
+cat >"${dir}/connect" <<'EOF'
+#!/bin/sh
+sock="$(dirname "$0")/sftp.sock"
+if command -v socat >/dev/null 2>&1; then
+  exec socat STDIO "UNIX-CONNECT:${sock}"
+fi
+exec nc -U "${sock}"
+EOF
+chmod 0700 "${dir}/connect"
+echo "${dir}"
+`
+
+// directRemoteDirRegexp matches the remote directories that need no quoting, as sshfs splits ssh_command by whitespaces.
+var directRemoteDirRegexp = regexp.MustCompile(`^/[A-Za-z0-9/._-]+$`)
+
+// direct is the state of TransportDirect.
+type direct struct {
+	dir       string // Contains the local socket
+	listener  *net.UnixListener
+	remoteDir string // Contains the remote socket and the connect script
+	forwarded bool
+}
+
+// remoteSocket returns the path of the remote socket.
+func (d *direct) remoteSocket() string {
+	return path.Join(d.remoteDir, "sftp.sock")
+}
+
+// sshCommand returns the value of the sshfs option ssh_command.
+func (d *direct) sshCommand() string {
+	return path.Join(d.remoteDir, "connect")
+}
+
+// listenDirect listens on a local Unix socket, and requests the ssh master to forward a remote Unix socket to it.
+func (rsf *ReverseSSHFS) listenDirect() (retErr error) {
+	if !rsf.SSHConfig.Persist && rsf.SSHConfig.ControlPath == "" {
+		return fmt.Errorf("transport %q requires the ssh master (ControlPersist)", TransportDirect)
+	}
+	// The directory is accessible only by the current user
+	dir, err := os.MkdirTemp("", "sshocker-direct-")
+	if err != nil {
+		return err
+	}
+	d := &direct{dir: dir}
+	defer func() {
+		if retErr != nil {
+			_ = d.close(rsf)
+		}
+	}()
+	sock := filepath.Join(dir, "sftp.sock")
+	d.listener, err = net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	const scriptName = "direct-setup"
+	stdout, stderr, err := ssh.ExecuteScript(rsf.Host, rsf.Port, rsf.SSHConfig, directSetupScript, scriptName)
+	logrus.Debugf("executed script %q, stdout=%q, stderr=%q, err=%v", scriptName, stdout, stderr, err)
+	if err != nil {
+		if msg := strings.TrimSpace(stderr); msg != "" {
+			return fmt.Errorf("failed to create the remote directory for the socket: %s", msg)
+		}
+		return fmt.Errorf("failed to create the remote directory for the socket: %w", err)
+	}
+	remoteDir := strings.TrimSpace(stdout)
+	if !directRemoteDirRegexp.MatchString(remoteDir) {
+		return fmt.Errorf("unexpected output of script %q: %q", scriptName, stdout)
+	}
+	d.remoteDir = remoteDir
+	if err = ssh.RemoteForward(rsf.Host, rsf.Port, rsf.SSHConfig, d.remoteSocket(), sock); err != nil {
+		return err
+	}
+	d.forwarded = true
+	logrus.Debugf("Forwarding the remote socket %q to %q", d.remoteSocket(), sock)
+	rsf.direct = d
+	return nil
+}
+
+// acceptDirect accepts the connection from the remote sshfs.
+// The connection is returned as the files, so that the drivers can pass them to their processes.
+func (rsf *ReverseSSHFS) acceptDirect() (*util.RWC, error) {
+	l := rsf.direct.listener
+	if err := l.SetDeadline(time.Now().Add(directAcceptTimeout)); err != nil {
+		return nil, err
+	}
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		return nil, fmt.Errorf("sshfs did not connect to the remote socket %q: %w", rsf.direct.remoteSocket(), err)
+	}
+	defer conn.Close()
+	// The connection is duplicated twice, as util.RWC closes both
+	r, err := conn.File()
+	if err != nil {
+		return nil, err
+	}
+	w, err := conn.File()
+	if err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+	return &util.RWC{ReadCloser: r, WriteCloser: w}, nil
+}
+
+// close cancels the forward, and removes the local and the remote directories.
+func (d *direct) close(rsf *ReverseSSHFS) error {
+	var errs []error
+	if d.forwarded {
+		sock := filepath.Join(d.dir, "sftp.sock")
+		if err := ssh.CancelRemoteForward(rsf.Host, rsf.Port, rsf.SSHConfig, d.remoteSocket(), sock); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if d.remoteDir != "" {
+		const scriptName = "direct-cleanup"
+		script := "#!/bin/sh\nset -eu\nrm -rf " + util.ShellQuote(d.remoteDir) + "\n"
+		stdout, stderr, err := ssh.ExecuteScript(rsf.Host, rsf.Port, rsf.SSHConfig, script, scriptName)
+		logrus.Debugf("executed script %q, stdout=%q, stderr=%q, err=%v", scriptName, stdout, stderr, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove the remote directory %q: %w", d.remoteDir, err))
+		}
+	}
+	if d.listener != nil {
+		if err := d.listener.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := os.RemoveAll(d.dir); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,170 @@
+package reversesshfs
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/lima-vm/sshocker/pkg/util"
+	"github.com/lima-vm/sshocker/pkg/vfs"
+	"github.com/pkg/sftp"
+)
+
+// dialDirect returns a ReverseSSHFS listening on a Unix socket as in TransportDirect, without the remote forward,
+// and the client side connection.
+func dialDirect(tb testing.TB) (*ReverseSSHFS, net.Conn) {
+	tb.Helper()
+	if runtime.GOOS == "windows" {
+		tb.Skip("needs Unix sockets with File")
+	}
+	dir := tb.TempDir()
+	sock := filepath.Join(dir, "sftp.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	rsf := &ReverseSSHFS{direct: &direct{dir: dir, listener: l}}
+	tb.Cleanup(func() {
+		_ = l.Close()
+	})
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return rsf, conn
+}
+
+func TestAcceptDirect(t *testing.T) {
+	rsf, conn := dialDirect(t)
+	stdio, err := rsf.acceptDirect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdio.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(stdio, b); err != nil || string(b) != "ping" {
+		t.Fatalf("unexpected %q (%v)", string(b), err)
+	}
+	// The connection has to be passed to the processes of the drivers as files
+	if _, ok := stdio.ReadCloser.(*os.File); !ok {
+		t.Errorf("expected *os.File, got %T", stdio.ReadCloser)
+	}
+}
+
+// TestDirectSetupScript runs directSetupScript locally, with a fake nc recording its arguments.
+func TestDirectSetupScript(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	binDir := t.TempDir()
+	ncOut := filepath.Join(t.TempDir(), "nc.out")
+	if err := os.WriteFile(filepath.Join(binDir, "nc"), []byte("#!/bin/sh\necho \"$@\" >"+util.ShellQuote(ncOut)+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	tmpDir := t.TempDir()
+	cmd := exec.Command("sh", "-c", directSetupScript)
+	cmd.Env = append(os.Environ(), "TMPDIR="+tmpDir, "PATH="+binDir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &direct{remoteDir: strings.TrimSpace(string(out))}
+	if !directRemoteDirRegexp.MatchString(d.remoteDir) || filepath.Dir(d.remoteDir) != tmpDir {
+		t.Fatalf("unexpected directory %q", d.remoteDir)
+	}
+	st, err := os.Stat(d.remoteDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := st.Mode().Perm(); perm != 0o700 {
+		t.Errorf("expected the directory to be 0700, got %o", perm)
+	}
+	// sshfs appends the ssh arguments, which are ignored
+	cmd = exec.Command(d.sshCommand(), "-x", "-a", "-oClearAllForwardings=yes", "-2", "127.0.0.1", "-s", "sftp")
+	cmd.Env = append(os.Environ(), "PATH="+binDir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	b, err := os.ReadFile(ncOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := strings.TrimSpace(string(b)), "-U "+d.remoteSocket(); got != expected {
+		t.Errorf("expected nc %q, got %q", expected, got)
+	}
+}
+
+// BenchmarkTransport compares the local legs of TransportStdio (pipes) and TransportDirect (a Unix socket),
+// by reading a file from the builtin driver with an SFTP client.
+// The remote legs (ssh and sshfs) are not included.
+func BenchmarkTransport(b *testing.B) {
+	const size = 16 << 20
+	localDir := b.TempDir()
+	if err := os.WriteFile(filepath.Join(localDir, "file"), bytes.Repeat([]byte{'x'}, size), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	info, _ := LookupDriver(DriverBuiltin)
+	transports := map[Transport]func(b *testing.B) (driverSide *util.RWC, clientSide io.ReadWriteCloser){
+		TransportStdio: func(b *testing.B) (*util.RWC, io.ReadWriteCloser) {
+			reqReader, reqWriter, err := os.Pipe()
+			if err != nil {
+				b.Fatal(err)
+			}
+			resReader, resWriter, err := os.Pipe()
+			if err != nil {
+				b.Fatal(err)
+			}
+			return &util.RWC{ReadCloser: reqReader, WriteCloser: resWriter}, &util.RWC{ReadCloser: resReader, WriteCloser: reqWriter}
+		},
+		TransportDirect: func(b *testing.B) (*util.RWC, io.ReadWriteCloser) {
+			rsf, conn := dialDirect(b)
+			stdio, err := rsf.acceptDirect()
+			if err != nil {
+				b.Fatal(err)
+			}
+			return stdio, conn
+		},
+	}
+	for transport, connect := range transports {
+		b.Run(transport, func(b *testing.B) {
+			driverSide, clientSide := connect(b)
+			d, err := info.New(DriverConfig{LocalPath: localDir, FS: vfs.DirFS(localDir), Readonly: true})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer d.Close()
+			if err := d.Start(driverSide); err != nil {
+				b.Fatal(err)
+			}
+			client, err := sftp.NewClientPipe(clientSide, clientSide)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer client.Close()
+			b.SetBytes(size)
+			b.ResetTimer()
+			for range b.N {
+				f, err := client.Open("/file")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n, err := io.Copy(io.Discard, f); err != nil || n != size {
+					b.Fatalf("read %d bytes: %v", n, err)
+				}
+				_ = f.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package reversesshfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/lima-vm/sshocker/pkg/audit"
+	"github.com/lima-vm/sshocker/pkg/sandbox"
+	"github.com/lima-vm/sshocker/pkg/sftpserver"
+	"github.com/lima-vm/sshocker/pkg/util"
+	"github.com/lima-vm/sshocker/pkg/vfs"
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+)
+
+// DriverExec executes the command that speaks SFTP on stdio, e.g., "exec:rclone serve sftp --stdio .".
+const DriverExec = Driver("exec")
+
+// SFTPDriver serves SFTP for a mount.
+// SFTPDriver is instantiated for each mount by [DriverInfo.New].
+type SFTPDriver interface {
+	// Root returns the SFTP path to be mounted by sshfs, e.g., "/" for a driver that serves LocalPath as the root.
+	Root() string
+	// Start starts serving SFTP on stdio, i.e., reads the requests of sshfs from stdio and writes the responses to stdio.
+	// Start must not block.
+	Start(stdio io.ReadWriteCloser) error
+	// Close stops serving SFTP.
+	Close() error
+}
+
+// DriverConfig is the configuration passed to [DriverInfo.New].
+type DriverConfig struct {
+	LocalPath string        // The local directory to be served. May be a Cygwin/msys2 path on Windows.
+	FS        fs.FS         // The filesystem to be served instead of LocalPath. Set only for the drivers with SupportsFS.
+	Arg       string        // ARG of "NAME:ARG", e.g., "/path/to/cmd args" for "exec:/path/to/cmd args"
+	Readonly  bool          // Only for the drivers with SupportsReadonly
+	Audit     audit.Handler // Optional. Only for the drivers with SupportsAudit.
+	UID       *uint32       // Optional. The UID reported as the owner of the files. sshfs is also configured with `-o uid=`.
+	GID       *uint32       // Optional. The GID reported as the owner of the files. sshfs is also configured with `-o gid=`.
+	Umask     fs.FileMode   // The umask applied to the file modes. sshfs is also configured with `-o umask=`.
+	Sandbox   bool          // Only for the drivers with SupportsSandbox
+	// DeniedRequests and AllowedRequests are the SFTP requests to be denied and allowed,
+	// e.g., "remove". Only for the drivers with SupportsRequestFilter.
+	DeniedRequests  []string
+	AllowedRequests []string
+	// ServedPaths are the local directories actually served under LocalPath, for ReverseSSHFS.Submounts.
+	// When set, the sandbox allows only them instead of LocalPath.
+	ServedPaths []string
+}
+
+// DriverInfo describes a driver registered with [RegisterDriver].
+type DriverInfo struct {
+	Name             Driver
+	New              func(DriverConfig) (SFTPDriver, error)
+	SupportsReadonly bool // Enforces DriverConfig.Readonly
+	SupportsFS       bool // Serves DriverConfig.FS. Required for ReverseSSHFS.FS, Include, Exclude, Gitignore, and single files.
+	SupportsAudit    bool // Emits the audit records to DriverConfig.Audit
+	SupportsSandbox  bool // Confines the SFTP server to LocalPath with package sandbox, when DriverConfig.Sandbox is set
+	// SupportsRequestFilter is true if the driver supports DriverConfig.DeniedRequests and DriverConfig.AllowedRequests
+	SupportsRequestFilter bool
+}
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[Driver]DriverInfo)
+)
+
+// RegisterDriver registers the driver, so that it can be specified in ReverseSSHFS.Driver.
+// Panics if the name is invalid or already registered.
+func RegisterDriver(info DriverInfo) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if info.Name == "" || info.Name == DriverAuto || strings.Contains(info.Name, ":") {
+		panic(fmt.Errorf("invalid driver name %q", info.Name))
+	}
+	if info.New == nil {
+		panic(fmt.Errorf("driver %q has no New function", info.Name))
+	}
+	if _, ok := drivers[info.Name]; ok {
+		panic(fmt.Errorf("driver %q is already registered", info.Name))
+	}
+	drivers[info.Name] = info
+}
+
+// LookupDriver returns the registered driver.
+func LookupDriver(name Driver) (DriverInfo, bool) {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	info, ok := drivers[name]
+	return info, ok
+}
+
+// Drivers returns the sorted names of the registered drivers.
+func Drivers() []Driver {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	var names []Driver
+	for name := range drivers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// ParseDriver splits "NAME[:ARG]" into NAME and ARG.
+func ParseDriver(s Driver) (Driver, string) {
+	name, arg, _ := strings.Cut(s, ":")
+	return name, arg
+}
+
+func init() {
+	RegisterDriver(DriverInfo{
+		Name:             DriverBuiltin,
+		New:              newBuiltinDriver,
+		SupportsReadonly: true,
+		SupportsFS:       true,
+		SupportsAudit:    true,
+	})
+	RegisterDriver(DriverInfo{
+		Name:                  DriverOpensshSftpServer,
+		New:                   newOpensshSftpServerDriver,
+		SupportsReadonly:      true,
+		SupportsAudit:         true,
+		SupportsSandbox:       true,
+		SupportsRequestFilter: true,
+	})
+	RegisterDriver(DriverInfo{
+		Name:            DriverExec,
+		New:             newExecDriver,
+		SupportsSandbox: true,
+	})
+}
+
+// builtinDriver serves DriverConfig.FS with package sftpserver.
+type builtinDriver struct {
+	cfg DriverConfig
+}
+
+func newBuiltinDriver(cfg DriverConfig) (SFTPDriver, error) {
+	if cfg.FS == nil {
+		return nil, errors.New("got nil FS")
+	}
+	if _, ok := cfg.FS.(vfs.WritableFS); !ok && !cfg.Readonly {
+		return nil, errors.New("FS does not implement vfs.WritableFS, Readonly has to be set")
+	}
+	return &builtinDriver{cfg: cfg}, nil
+}
+
+func (d *builtinDriver) Root() string {
+	return "/"
+}
+
+func (d *builtinDriver) Start(stdio io.ReadWriteCloser) error {
+	server := sftp.NewRequestServer(stdio, sftpserver.NewHandlersWithOptions(d.cfg.FS, sftpserver.Options{
+		Readonly: d.cfg.Readonly,
+		Audit:    d.cfg.Audit,
+		UID:      d.cfg.UID,
+		GID:      d.cfg.GID,
+		Umask:    d.cfg.Umask,
+	}))
+	go func() {
+		if srvErr := server.Serve(); srvErr != nil {
+			if errors.Is(srvErr, io.EOF) {
+				logrus.WithError(srvErr).Debugf("sftp server for %v exited with EOF (negligible)", d.cfg.LocalPath)
+			} else {
+				logrus.WithError(srvErr).Errorf("sftp server for %v exited", d.cfg.LocalPath)
+			}
+		}
+	}()
+	return nil
+}
+
+func (d *builtinDriver) Close() error {
+	// The server exits when stdio is closed by ssh
+	return nil
+}
+
+// cmdDriver executes an SFTP server command on stdio.
+type cmdDriver struct {
+	cmd     *exec.Cmd
+	root    string
+	sandbox []sandbox.Rule // nil unless DriverConfig.Sandbox is set
+}
+
+// newCmdDriver creates cmdDriver. The sandbox rules are created from cfg.
+func newCmdDriver(cmd *exec.Cmd, root string, cfg DriverConfig) *cmdDriver {
+	d := &cmdDriver{cmd: cmd, root: root}
+	if cfg.Sandbox {
+		d.sandbox = []sandbox.Rule{{Path: cfg.LocalPath, Write: !cfg.Readonly}}
+		if len(cfg.ServedPaths) > 0 {
+			d.sandbox = nil
+			for _, p := range cfg.ServedPaths {
+				d.sandbox = append(d.sandbox, sandbox.Rule{Path: p, Write: !cfg.Readonly})
+			}
+		}
+		// The shared libraries, and the system configuration such as /etc/passwd for the names of the file owners
+		for _, dir := range []string{"/usr", "/lib", "/lib32", "/lib64", "/bin", "/sbin"} {
+			d.sandbox = append(d.sandbox, sandbox.Rule{Path: dir, Exec: true})
+		}
+		d.sandbox = append(d.sandbox, sandbox.Rule{Path: "/etc"})
+		// The command may be installed in a non-system directory, such as /home/linuxbrew
+		if exe, err := filepath.EvalSymlinks(cmd.Path); err == nil {
+			d.sandbox = append(d.sandbox, sandbox.Rule{Path: filepath.Dir(exe), Exec: true})
+		}
+	}
+	return d
+}
+
+func (d *cmdDriver) Root() string {
+	return d.root
+}
+
+func (d *cmdDriver) Start(stdio io.ReadWriteCloser) error {
+	d.cmd.Stdin, d.cmd.Stdout = stdio, stdio
+	// Pass the file descriptors directly when the streams are not wrapped, to avoid copying them in this process
+	if rwc, ok := stdio.(*util.RWC); ok {
+		d.cmd.Stdin, d.cmd.Stdout = rwc.ReadCloser, rwc.WriteCloser
+	}
+	logrus.Debugf("executing SFTP server: %s %v", d.cmd.Path, d.cmd.Args)
+	if d.sandbox != nil {
+		err := sandbox.Start(d.cmd, d.sandbox)
+		if !errors.Is(err, sandbox.ErrUnsupported) {
+			return err
+		}
+		logrus.WithError(err).Warnf("Executing SFTP server %q without the sandbox; the server can access any file of the current user", d.cmd.Path)
+	}
+	return d.cmd.Start()
+}
+
+func (d *cmdDriver) Close() error {
+	if d.cmd.Process == nil {
+		return nil
+	}
+	return d.cmd.Process.Kill()
+}
+
+// newOpensshSftpServerDriver executes OpenSSH sftp-server.
+// DriverConfig.Arg is the path of sftp-server, detected automatically when empty.
+func newOpensshSftpServerDriver(cfg DriverConfig) (SFTPDriver, error) {
+	var (
+		server *OpensshSftpServer
+		err    error
+	)
+	if cfg.Arg == "" {
+		server, err = DetectOpensshSftpServer()
+	} else {
+		server, err = ProbeOpensshSftpServer(cfg.Arg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debugf("Using OpenSSH SFTP Server %q (%s, flags %q)", server.Path, server.Version, server.Flags)
+	sftpServerArgs := []string{
+		// `-e` available since OpenSSH 5.4p1 (2010) https://github.com/openssh/openssh-portable/commit/7bee06ab
+		"-e",
+		// `-d` available since OpenSSH 6.2p1 (2013) https://github.com/openssh/openssh-portable/commit/502ab0ef
+		// NOTE: `-d` just chdirs the sftp server process to the specified directory.
+		// This is expected to be used in conjunction with chroot (in future), however, macOS does not support unprivileged chroot.
+		// On Linux, DriverConfig.Sandbox confines the access to LocalPath with Landlock instead.
+		"-d", strings.ReplaceAll(cfg.LocalPath, "%", "%%"),
+	}
+	if cfg.Readonly {
+		// `-R` available since OpenSSH 5.4p1 (2010) https://github.com/openssh/openssh-portable/commit/db7bf825
+		sftpServerArgs = append(sftpServerArgs, "-R")
+	}
+	if cfg.Audit != nil {
+		// `-l` available since OpenSSH 4.4p1 (2006)
+		sftpServerArgs = append(sftpServerArgs, "-l", audit.OpensshLogLevel)
+	}
+	var umask string
+	if cfg.Umask != 0 {
+		umask = fmt.Sprintf("%03o", cfg.Umask)
+	}
+	requestArgs, err := opensshSftpServerRequestArgs(server, cfg.DeniedRequests, cfg.AllowedRequests, umask)
+	if err != nil {
+		return nil, err
+	}
+	sftpServerArgs = append(sftpServerArgs, requestArgs...)
+	cmd := exec.Command(server.Path, sftpServerArgs...)
+	cmd.Stderr = os.Stderr
+	if cfg.Audit != nil {
+		cmd.Stderr = audit.NewOpensshLogWriter(cfg.Audit, cfg.LocalPath, os.Stderr)
+	}
+	// sftp-server serves the whole filesystem, unless sandboxed
+	return newCmdDriver(cmd, cfg.LocalPath, cfg), nil
+}
+
+// newExecDriver executes DriverConfig.Arg in LocalPath.
+// The SFTP session is expected to start in the working directory, which is mounted by sshfs as ".".
+func newExecDriver(cfg DriverConfig) (SFTPDriver, error) {
+	args := strings.Fields(cfg.Arg)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("driver %q needs a command, e.g., \"exec:/path/to/cmd args\"", DriverExec)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = cfg.LocalPath
+	cmd.Stderr = os.Stderr
+	return newCmdDriver(cmd, ".", cfg), nil
+}
@@ -0,0 +1,87 @@
+package reversesshfs
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/lima-vm/sshocker/pkg/util"
+)
+
+func TestParseDriver(t *testing.T) {
+	testCases := map[Driver][2]string{
+		"builtin": {"builtin", ""},
+		"openssh-sftp-server:/usr/lib/ssh/sftp-server": {"openssh-sftp-server", "/usr/lib/ssh/sftp-server"},
+		"exec:rclone serve sftp --stdio .":             {"exec", "rclone serve sftp --stdio ."},
+	}
+	for s, expected := range testCases {
+		name, arg := ParseDriver(s)
+		if name != expected[0] || arg != expected[1] {
+			t.Errorf("%q: expected %v, got [%q %q]", s, expected, name, arg)
+		}
+	}
+}
+
+func TestRegisterDriver(t *testing.T) {
+	if expected := []Driver{DriverBuiltin, DriverExec, DriverOpensshSftpServer}; !reflect.DeepEqual(Drivers(), expected) {
+		t.Errorf("expected %v, got %v", expected, Drivers())
+	}
+	for _, name := range []Driver{"", DriverAuto, "foo:bar", DriverBuiltin} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%q: expected a panic", name)
+				}
+			}()
+			RegisterDriver(DriverInfo{Name: name, New: newExecDriver})
+		}()
+	}
+}
+
+func TestExecDriver(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs cat")
+	}
+	info, ok := LookupDriver(DriverExec)
+	if !ok {
+		t.Fatal("exec driver is not registered")
+	}
+	if _, err := info.New(DriverConfig{LocalPath: t.TempDir()}); err == nil {
+		t.Error("expected an error for the missing command")
+	}
+	d, err := info.New(DriverConfig{LocalPath: t.TempDir(), Arg: "cat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Root() != "." {
+		t.Errorf("expected %q, got %q", ".", d.Root())
+	}
+	// cat echoes the "requests" back as the "responses"
+	requestsReader, requestsWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	responsesReader, responsesWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(&util.RWC{ReadCloser: requestsReader, WriteCloser: responsesWriter}); err != nil {
+		t.Fatal(err)
+	}
+	_ = requestsReader.Close()
+	_ = responsesWriter.Close()
+	if _, err := requestsWriter.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = requestsWriter.Close()
+	b, err := io.ReadAll(responsesReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("expected %q, got %q", "hello", string(b))
+	}
+	_ = d.Close()
+}
@@ -0,0 +1,234 @@
+package reversesshfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// OpensshSftpServer is an OpenSSH sftp-server binary probed by ProbeOpensshSftpServer.
+type OpensshSftpServer struct {
+	Path    string // Absolute path of the binary
+	Version string // e.g., "OpenSSH_9.6p1". Informative only, empty if unknown
+	Flags   string // Flags listed in the usage, e.g., "ehRdflPpu"
+}
+
+// Supports returns true if the flag (e.g., 'P') is listed in the usage of sftp-server.
+func (s *OpensshSftpServer) Supports(flag rune) bool {
+	return strings.ContainsRune(s.Flags, flag)
+}
+
+// String returns the quoted path, followed by the version if known.
+func (s *OpensshSftpServer) String() string {
+	if s.Version == "" {
+		return strconv.Quote(s.Path)
+	}
+	return fmt.Sprintf("%q (%s)", s.Path, s.Version)
+}
+
+var (
+	// opensshSftpServerUsageFlagRegexp matches "[-ehR]" and "[-d start_directory]" in the usage of sftp-server.
+	opensshSftpServerUsageFlagRegexp = regexp.MustCompile(`\[-([A-Za-z]+)[\] ]`)
+	// opensshVersionRegexp matches "OpenSSH_9.6p1" in binaries and in `ssh -V`.
+	opensshVersionRegexp = regexp.MustCompile(`OpenSSH_[0-9][0-9A-Za-z.]*`)
+)
+
+// ProbeOpensshSftpServer executes binary to see whether it is a usable OpenSSH sftp-server.
+// `-e` (OpenSSH 5.4p1) and `-d` (OpenSSH 6.2p1) are required.
+func ProbeOpensshSftpServer(binary string) (*OpensshSftpServer, error) {
+	exe, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, err
+	}
+	// sftp-server prints the usage for `-h` and exits with status 1
+	out, _ := exec.Command(exe, "-h").CombinedOutput()
+	logrus.Debugf("usage of %q: %q", exe, string(out))
+	if !bytes.Contains(out, []byte("usage:")) {
+		return nil, fmt.Errorf("%q does not seem to be OpenSSH sftp-server: %q", exe, string(bytes.TrimSpace(out)))
+	}
+	var flags strings.Builder
+	for _, m := range opensshSftpServerUsageFlagRegexp.FindAllSubmatch(out, -1) {
+		flags.Write(m[1])
+	}
+	server := &OpensshSftpServer{
+		Path:    exe,
+		Version: probeOpensshVersion(exe),
+		Flags:   flags.String(),
+	}
+	for _, f := range []rune{'e', 'd'} {
+		if !server.Supports(f) {
+			return nil, fmt.Errorf("%s does not support `-%c`, needs OpenSSH 6.2p1 or later", server, f)
+		}
+	}
+	return server, nil
+}
+
+// probeOpensshVersion returns the OpenSSH version string embedded in exe,
+// or printed by `ssh -V` of the same installation (e.g., "/usr/bin/ssh" for "/usr/lib/openssh/sftp-server").
+// sftp-server itself has no flag to print the version.
+func probeOpensshVersion(exe string) string {
+	if f, err := os.Open(exe); err == nil {
+		b, _ := io.ReadAll(io.LimitReader(f, 16<<20))
+		_ = f.Close()
+		if v := opensshVersionRegexp.Find(b); v != nil {
+			return string(v)
+		}
+	}
+	dir := filepath.Dir(exe)
+	for range 3 {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+		ssh := filepath.Join(dir, "bin", "ssh")
+		if runtime.GOOS == "windows" {
+			ssh += ".exe"
+		}
+		if _, err := os.Stat(ssh); err != nil {
+			continue
+		}
+		// `ssh -V` prints the version to stderr
+		out, _ := exec.Command(ssh, "-V").CombinedOutput()
+		if v := opensshVersionRegexp.Find(out); v != nil {
+			return string(v)
+		}
+	}
+	return ""
+}
+
+// opensshSftpServerCandidates returns the paths of sftp-server to be probed by DetectOpensshSftpServer.
+func opensshSftpServerCandidates() []string {
+	var res []string
+	if exe, err := exec.LookPath("sftp-server"); err == nil {
+		res = append(res, exe)
+	}
+	homebrewSSHD := []string{
+		"/usr/local/sbin/sshd",
+		"/opt/homebrew/sbin/sshd",
+	}
+	for _, f := range homebrewSSHD {
+		// sshd is like "/usr/local/Cellar/openssh/8.9p1/sbin/sshd"
+		sshd, err := filepath.EvalSymlinks(f)
+		if err != nil {
+			continue
+		}
+		// local is like "/usr/local/Cellar/openssh"
+		local := filepath.Dir(filepath.Dir(sshd))
+		// sftpServer is like "/usr/local/Cellar/openssh/8.9p1/libexec/sftp-server"
+		sftpServer := filepath.Join(local, "libexec", "sftp-server")
+		if exe, err := exec.LookPath(sftpServer); err == nil {
+			res = append(res, exe)
+		}
+	}
+	if runtime.GOOS == "windows" {
+		// unix path is like "/usr/lib/ssh/sftp-server"
+		cygpathCmd := exec.Command("cygpath", "-w", "/usr/lib/ssh/sftp-server")
+		// windows path is like `C:\msys64\usr\lib\ssh\sftp-server.exe`
+		if out, err := cygpathCmd.Output(); err == nil {
+			sftpServer := strings.TrimSpace(string(out))
+			if exe, err := exec.LookPath(sftpServer); err == nil {
+				res = append(res, exe)
+			}
+		}
+	}
+	candidates := []string{
+		"/usr/libexec/sftp-server",         // macOS, OpenWrt
+		"/usr/libexec/openssh/sftp-server", // Fedora
+		"/usr/lib/sftp-server",             // Debian (symlink to openssh/sftp-server)
+		"/usr/lib/openssh/sftp-server",     // Debian
+		"/usr/lib/ssh/sftp-server",         // Alpine
+	}
+	for _, cand := range candidates {
+		if exe, err := exec.LookPath(cand); err == nil {
+			res = append(res, exe)
+		}
+	}
+	return slices.Compact(res)
+}
+
+// DetectOpensshSftpServer returns the first usable sftp-server found in $PATH and the well-known locations.
+// The error explains why each of the candidates is unusable.
+func DetectOpensshSftpServer() (*OpensshSftpServer, error) {
+	candidates := opensshSftpServerCandidates()
+	if len(candidates) == 0 {
+		return nil, errors.New("sftp-server was not found in $PATH and the well-known locations")
+	}
+	var reasons []string
+	for _, cand := range candidates {
+		server, err := ProbeOpensshSftpServer(cand)
+		if err != nil {
+			logrus.Debugf("Skipping %q: %v", cand, err)
+			reasons = append(reasons, err.Error())
+			continue
+		}
+		return server, nil
+	}
+	return nil, fmt.Errorf("no usable sftp-server was found: %s", strings.Join(reasons, "; "))
+}
+
+// DetectOpensshSftpServerBinary returns the path of the first usable sftp-server, or an empty string.
+//
+// Deprecated: use DetectOpensshSftpServer.
+func DetectOpensshSftpServerBinary() string {
+	server, err := DetectOpensshSftpServer()
+	if err != nil {
+		return ""
+	}
+	return server.Path
+}
+
+// probeOpensshSftpServerRequests returns the SFTP requests supported by sftp-server, for `-P` and `-p`.
+func probeOpensshSftpServerRequests(binary string) ([]string, error) {
+	out, err := exec.Command(binary, "-Q", "requests").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the supported requests with `%s -Q requests`: %w", binary, err)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// opensshSftpServerRequestArgs returns the arguments of sftp-server for denied, allowed, and umask,
+// after validating them against the flags and the requests supported by server.
+func opensshSftpServerRequestArgs(server *OpensshSftpServer, denied, allowed []string, umask string) ([]string, error) {
+	var args []string
+	if len(denied) > 0 || len(allowed) > 0 {
+		if !server.Supports('P') || !server.Supports('p') {
+			return nil, fmt.Errorf("%s does not support denying and allowing requests (`-P` and `-p`), needs OpenSSH 6.5 or later", server)
+		}
+		supported, err := probeOpensshSftpServerRequests(server.Path)
+		if err != nil {
+			return nil, err
+		}
+		for _, req := range append(slices.Clone(denied), allowed...) {
+			if !slices.Contains(supported, req) {
+				return nil, fmt.Errorf("request %q is not supported by %q, should be one of %v", req, server.Path, supported)
+			}
+		}
+		if len(denied) > 0 {
+			args = append(args, "-P", strings.Join(denied, ","))
+		}
+		if len(allowed) > 0 {
+			args = append(args, "-p", strings.Join(allowed, ","))
+		}
+	}
+	if umask != "" {
+		// The umask is still applied by sshfs, so an old sftp-server is not an error
+		if server.Supports('u') {
+			args = append(args, "-u", umask)
+		} else {
+			logrus.Warnf("%q does not support forcing the umask (`-u`), the umask is applied only by sshfs", server.Path)
+		}
+	}
+	return args, nil
+}
@@ -0,0 +1,100 @@
+package reversesshfs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// writeFakeSftpServer writes a shell script that prints usage like sftp-server.
+func writeFakeSftpServer(t *testing.T, usage string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	binary := filepath.Join(t.TempDir(), "sftp-server")
+	script := `#!/bin/sh
+if [ "$1" = "-Q" ]; then
+	printf 'open\nclose\nremove\nrmdir\nrename\n'
+	exit 0
+fi
+printf '%s\n' '` + usage + `' >&2
+exit 1
+`
+	if err := os.WriteFile(binary, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return binary
+}
+
+func TestOpensshSftpServerRequestArgs(t *testing.T) {
+	binary := writeFakeSftpServer(t, "usage: sftp-server [-ehR] [-d start_directory] [-f log_facility] [-l log_level] [-P denied_requests] [-p allowed_requests] [-u umask]")
+	server, err := ProbeOpensshSftpServer(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "ehRdflPpu"; server.Flags != expected {
+		t.Errorf("expected %q, got %q", expected, server.Flags)
+	}
+
+	args, err := opensshSftpServerRequestArgs(server, []string{"remove", "rmdir"}, []string{"open"}, "022")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"-P", "remove,rmdir", "-p", "open", "-u", "022"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+
+	if _, err := opensshSftpServerRequestArgs(server, []string{"unlink"}, nil, ""); err == nil {
+		t.Error("expected an error for the unsupported request")
+	}
+
+	args, err = opensshSftpServerRequestArgs(server, nil, nil, "")
+	if err != nil || args != nil {
+		t.Errorf("expected no args, got %v (%v)", args, err)
+	}
+}
+
+func TestOpensshSftpServerRequestArgsOld(t *testing.T) {
+	// OpenSSH 6.2p1
+	binary := writeFakeSftpServer(t, "usage: sftp-server [-ehR] [-d start_directory] [-f log_facility] [-l log_level]")
+	server, err := ProbeOpensshSftpServer(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := opensshSftpServerRequestArgs(server, []string{"remove"}, nil, ""); err == nil {
+		t.Error("expected an error for sftp-server without -P")
+	}
+	// The umask is still applied by sshfs
+	args, err := opensshSftpServerRequestArgs(server, nil, nil, "022")
+	if err != nil || len(args) != 0 {
+		t.Errorf("expected no args, got %v (%v)", args, err)
+	}
+}
+
+func TestProbeOpensshSftpServer(t *testing.T) {
+	// OpenSSH 5.9p1 lacks -d
+	binary := writeFakeSftpServer(t, "usage: sftp-server [-ehR] [-f log_facility] [-l log_level] OpenSSH_5.9p1")
+	if _, err := ProbeOpensshSftpServer(binary); err == nil || !strings.Contains(err.Error(), "-d") {
+		t.Errorf("expected an error for sftp-server without -d, got %v", err)
+	}
+	if _, err := ProbeOpensshSftpServer("true"); err == nil {
+		t.Error("expected an error for a binary that is not sftp-server")
+	}
+
+	binary = writeFakeSftpServer(t, "usage: sftp-server [-ehR] [-d start_directory] OpenSSH_9.6p1")
+	server, err := ProbeOpensshSftpServer(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The version is found in the script itself
+	if expected := "OpenSSH_9.6p1"; server.Version != expected {
+		t.Errorf("expected %q, got %q", expected, server.Version)
+	}
+	if !server.Supports('R') || server.Supports('P') {
+		t.Errorf("unexpected flags %q", server.Flags)
+	}
+}
@@ -0,0 +1,92 @@
+package reversesshfs
+
+import (
+	"slices"
+	"strings"
+)
+
+// Preset is a named set of sshfs and ssh options for a workload.
+// The options of a preset are layered under the explicit options, i.e., prepended to ReverseSSHFS.SSHFSAdditionalArgs.
+type Preset struct {
+	Name         string
+	Description  string
+	SSHFSOptions []string // sshfs `-o` options, e.g., "cache=no"
+	SSHOptions   []string // ssh `-o` options of the sshfs session, e.g., "Compression=yes". See ReverseSSHFS.SSHAdditionalArgs.
+}
+
+// presetCiphers prefers the cipher accelerated by AES-NI and ARMv8 Crypto Extensions.
+// Both ciphers are enabled by default since OpenSSH 6.7.
+const presetCiphers = "aes128-gcm@openssh.com,chacha20-poly1305@openssh.com"
+
+var presets = []Preset{
+	{
+		Name:         "source-code",
+		Description:  "Many small files edited locally and read repeatedly on the remote, e.g., by compilers and language servers",
+		SSHFSOptions: []string{"cache=yes", "auto_cache"},
+		SSHOptions:   []string{"Compression=yes"},
+	},
+	{
+		Name:         "build-output",
+		Description:  "Large files written and read mostly on the remote, e.g., object files and archives",
+		SSHFSOptions: []string{"cache=yes", "kernel_cache", "max_read=65536"},
+		SSHOptions:   []string{"Compression=no", "Ciphers=" + presetCiphers},
+	},
+	{
+		Name:         "media",
+		Description:  "Large incompressible files read sequentially, e.g., images, videos, and datasets",
+		SSHFSOptions: []string{"kernel_cache", "max_read=65536"},
+		SSHOptions:   []string{"Compression=no", "Ciphers=" + presetCiphers},
+	},
+	{
+		Name:         "strict-consistency",
+		Description:  "Files modified on both hosts, where the remote must see the local changes immediately",
+		SSHFSOptions: []string{"cache=no", "attr_timeout=0", "entry_timeout=0", "negative_timeout=0"},
+	},
+}
+
+// Presets returns the presets sorted by name.
+func Presets() []Preset {
+	res := slices.Clone(presets)
+	slices.SortFunc(res, func(a, b Preset) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return res
+}
+
+// PresetNames returns the sorted names of the presets.
+func PresetNames() []string {
+	var names []string
+	for _, p := range Presets() {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// LookupPreset returns the preset.
+func LookupPreset(name string) (Preset, bool) {
+	i := slices.IndexFunc(presets, func(p Preset) bool {
+		return p.Name == name
+	})
+	if i < 0 {
+		return Preset{}, false
+	}
+	return presets[i], true
+}
+
+// SSHFSArgs returns the sshfs arguments, e.g., []string{"-o", "cache=no"}.
+func (p Preset) SSHFSArgs() []string {
+	return optionArgs(p.SSHFSOptions)
+}
+
+// SSHArgs returns the ssh arguments, e.g., []string{"-o", "Compression=yes"}.
+func (p Preset) SSHArgs() []string {
+	return optionArgs(p.SSHOptions)
+}
+
+func optionArgs(opts []string) []string {
+	var args []string
+	for _, o := range opts {
+		args = append(args, "-o", o)
+	}
+	return args
+}
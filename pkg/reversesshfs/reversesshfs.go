@@ -5,18 +5,25 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
-	"io"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
+	"github.com/lima-vm/sshocker/pkg/audit"
+	"github.com/lima-vm/sshocker/pkg/events"
+	"github.com/lima-vm/sshocker/pkg/metrics"
+	"github.com/lima-vm/sshocker/pkg/pathfilter"
+	"github.com/lima-vm/sshocker/pkg/ratelimit"
 	"github.com/lima-vm/sshocker/pkg/ssh"
 	"github.com/lima-vm/sshocker/pkg/util"
-	"github.com/pkg/sftp"
+	"github.com/lima-vm/sshocker/pkg/vfs"
 	"github.com/sirupsen/logrus"
 )
 
@@ -30,219 +37,736 @@ const (
 
 type ReverseSSHFS struct {
 	*ssh.SSHConfig
-	Driver                  Driver
+	Driver                  Driver // "NAME[:ARG]" of a registered driver, or DriverAuto. See RegisterDriver.
 	OpensshSftpServerBinary string // used only when Driver == DriverOpensshSftpServer
-	LocalPath               string
+	LocalPath               string // Ignored when FS or Submounts is set. See Prepare for a regular file.
+	FS                      fs.FS  // Optional. Served by the builtin driver instead of LocalPath. Has to implement vfs.WritableFS unless Readonly.
 	Host                    string
 	Port                    int
 	RemotePath              string
 	Readonly                bool
+	Include                 []string       // Optional. gitignore-style patterns of the files to be served. Requires the builtin driver.
+	Exclude                 []string       // Optional. gitignore-style patterns of the paths to be hidden. Requires the builtin driver.
+	Gitignore               bool           // Hide the paths ignored by the .gitignore files. Requires the builtin driver.
+	AuditLog                string         // Optional. Path of the audit log file in the JSON Lines format.
+	AuditLogMaxSize         int64          // Rotate AuditLog when its size exceeds AuditLogMaxSize bytes. 0 disables the rotation.
+	AuditLogMaxBackups      int            // Number of the rotated AuditLog files to be kept. 0 means audit.DefaultMaxBackups.
+	Metrics                 *metrics.Mount // Optional. Collects the metrics of the SFTP stream.
+	UIDMap                  string         // Optional. "user" (sshfs `idmap=user`), or the remote UID to own the files (sshfs `uid=`).
+	GIDMap                  string         // Optional. The remote GID to own the files (sshfs `gid=`).
+	Umask                   string         // Optional. Octal umask applied to the file modes (sshfs `umask=`), e.g., "022".
+	Squash                  bool           // Make the files owned by the remote user. Cannot be combined with UIDMap and GIDMap.
+	AllowOther              bool           // Allow the other remote users to access the mount (sshfs `allow_other`). See Prepare.
+	RemoteSudo              bool           // Execute sshfs as root via `sudo -n`. Implies AllowOther. See Prepare.
+	DeniedRequests          []string       // Optional. SFTP requests denied by the server, e.g., "remove". Requires the openssh-sftp-server driver.
+	AllowedRequests         []string       // Optional. SFTP requests allowed by the server. Requires the openssh-sftp-server driver.
+	ReadLimit               int64          // Optional. Max bytes per second of the SFTP stream from LocalPath to RemotePath.
+	WriteLimit              int64          // Optional. Max bytes per second of the SFTP stream from RemotePath to LocalPath.
+	KeepMountpoint          bool           // Do not remove the directories created by Prepare on Close.
+	Sandbox                 bool           // Confine the SFTP server process to LocalPath. See package sandbox.
+	Submounts               []Submount     // Optional. Multiplex the local directories into the session instead of LocalPath. See Prepare.
+	Transport               Transport      // Optional. TransportStdio (default) or TransportDirect.
+	auditLogger             *audit.Logger
+	singleFile              bool     // LocalPath is a regular file
+	createdDirs             []string // Created by Prepare, from the shallowest
 	sshCmd                  *exec.Cmd
-	opensshSftpServerCmd    *exec.Cmd
+	driver                  SFTPDriver
+	direct                  *direct     // Set for TransportDirect
+	rootFS                  *vfs.RootFS // Opened for the filter on LocalPath
 	SSHFSAdditionalArgs     []string
+	SSHAdditionalArgs       []string       // Optional. ssh arguments of the sshfs session, e.g., "-o", "Compression=yes". Ignored when the master is used (SSHConfig.Persist or ControlPath).
+	EventHandler            events.Handler // Optional. Receives events.TypeMountClosed.
+	closing                 atomic.Bool
+	watcherDone             chan struct{} // Closed by watchSSHCmd after emitting events.TypeMountClosed
 }
 
+// Submount is a local directory multiplexed into the session of ReverseSSHFS.
+type Submount struct {
+	LocalPath  string
+	RemotePath string // Created as a symbolic link into ReverseSSHFS.RemotePath
+}
+
+// Prepare creates RemotePath (remote) as the mount point.
+// The directories created by Prepare are removed on Close, unless KeepMountpoint is set.
+//
+// When LocalPath is a regular file, the builtin driver serves only the file,
+// and the file is mounted in a hidden directory next to RemotePath, e.g., "/root/.kube/.config.sshocker".
+// RemotePath is created as a symbolic link to the file in the hidden directory.
+// Writes to RemotePath are written through to LocalPath (only writing and truncating are allowed), however, replacing RemotePath
+// (e.g., by renaming another file onto it) on the remote just replaces the symbolic link,
+// and the change is not propagated to LocalPath.
+// Prepare fails if RemotePath already exists and is not the symbolic link created by sshocker.
+//
+// When Submounts is set, the common ancestor of their local paths is served in a single session,
+// which is mounted on RemotePath (typically a hidden directory).
+// The builtin driver (chosen by DriverAuto) serves only the submounts.
+// The other drivers serve the whole common ancestor, so they require Sandbox to confine it to the submounts.
+// The RemotePath of each Submount is created as a symbolic link to the directory in RemotePath,
+// in the same way as a regular file.
+//
+// When AllowOther or RemoteSudo is set, Prepare verifies the privilege on the remote host first:
+// AllowOther needs `user_allow_other` in /etc/fuse.conf (Linux), and RemoteSudo needs `sudo -n` (NOPASSWD).
+// The files are owned by the remote user as in Squash, unless UIDMap or GIDMap is set,
+// and the permissions are checked against the reported modes (sshfs `default_permissions`).
 func (rsf *ReverseSSHFS) Prepare() error {
-	sshBinary := rsf.SSHConfig.Binary()
-	sshArgs := rsf.SSHConfig.Args()
 	if !path.IsAbs(rsf.RemotePath) {
 		return fmt.Errorf("unexpected relative path: %q", rsf.RemotePath)
 	}
-	if rsf.Port != 0 {
-		sshArgs = append(sshArgs, "-p", strconv.Itoa(rsf.Port))
+	if rsf.allowOther() {
+		if err := rsf.preflight(); err != nil {
+			return err
+		}
 	}
-	sshArgs = append(sshArgs, rsf.Host, "--")
-	sshArgs = append(sshArgs, "mkdir", "-p", addQuotes(rsf.RemotePath))
-	sshCmd := exec.Command(sshBinary, sshArgs...)
-	logrus.Debugf("executing ssh for preparing sshfs: %s %v", sshCmd.Path, sshCmd.Args)
-	out, err := sshCmd.CombinedOutput()
+	rsf.singleFile = rsf.detectSingleFile()
+	links, err := rsf.links()
+	if err != nil {
+		return err
+	}
+	const scriptName = "prepare-mountpoint"
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\nset -eu\n")
+	if rsf.RemoteSudo {
+		// The stale mount is owned by root
+		b.WriteString("sudo='sudo -n'\n")
+	}
+	fmt.Fprintf(&b, staleMountScript, util.ShellQuote(rsf.mountpoint()))
+	// Same as `mkdir -p`, but prints the created directories
+	var dirs []string
+	for _, dir := range ancestors(rsf.mountpoint()) {
+		dirs = append(dirs, util.ShellQuote(dir))
+	}
+	for _, l := range links {
+		fmt.Fprintf(&b, `file=%s
+target=%s
+if [ -e "${file}" ] || [ -L "${file}" ]; then
+  if [ ! -L "${file}" ] || [ "$(readlink "${file}")" != "${target}" ]; then
+    echo >&2 "${file} already exists"
+    exit 1
+  fi
+fi
+`, util.ShellQuote(l.file), util.ShellQuote(l.target))
+		for _, dir := range ancestors(path.Dir(l.file)) {
+			if quoted := util.ShellQuote(dir); !slices.Contains(dirs, quoted) {
+				dirs = append(dirs, quoted)
+			}
+		}
+	}
+	fmt.Fprintf(&b, `for dir in %s; do
+  if [ ! -d "${dir}" ]; then
+    mkdir "${dir}"
+    echo "created:${dir}"
+  fi
+done
+`, strings.Join(dirs, " "))
+	for _, l := range links {
+		fmt.Fprintf(&b, "ln -sfn %s %s\n", util.ShellQuote(l.target), util.ShellQuote(l.file))
+	}
+	stdout, stderr, err := ssh.ExecuteScript(rsf.Host, rsf.Port, rsf.SSHConfig, b.String(), scriptName)
+	logrus.Debugf("executed script %q, stdout=%q, stderr=%q, err=%v", scriptName, stdout, stderr, err)
+	if err != nil {
+		return fmt.Errorf("failed to mkdir %q (remote): %q: %w", rsf.mountpoint(), stderr, err)
+	}
+	rsf.createdDirs = nil
+	for _, line := range strings.Split(stdout, "\n") {
+		if dir, ok := strings.CutPrefix(line, "created:"); ok {
+			rsf.createdDirs = append(rsf.createdDirs, dir)
+		} else if dir, ok := strings.CutPrefix(line, "unmounted:"); ok {
+			logrus.Warnf("Unmounted the stale sshfs on %q (remote), probably left by a crashed sshocker", dir)
+		}
+	}
+	return nil
+}
+
+// staleMountScript is the script snippet to detect an existing mount on the mountpoint, formatted with the quoted mountpoint.
+//
+// A stale sshfs mount left by a crashed sshocker is lazily unmounted.
+// sshocker's sshfs mounts are told apart from the foreign ones by their empty host names (":/" or ":LOCALPATH"),
+// as sshfs is executed in the slave mode, or by "127.0.0.1:" for TransportDirect. They are considered stale when the mountpoint is not accessible.
+//
+// The mount table entries look like ":/ on /mnt/foo type fuse.sshfs (rw,...)" on Linux,
+// and ":/ on /mnt/foo (macfuse, ...)" on macOS.
+const staleMountScript = `LANG=C
+LC_ALL=C
+export LANG LC_ALL
+mountpoint=%s
+# spaces in file names are encoded as '\040' in the mount table
+entry=$(mount | sed 's/\\040/ /g' | grep -F " on ${mountpoint} " | tail -n 1 || true)
+if [ -n "${entry}" ]; then
+  if ! echo "${entry}" | grep -Eqw "fuse.sshfs|osxfuse|macfuse" || { [ "${entry#:}" = "${entry}" ] && [ "${entry#127.0.0.1:}" = "${entry}" ]; }; then
+    echo >&2 "${mountpoint} is already mounted by a foreign filesystem: ${entry}"
+    exit 1
+  fi
+  if ls "${mountpoint}" >/dev/null 2>&1; then
+    echo >&2 "${mountpoint} is already mounted by another sshocker session: ${entry}"
+    exit 1
+  fi
+  ${sudo:-} fusermount -uz "${mountpoint}" 2>/dev/null || ${sudo:-} fusermount3 -uz "${mountpoint}" 2>/dev/null || ${sudo:-} umount -f "${mountpoint}"
+  echo "unmounted:${mountpoint}"
+fi
+`
+
+// fuseConf is the configuration file of FUSE on the remote host. Variable for testing.
+var fuseConf = "/etc/fuse.conf"
+
+// allowOther returns true if the mount has to be accessible by the other remote users.
+func (rsf *ReverseSSHFS) allowOther() bool {
+	return rsf.AllowOther || rsf.RemoteSudo
+}
+
+// preflightScript returns the script to verify the privilege needed for AllowOther and RemoteSudo.
+func (rsf *ReverseSSHFS) preflightScript() string {
+	var b strings.Builder
+	b.WriteString(`#!/bin/sh
+set -eu
+LANG=C
+LC_ALL=C
+export LANG LC_ALL
+`)
+	if rsf.RemoteSudo {
+		b.WriteString(`if ! sudo -n true 2>/dev/null; then
+  echo >&2 "sudo -n failed for user $(id -un): the remote sudo requires sudo without a password (NOPASSWD) for the user"
+  exit 1
+fi
+if ! sudo -n sh -c 'command -v sshfs' >/dev/null 2>&1; then
+  echo >&2 "sshfs is not found in the PATH of sudo, see secure_path in /etc/sudoers"
+  exit 1
+fi
+`)
+	} else {
+		// Root and non-Linux hosts (macFUSE) do not need user_allow_other
+		fmt.Fprintf(&b, `conf=%s
+if [ "$(id -u)" != 0 ] && [ "$(uname -s)" = Linux ] && ! grep -Eqs '^[[:space:]]*user_allow_other[[:space:]]*$' "${conf}"; then
+  echo >&2 "allow_other requires \"user_allow_other\" in ${conf}, e.g., run: echo user_allow_other | sudo tee -a ${conf}"
+  exit 1
+fi
+`, util.ShellQuote(fuseConf))
+	}
+	return b.String()
+}
+
+// preflight verifies the privilege needed for AllowOther and RemoteSudo.
+func (rsf *ReverseSSHFS) preflight() error {
+	const scriptName = "preflight"
+	stdout, stderr, err := ssh.ExecuteScript(rsf.Host, rsf.Port, rsf.SSHConfig, rsf.preflightScript(), scriptName)
+	logrus.Debugf("executed script %q, stdout=%q, stderr=%q, err=%v", scriptName, stdout, stderr, err)
+	if err != nil {
+		if msg := strings.TrimSpace(stderr); msg != "" {
+			return fmt.Errorf("cannot mount %q (remote) for the other users: %s", rsf.RemotePath, msg)
+		}
+		return fmt.Errorf("cannot mount %q (remote) for the other users: %w", rsf.RemotePath, err)
+	}
+	return nil
+}
+
+// ancestors returns the absolute path p and its ancestors except "/", from the shallowest.
+func ancestors(p string) []string {
+	var res []string
+	for p = path.Clean(p); p != "/"; p = path.Dir(p) {
+		res = append([]string{p}, res...)
+	}
+	return res
+}
+
+// cleanup removes the symbolic links created by Prepare for a single file and Submounts,
+// and the directories created by Prepare unless KeepMountpoint is set.
+// The directories are removed only when they are empty, after sshfs is unmounted.
+func (rsf *ReverseSSHFS) cleanup() error {
+	links, err := rsf.links()
+	if err != nil {
+		return err
+	}
+	removeDirs := !rsf.KeepMountpoint && len(rsf.createdDirs) > 0
+	if len(links) == 0 && !removeDirs {
+		return nil
+	}
+	const scriptName = "cleanup-mountpoint"
+	var b strings.Builder
+	b.WriteString(`#!/bin/sh
+set -eu
+LANG=C
+LC_ALL=C
+export LANG LC_ALL
+`)
+	for _, l := range links {
+		fmt.Fprintf(&b, `file=%s
+target=%s
+if [ -L "${file}" ] && [ "$(readlink "${file}")" = "${target}" ]; then
+  rm -f "${file}"
+fi
+`, util.ShellQuote(l.file), util.ShellQuote(l.target))
+	}
+	if removeDirs {
+		var dirs []string
+		for i := len(rsf.createdDirs) - 1; i >= 0; i-- {
+			dirs = append(dirs, util.ShellQuote(rsf.createdDirs[i]))
+		}
+		fmt.Fprintf(&b, `mountpoint=%s
+i=0
+# spaces in file names are encoded as '\040' in the mount table
+while mount | sed 's/\\040/ /g' | grep -F "on ${mountpoint} " | grep -Eqw "fuse.sshfs|osxfuse"; do
+  if [ $i -ge 10 ]; then
+    echo >&2 "${mountpoint} is still mounted, not removing the directories"
+    exit 1
+  fi
+  sleep 1
+  i=$((i + 1))
+done
+# rmdir fails when the directory is not empty, and then its ancestors are not removed either
+for dir in %s; do
+  rmdir "${dir}" 2>/dev/null || :
+done
+`, util.ShellQuote(rsf.mountpoint()), strings.Join(dirs, " "))
+	}
+	stdout, stderr, err := ssh.ExecuteScript(rsf.Host, rsf.Port, rsf.SSHConfig, b.String(), scriptName)
+	logrus.Debugf("executed script %q, stdout=%q, stderr=%q, err=%v", scriptName, stdout, stderr, err)
 	if err != nil {
-		return fmt.Errorf("failed to mkdir %q (remote): %q: %w", rsf.RemotePath, string(out), err)
+		return fmt.Errorf("failed to clean up %q (remote): %q: %w", rsf.RemotePath, stderr, err)
 	}
 	return nil
 }
 
-func DetectOpensshSftpServerBinary() string {
-	if exe, err := exec.LookPath("sftp-server"); err == nil {
-		return exe
+// DetectDriver returns DriverOpensshSftpServer and the path of sftp-server when a usable sftp-server is found.
+// Otherwise it returns DriverBuiltin, and logs the reason.
+// An unusable explicitOpensshSftpServerBinary is an error.
+func DetectDriver(explicitOpensshSftpServerBinary string) (Driver, string, error) {
+	if explicitOpensshSftpServerBinary != "" {
+		server, err := ProbeOpensshSftpServer(explicitOpensshSftpServerBinary)
+		if err != nil {
+			return "", "", err
+		}
+		return DriverOpensshSftpServer, server.Path, nil
 	}
-	homebrewSSHD := []string{
-		"/usr/local/sbin/sshd",
-		"/opt/homebrew/sbin/sshd",
+	server, err := DetectOpensshSftpServer()
+	if err != nil {
+		logrus.Infof("Falling back to the %q driver: %v", DriverBuiltin, err)
+		return DriverBuiltin, "", nil
 	}
-	for _, f := range homebrewSSHD {
-		// sshd is like "/usr/local/Cellar/openssh/8.9p1/sbin/sshd"
-		sshd, err := filepath.EvalSymlinks(f)
+	return DriverOpensshSftpServer, server.Path, nil
+}
+
+// idmapping is the result of UIDMap, GIDMap, Umask, and Squash.
+type idmapping struct {
+	sshfsArgs []string
+	uid, gid  *uint32     // enforced by the builtin driver
+	umask     fs.FileMode // enforced by the builtin driver
+}
+
+func (rsf *ReverseSSHFS) idmapping() (*idmapping, error) {
+	var res idmapping
+	if rsf.Squash && (rsf.UIDMap != "" || rsf.GIDMap != "") {
+		return nil, errors.New("Squash cannot be combined with UIDMap and GIDMap")
+	}
+	if rsf.RemoteSudo && rsf.UIDMap == "user" {
+		return nil, errors.New("UIDMap \"user\" cannot be combined with RemoteSudo, as it maps the files to root")
+	}
+	// The other users see the files owned by the remote user by default
+	if rsf.Squash || (rsf.allowOther() && rsf.UIDMap == "" && rsf.GIDMap == "") {
+		uid, gid, err := rsf.remoteIDs()
 		if err != nil {
-			continue
+			return nil, err
 		}
-		// local is like "/usr/local/Cellar/openssh"
-		local := filepath.Dir(filepath.Dir(sshd))
-		// sftpServer is like "/usr/local/Cellar/openssh/8.9p1/libexec/sftp-server"
-		sftpServer := filepath.Join(local, "libexec", "sftp-server")
-		if exe, err := exec.LookPath(sftpServer); err == nil {
-			return exe
+		res.uid, res.gid = &uid, &gid
+	}
+	switch rsf.UIDMap {
+	case "":
+	case "user":
+		res.sshfsArgs = append(res.sshfsArgs, "-o", "idmap=user")
+	default:
+		uid, err := strconv.ParseUint(rsf.UIDMap, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UIDMap %q, should be \"user\" or a numeric UID", rsf.UIDMap)
 		}
+		res.uid = ptr(uint32(uid))
 	}
-	if runtime.GOOS == "windows" {
-		// unix path is like "/usr/lib/ssh/sftp-server"
-		cygpathCmd := exec.Command("cygpath", "-w", "/usr/lib/ssh/sftp-server")
-		// windows path is like `C:\msys64\usr\lib\ssh\sftp-server.exe`
-		if out, err := cygpathCmd.Output(); err == nil {
-			sftpServer := strings.TrimSpace(string(out))
-			if exe, err := exec.LookPath(sftpServer); err == nil {
-				return exe
-			}
+	if rsf.GIDMap != "" {
+		gid, err := strconv.ParseUint(rsf.GIDMap, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GIDMap %q, should be a numeric GID", rsf.GIDMap)
 		}
+		res.gid = ptr(uint32(gid))
 	}
-	candidates := []string{
-		"/usr/libexec/sftp-server",         // macOS, OpenWrt
-		"/usr/libexec/openssh/sftp-server", // Fedora
-		"/usr/lib/sftp-server",             // Debian (symlink to openssh/sftp-server)
-		"/usr/lib/openssh/sftp-server",     // Debian
-		"/usr/lib/ssh/sftp-server",         // Alpine
+	if res.uid != nil {
+		res.sshfsArgs = append(res.sshfsArgs, "-o", "uid="+strconv.FormatUint(uint64(*res.uid), 10))
 	}
-	for _, cand := range candidates {
-		if exe, err := exec.LookPath(cand); err == nil {
-			return exe
+	if res.gid != nil {
+		res.sshfsArgs = append(res.sshfsArgs, "-o", "gid="+strconv.FormatUint(uint64(*res.gid), 10))
+	}
+	if rsf.Umask != "" {
+		umask, err := strconv.ParseUint(rsf.Umask, 8, 32)
+		if err != nil || umask > 0o777 {
+			return nil, fmt.Errorf("invalid Umask %q, should be an octal number such as \"022\"", rsf.Umask)
 		}
+		res.umask = fs.FileMode(umask)
+		res.sshfsArgs = append(res.sshfsArgs, "-o", fmt.Sprintf("umask=%03o", umask))
 	}
-	return ""
+	return &res, nil
 }
 
-func DetectDriver(explicitOpensshSftpServerBinary string) (Driver, string, error) {
-	if explicitOpensshSftpServerBinary != "" {
-		exe, err := exec.LookPath(explicitOpensshSftpServerBinary)
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// remoteIDs returns the UID and the GID of the remote user.
+func (rsf *ReverseSSHFS) remoteIDs() (uint32, uint32, error) {
+	const scriptName = "remote-ids"
+	script := "#!/bin/sh\nset -eu\nid -u\nid -g\n"
+	stdout, stderr, err := ssh.ExecuteScript(rsf.Host, rsf.Port, rsf.SSHConfig, script, scriptName)
+	logrus.Debugf("executed script %q, stdout=%q, stderr=%q, err=%v", scriptName, stdout, stderr, err)
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(stdout)
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("unexpected output of script %q: %q", scriptName, stdout)
+	}
+	var ids [2]uint32
+	for i, f := range fields {
+		id, err := strconv.ParseUint(f, 10, 32)
 		if err != nil {
-			return "", "", err
+			return 0, 0, fmt.Errorf("unexpected output of script %q: %q: %w", scriptName, stdout, err)
 		}
-		return DriverOpensshSftpServer, exe, nil
+		ids[i] = uint32(id)
 	}
-	exe := DetectOpensshSftpServerBinary()
-	if exe != "" {
-		return DriverOpensshSftpServer, exe, nil
+	return ids[0], ids[1], nil
+}
+
+// detectSingleFile returns true if LocalPath is a regular file.
+func (rsf *ReverseSSHFS) detectSingleFile() bool {
+	if rsf.FS != nil {
+		return false
 	}
-	return DriverBuiltin, "", nil
+	fi, err := os.Stat(rsf.LocalPath)
+	return err == nil && fi.Mode().IsRegular()
 }
 
-func (rsf *ReverseSSHFS) Start() error {
-	sshBinary := rsf.SSHConfig.Binary()
-	sshArgs := rsf.SSHConfig.Args()
-	if !filepath.IsAbs(rsf.LocalPath) && !path.IsAbs(rsf.LocalPath) {
-		return fmt.Errorf("unexpected relative path: %q", rsf.LocalPath)
+// mountpoint returns the remote directory to be mounted by sshfs.
+func (rsf *ReverseSSHFS) mountpoint() string {
+	if rsf.singleFile {
+		return path.Join(path.Dir(rsf.RemotePath), "."+path.Base(rsf.RemotePath)+".sshocker")
 	}
-	if runtime.GOOS == "windows" && path.IsAbs(rsf.LocalPath) {
-		logrus.Infof("Accepting %q Unix path, assuming Cygwin/msys2 OpenSSH", rsf.LocalPath)
+	return rsf.RemotePath
+}
+
+// singleFileLinkTarget returns the target of the symbolic link RemotePath, relative to the parent of RemotePath.
+func (rsf *ReverseSSHFS) singleFileLinkTarget() string {
+	return path.Join(path.Base(rsf.mountpoint()), filepath.Base(rsf.LocalPath))
+}
+
+// singleFileFS returns the filesystem that contains only LocalPath.
+// Only reading, writing, and truncating the file are allowed, so that the remote cannot replace the file
+// with a symbolic link to another local file.
+func (rsf *ReverseSSHFS) singleFileFS() (fs.FS, error) {
+	// Resolve symbolic links such as "~/.npmrc -> dotfiles/npmrc", as they would point to the hidden paths
+	local, err := filepath.EvalSymlinks(rsf.LocalPath)
+	if err != nil {
+		return nil, err
 	}
-	if !path.IsAbs(rsf.RemotePath) {
-		return fmt.Errorf("unexpected relative path: %q", rsf.RemotePath)
+	return vfs.NewMultiFS(map[string]vfs.WritableFS{
+		// Served under the name of LocalPath, as the name in singleFileLinkTarget
+		filepath.Base(rsf.LocalPath): vfs.FileFS(local),
+	}), nil
+}
+
+// link is a symbolic link created by Prepare.
+type link struct {
+	file   string // The remote path of the symbolic link
+	target string
+}
+
+// links returns the symbolic links to be created by Prepare, for a single file and Submounts.
+func (rsf *ReverseSSHFS) links() ([]link, error) {
+	if rsf.singleFile {
+		return []link{{file: rsf.RemotePath, target: rsf.singleFileLinkTarget()}}, nil
 	}
-	if rsf.Port != 0 {
-		sshArgs = append(sshArgs, "-p", strconv.Itoa(rsf.Port))
+	if len(rsf.Submounts) == 0 {
+		return nil, nil
 	}
-	sshArgs = append(sshArgs, rsf.Host, "--")
-	sshArgs = append(sshArgs, "sshfs", addQuotes(":"+rsf.LocalPath), addQuotes(rsf.RemotePath), "-o", "slave")
-	if rsf.Readonly {
-		sshArgs = append(sshArgs, "-o", "ro")
+	_, names, err := rsf.submounts()
+	if err != nil {
+		return nil, err
 	}
-	sshArgs = append(sshArgs, rsf.SSHFSAdditionalArgs...)
-	rsf.sshCmd = exec.Command(sshBinary, sshArgs...)
-	rsf.sshCmd.Stderr = os.Stderr
-	driver := rsf.Driver
-	opensshSftpServerBinary := rsf.OpensshSftpServerBinary
-	switch driver {
-	case DriverBuiltin, DriverOpensshSftpServer:
-		// NOP
-	case "", DriverAuto:
-		var err error
-		driver, opensshSftpServerBinary, err = DetectDriver(opensshSftpServerBinary)
+	res := make([]link, len(rsf.Submounts))
+	for i, sub := range rsf.Submounts {
+		res[i] = link{file: sub.RemotePath, target: path.Join(rsf.RemotePath, names[i])}
+	}
+	return res, nil
+}
+
+// submounts returns the common ancestor of the local paths of Submounts,
+// and the slash-separated paths of Submounts relative to it, e.g., "/home/user" and ["src", "work/data"].
+func (rsf *ReverseSSHFS) submounts() (string, []string, error) {
+	var root string
+	for i, sub := range rsf.Submounts {
+		if !filepath.IsAbs(sub.LocalPath) {
+			return "", nil, fmt.Errorf("unexpected relative path: %q", sub.LocalPath)
+		}
+		if !path.IsAbs(sub.RemotePath) {
+			return "", nil, fmt.Errorf("unexpected relative path: %q", sub.RemotePath)
+		}
+		if sub.RemotePath == rsf.RemotePath || strings.HasPrefix(sub.RemotePath, rsf.RemotePath+"/") {
+			return "", nil, fmt.Errorf("%q must not be in the mountpoint %q", sub.RemotePath, rsf.RemotePath)
+		}
+		for _, other := range rsf.Submounts[:i] {
+			if other.RemotePath == sub.RemotePath || strings.HasPrefix(sub.RemotePath, other.RemotePath+"/") || strings.HasPrefix(other.RemotePath, sub.RemotePath+"/") {
+				return "", nil, fmt.Errorf("%q and %q must not be nested", other.RemotePath, sub.RemotePath)
+			}
+		}
+		local := filepath.Clean(sub.LocalPath)
+		if i == 0 {
+			root = local
+			continue
+		}
+		for {
+			if rel, err := filepath.Rel(root, local); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				break
+			}
+			parent := filepath.Dir(root)
+			if parent == root {
+				return "", nil, fmt.Errorf("%q and %q have no common ancestor", rsf.Submounts[0].LocalPath, sub.LocalPath)
+			}
+			root = parent
+		}
+	}
+	names := make([]string, len(rsf.Submounts))
+	for i, sub := range rsf.Submounts {
+		rel, err := filepath.Rel(root, filepath.Clean(sub.LocalPath))
 		if err != nil {
-			return fmt.Errorf("failed to choose driver automatically: %w", err)
+			return "", nil, err
 		}
-		logrus.Debugf("Chosen driver %q", driver)
-	default:
-		return fmt.Errorf("unknown driver %q", driver)
+		names[i] = filepath.ToSlash(rel)
 	}
-	var builtinSftpServer *sftp.Server
-	switch driver {
-	case DriverBuiltin:
-		stdinPipe, err := rsf.sshCmd.StdinPipe()
+	return root, names, nil
+}
+
+func (rsf *ReverseSSHFS) filtered() bool {
+	return len(rsf.Include) > 0 || len(rsf.Exclude) > 0 || rsf.Gitignore
+}
+
+// filterFS wraps fsys with vfs.NewFilterFS for Include, Exclude, and Gitignore.
+func (rsf *ReverseSSHFS) filterFS(fsys fs.FS) (fs.FS, error) {
+	include, err := pathfilter.New(rsf.Include)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the include patterns: %w", err)
+	}
+	var excludePatterns []string
+	if rsf.Gitignore {
+		excludePatterns, err = pathfilter.ReadGitignore(fsys)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("failed to read the .gitignore files: %w", err)
+		}
+		logrus.Debugf("Hiding %d patterns from the .gitignore files", len(excludePatterns))
+	}
+	// Exclude comes after the .gitignore patterns, so that it cannot be negated by the .gitignore files
+	excludePatterns = append(excludePatterns, rsf.Exclude...)
+	exclude, err := pathfilter.New(excludePatterns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the exclude patterns: %w", err)
+	}
+	return vfs.NewFilterFS(fsys, include, exclude), nil
+}
+
+func (rsf *ReverseSSHFS) Start() (retErr error) {
+	sshBinary := rsf.SSHConfig.Binary()
+	sshArgs := rsf.sessionSSHArgs()
+	localPath := rsf.LocalPath
+	var submountNames []string
+	if len(rsf.Submounts) > 0 {
+		if rsf.FS != nil || rsf.filtered() {
+			return errors.New("FS, Include, Exclude, and Gitignore cannot be combined with Submounts")
 		}
-		stdoutPipe, err := rsf.sshCmd.StdoutPipe()
+		var err error
+		localPath, submountNames, err = rsf.submounts()
 		if err != nil {
 			return err
 		}
-		stdio := &util.RWC{
-			ReadCloser:  stdoutPipe,
-			WriteCloser: stdinPipe,
+		logrus.Debugf("Multiplexing %v in %q", submountNames, localPath)
+	} else if rsf.FS == nil {
+		if !filepath.IsAbs(localPath) && !path.IsAbs(localPath) {
+			return fmt.Errorf("unexpected relative path: %q", localPath)
+		}
+		if runtime.GOOS == "windows" && path.IsAbs(localPath) {
+			logrus.Infof("Accepting %q Unix path, assuming Cygwin/msys2 OpenSSH", localPath)
 		}
-		var sftpOpts []sftp.ServerOption
-		if rsf.Readonly {
-			sftpOpts = append(sftpOpts, sftp.ReadOnly())
+	}
+	if !path.IsAbs(rsf.RemotePath) {
+		return fmt.Errorf("unexpected relative path: %q", rsf.RemotePath)
+	}
+	rsf.singleFile = rsf.detectSingleFile()
+	// The multiplexed session needs FS too, so that only the submounts are served, not their common ancestor
+	needsFS := rsf.FS != nil || rsf.filtered() || rsf.singleFile || len(rsf.Submounts) > 0
+	driverName, driverArg := ParseDriver(rsf.Driver)
+	switch driverName {
+	case "", DriverAuto:
+		if needsFS {
+			driverName = DriverBuiltin
+			break
 		}
-		// NOTE: sftp.NewServer doesn't support specifying the root.
-		// https://github.com/pkg/sftp/pull/238
-		//
-		// TODO: use sftp.NewRequestServer with custom handlers to mitigate potential vulnerabilities.
-		builtinSftpServer, err = sftp.NewServer(stdio, sftpOpts...)
+		var err error
+		driverName, driverArg, err = DetectDriver(rsf.OpensshSftpServerBinary)
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to choose driver automatically: %w", err)
 		}
+		logrus.Debugf("Chosen driver %q", driverName)
 	case DriverOpensshSftpServer:
-		if opensshSftpServerBinary == "" {
-			opensshSftpServerBinary = DetectOpensshSftpServerBinary()
-			if opensshSftpServerBinary == "" {
-				return errors.New("no openssh sftp-server found")
-			}
+		if driverArg == "" {
+			driverArg = rsf.OpensshSftpServerBinary
 		}
-		logrus.Debugf("Using OpenSSH SFTP Server %q", opensshSftpServerBinary)
-		sftpServerArgs := []string{
-			// `-e` available since OpenSSH 5.4p1 (2010) https://github.com/openssh/openssh-portable/commit/7bee06ab
-			"-e",
-			// `-d` available since OpenSSH 6.2p1 (2013) https://github.com/openssh/openssh-portable/commit/502ab0ef
-			// NOTE: `-d` just chdirs the sftp server process to the specified directory.
-			// This is expected to be used in conjunction with chroot (in future), however, macOS does not support unprivileged chroot.
-			"-d", strings.ReplaceAll(rsf.LocalPath, "%", "%%"),
-		}
-		if rsf.Readonly {
-			// `-R` available since OpenSSH 5.4p1 (2010) https://github.com/openssh/openssh-portable/commit/db7bf825
-			sftpServerArgs = append(sftpServerArgs, "-R")
-		}
-		rsf.opensshSftpServerCmd = exec.Command(opensshSftpServerBinary, sftpServerArgs...)
-		rsf.opensshSftpServerCmd.Stderr = os.Stderr
-		var err error
-		rsf.opensshSftpServerCmd.Stdin, err = rsf.sshCmd.StdoutPipe()
-		if err != nil {
-			return err
+	}
+	driverInfo, ok := LookupDriver(driverName)
+	if !ok {
+		return fmt.Errorf("unknown driver %q, should be one of %v", driverName, Drivers())
+	}
+	if !driverInfo.SupportsFS {
+		if rsf.FS != nil {
+			return fmt.Errorf("FS is not supported by driver %q", driverName)
 		}
-		rsf.sshCmd.Stdin, err = rsf.opensshSftpServerCmd.StdoutPipe()
-		if err != nil {
-			return err
+		if rsf.filtered() {
+			return fmt.Errorf("Include, Exclude, and Gitignore are not supported by driver %q", driverName)
+		}
+		if rsf.singleFile {
+			return fmt.Errorf("mounting a single file is not supported by driver %q", driverName)
+		}
+		if len(rsf.Submounts) > 0 && !(rsf.Sandbox && driverInfo.SupportsSandbox) {
+			return fmt.Errorf("Submounts require Sandbox for driver %q, as it serves the common ancestor %q", driverName, localPath)
 		}
 	}
-	logrus.Debugf("executing ssh for remote sshfs: %s %v", rsf.sshCmd.Path, rsf.sshCmd.Args)
-	if err := rsf.sshCmd.Start(); err != nil {
+	if rsf.singleFile && rsf.filtered() {
+		return errors.New("Include, Exclude, and Gitignore are not supported for a single file")
+	}
+	if rsf.Readonly && !driverInfo.SupportsReadonly {
+		return fmt.Errorf("Readonly is not supported by driver %q", driverName)
+	}
+	if rsf.AuditLog != "" && !driverInfo.SupportsAudit {
+		return fmt.Errorf("AuditLog is not supported by driver %q", driverName)
+	}
+	if (len(rsf.DeniedRequests) > 0 || len(rsf.AllowedRequests) > 0) && !driverInfo.SupportsRequestFilter {
+		return fmt.Errorf("DeniedRequests and AllowedRequests are not supported by driver %q", driverName)
+	}
+	if rsf.Sandbox && !driverInfo.SupportsSandbox {
+		logrus.Warnf("Sandbox is not supported by driver %q, ignoring", driverName)
+	}
+	idmap, err := rsf.idmapping()
+	if err != nil {
 		return err
 	}
-	logrus.Debugf("starting sftp server for %v", rsf.LocalPath)
-	switch driver {
-	case DriverBuiltin:
-		go func() {
-			if srvErr := builtinSftpServer.Serve(); srvErr != nil {
-				if errors.Is(srvErr, io.EOF) {
-					logrus.WithError(srvErr).Debugf("sftp server for %v exited with EOF (negligible)", rsf.LocalPath)
-				} else {
-					logrus.WithError(srvErr).Errorf("sftp server for %v exited", rsf.LocalPath)
+	driverConfig := DriverConfig{
+		LocalPath:       localPath,
+		Arg:             driverArg,
+		Readonly:        rsf.Readonly,
+		UID:             idmap.uid,
+		GID:             idmap.gid,
+		Umask:           idmap.umask,
+		Sandbox:         rsf.Sandbox && driverInfo.SupportsSandbox,
+		DeniedRequests:  rsf.DeniedRequests, // Validated against the sftp-server binary by the driver
+		AllowedRequests: rsf.AllowedRequests,
+	}
+	for _, sub := range rsf.Submounts {
+		driverConfig.ServedPaths = append(driverConfig.ServedPaths, sub.LocalPath)
+	}
+	if driverInfo.SupportsFS {
+		driverConfig.FS = rsf.FS
+		if rsf.singleFile {
+			driverConfig.FS, err = rsf.singleFileFS()
+			if err != nil {
+				return err
+			}
+		} else if len(submountNames) > 0 {
+			subs := make(map[string]vfs.WritableFS, len(submountNames))
+			for i, name := range submountNames {
+				subs[name] = vfs.DirFS(rsf.Submounts[i].LocalPath)
+			}
+			driverConfig.FS = vfs.NewMultiFS(subs)
+		} else if driverConfig.FS == nil && rsf.filtered() {
+			// The filter checks the names before opening them, so the symbolic links must not be followed to the outside
+			rsf.rootFS, err = vfs.OpenRootFS(localPath)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if retErr != nil {
+					_ = rsf.rootFS.Close()
+					rsf.rootFS = nil
 				}
+			}()
+			driverConfig.FS = rsf.rootFS
+		} else if driverConfig.FS == nil {
+			driverConfig.FS = vfs.DirFS(localPath)
+		}
+		if rsf.filtered() {
+			driverConfig.FS, err = rsf.filterFS(driverConfig.FS)
+			if err != nil {
+				return err
 			}
-		}()
-	case DriverOpensshSftpServer:
-		logrus.Debugf("executing OpenSSH SFTP Server: %s %v", rsf.opensshSftpServerCmd.Path, rsf.opensshSftpServerCmd.Args)
-		if err := rsf.opensshSftpServerCmd.Start(); err != nil {
+		}
+	}
+	if rsf.AuditLog != "" {
+		rsf.auditLogger, err = audit.NewLogger(rsf.AuditLog, rsf.AuditLogMaxSize, rsf.AuditLogMaxBackups)
+		if err != nil {
 			return err
 		}
+		defer func() {
+			if retErr != nil {
+				_ = rsf.auditLogger.Close()
+			}
+		}()
+		driverConfig.Audit = rsf.auditLogger.Log
+	}
+	rsf.driver, err = driverInfo.New(driverConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create driver %q: %w", driverName, err)
+	}
+	if rsf.Port != 0 {
+		sshArgs = append(sshArgs, "-p", strconv.Itoa(rsf.Port))
+	}
+	sshArgs = append(sshArgs, rsf.Host, "--")
+	if rsf.RemoteSudo {
+		// Verified by preflight
+		sshArgs = append(sshArgs, "sudo", "-n")
+	}
+	switch rsf.Transport {
+	case "", TransportStdio:
+		sshArgs = append(sshArgs, "sshfs", addQuotes(":"+rsf.driver.Root()), addQuotes(rsf.mountpoint()), "-o", "slave")
+	case TransportDirect:
+		if err := rsf.listenDirect(); err != nil {
+			return fmt.Errorf("failed to set up transport %q: %w", TransportDirect, err)
+		}
+		defer func() {
+			if retErr != nil {
+				_ = rsf.direct.close(rsf)
+				rsf.direct = nil
+			}
+		}()
+		// `-f` keeps sshfs in the foreground, so that it can be watched as the ssh process.
+		// The host "127.0.0.1" is ignored by the connect script, but tells the mount apart in staleMountScript.
+		sshArgs = append(sshArgs, "sshfs", addQuotes("127.0.0.1:"+rsf.driver.Root()), addQuotes(rsf.mountpoint()),
+			"-f", "-o", addQuotes("ssh_command="+rsf.direct.sshCommand()))
+	default:
+		return fmt.Errorf("unknown transport %q", rsf.Transport)
+	}
+	if rsf.Readonly {
+		sshArgs = append(sshArgs, "-o", "ro")
+	}
+	if rsf.allowOther() {
+		sshArgs = append(sshArgs, "-o", "allow_other", "-o", "default_permissions")
+	}
+	sshArgs = append(sshArgs, idmap.sshfsArgs...)
+	sshArgs = append(sshArgs, rsf.SSHFSAdditionalArgs...)
+	rsf.sshCmd = exec.Command(sshBinary, sshArgs...)
+	rsf.sshCmd.Stderr = os.Stderr
+	stdio, err := rsf.startSSHCmd()
+	if err != nil {
+		return err
+	}
+	if rsf.Metrics != nil {
+		stdio.ReadCloser = rsf.Metrics.TapRequestReader(stdio.ReadCloser)
+		stdio.WriteCloser = rsf.Metrics.TapResponseWriter(stdio.WriteCloser)
+	}
+	stdio.ReadCloser = ratelimit.NewReadCloser(stdio.ReadCloser, ratelimit.New(rsf.WriteLimit))
+	stdio.WriteCloser = ratelimit.NewWriteCloser(stdio.WriteCloser, ratelimit.New(rsf.ReadLimit))
+	logrus.Debugf("starting sftp server (driver %q) for %v", driverName, localPath)
+	if err := rsf.driver.Start(stdio); err != nil {
+		_ = rsf.sshCmd.Process.Kill()
+		return fmt.Errorf("failed to start driver %q: %w", driverName, err)
 	}
 	logrus.Debugf("waiting for remote ready")
 	if err := rsf.waitForRemoteReady(); err != nil {
@@ -252,6 +776,68 @@ func (rsf *ReverseSSHFS) Start() error {
 	return nil
 }
 
+// sessionSSHArgs returns the arguments of ssh for the sshfs session, without the host.
+func (rsf *ReverseSSHFS) sessionSSHArgs() []string {
+	if len(rsf.SSHAdditionalArgs) == 0 {
+		return rsf.SSHConfig.Args()
+	}
+	if rsf.SSHConfig.Persist || rsf.SSHConfig.ControlPath != "" || rsf.Transport == TransportDirect {
+		// The connection-level options such as Compression cannot be changed on the master connection,
+		// and a dedicated connection would need another authentication and ignore the persistence
+		logrus.Warnf("Ignoring the ssh options %v of the sshfs session for %q (remote), as the session shares the master connection",
+			rsf.SSHAdditionalArgs, rsf.RemotePath)
+		return rsf.SSHConfig.Args()
+	}
+	c := *rsf.SSHConfig
+	c.Persist = false
+	c.ControlPath = ""
+	// ssh uses the first value of each option, so SSHConfig.AdditionalArgs take precedence over SSHAdditionalArgs,
+	// and the command line takes precedence over the config file
+	args := append(c.Args(), rsf.SSHAdditionalArgs...)
+	return append(args, "-o", "ControlMaster=no", "-o", "ControlPath=none")
+}
+
+// startSSHCmd starts sshCmd, and returns the SFTP session with the remote sshfs.
+func (rsf *ReverseSSHFS) startSSHCmd() (*util.RWC, error) {
+	logrus.Debugf("executing ssh for remote sshfs: %s %v", rsf.sshCmd.Path, rsf.sshCmd.Args)
+	if rsf.direct != nil {
+		if err := rsf.sshCmd.Start(); err != nil {
+			return nil, err
+		}
+		rsf.watcherDone = make(chan struct{})
+		go rsf.watchSSHCmd()
+		stdio, err := rsf.acceptDirect()
+		if err != nil {
+			_ = rsf.sshCmd.Process.Kill()
+			return nil, err
+		}
+		return stdio, nil
+	}
+	// os.Pipe is used instead of StdinPipe, so that the drivers can pass the file descriptors to their processes
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer stdinReader.Close()
+	rsf.sshCmd.Stdin = stdinReader
+	stdoutPipe, err := rsf.sshCmd.StdoutPipe()
+	if err != nil {
+		_ = stdinWriter.Close()
+		return nil, err
+	}
+	stdio := &util.RWC{
+		ReadCloser:  stdoutPipe,
+		WriteCloser: stdinWriter,
+	}
+	if err := rsf.sshCmd.Start(); err != nil {
+		_ = stdio.Close()
+		return nil, err
+	}
+	rsf.watcherDone = make(chan struct{})
+	go rsf.watchSSHCmd()
+	return stdio, nil
+}
+
 func addQuotes(input string) string {
 	input = strconv.Quote(input)
 	// exec.Command on Windows would escape wrapping double quotes in a way, which is not compatible
@@ -295,7 +881,7 @@ done
 	}
 	m := map[string]string{
 		// rsf.RemotePath should have been verified during rsf.Prepare()
-		"Dir":      rsf.RemotePath,
+		"Dir":      rsf.mountpoint(),
 		"MaxTrial": "30",
 	}
 	var b bytes.Buffer
@@ -309,7 +895,39 @@ done
 	return err
 }
 
+// watchSSHCmd emits events.TypeMountClosed when the ssh process for sshfs exits.
+func (rsf *ReverseSSHFS) watchSSHCmd() {
+	defer close(rsf.watcherDone)
+	// Process.Wait is used instead of Cmd.Wait, as Cmd.Wait closes the pipes that may be still read by the sftp server.
+	state, err := rsf.sshCmd.Process.Wait()
+	ev := events.Event{
+		Type:       events.TypeMountClosed,
+		Host:       rsf.Host,
+		Port:       rsf.Port,
+		LocalPath:  rsf.LocalPath,
+		RemotePath: rsf.RemotePath,
+	}
+	if !rsf.closing.Load() {
+		if err != nil {
+			ev.Error = err.Error()
+		} else {
+			ev.Error = fmt.Sprintf("ssh for sshfs exited unexpectedly: %v", state)
+		}
+		logrus.Warnf("%v [remote] seems unmounted: %s", rsf.RemotePath, ev.Error)
+	}
+	if len(rsf.Submounts) == 0 {
+		events.Emit(rsf.EventHandler, ev)
+		return
+	}
+	// One event per Submount, as the session itself is an implementation detail
+	for _, sub := range rsf.Submounts {
+		ev.LocalPath, ev.RemotePath = sub.LocalPath, sub.RemotePath
+		events.Emit(rsf.EventHandler, ev)
+	}
+}
+
 func (rsf *ReverseSSHFS) Close() error {
+	rsf.closing.Store(true)
 	logrus.Debugf("killing processes for remote sshfs: %s %v", rsf.sshCmd.Path, rsf.sshCmd.Args)
 	var errors []error
 	if rsf.sshCmd != nil && rsf.sshCmd.Process != nil {
@@ -317,11 +935,33 @@ func (rsf *ReverseSSHFS) Close() error {
 			errors = append(errors, err)
 		}
 	}
-	if rsf.opensshSftpServerCmd != nil && rsf.opensshSftpServerCmd.Process != nil {
-		if err := rsf.opensshSftpServerCmd.Process.Kill(); err != nil {
+	if rsf.watcherDone != nil {
+		// Wait for events.TypeMountClosed, so that it is not lost when the process exits after Close
+		<-rsf.watcherDone
+	}
+	if rsf.driver != nil {
+		if err := rsf.driver.Close(); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	if rsf.direct != nil {
+		if err := rsf.direct.close(rsf); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	if rsf.auditLogger != nil {
+		if err := rsf.auditLogger.Close(); err != nil {
 			errors = append(errors, err)
 		}
 	}
+	if rsf.rootFS != nil {
+		if err := rsf.rootFS.Close(); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	if err := rsf.cleanup(); err != nil {
+		errors = append(errors, err)
+	}
 	if len(errors) > 0 {
 		return fmt.Errorf("%v", errors)
 	}
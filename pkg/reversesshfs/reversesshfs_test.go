@@ -1,8 +1,22 @@
 package reversesshfs
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/lima-vm/sshocker/pkg/events"
+	"github.com/lima-vm/sshocker/pkg/ssh"
+	"github.com/lima-vm/sshocker/pkg/util"
+	"github.com/lima-vm/sshocker/pkg/vfs"
 )
 
 func TestAddQuotes(t *testing.T) {
@@ -33,3 +47,378 @@ func TestAddQuotes(t *testing.T) {
 		}
 	}
 }
+
+func TestSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"kubeconfig": "config",
+		"other":      "other",
+		"sub/file":   "file",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rsf := &ReverseSSHFS{
+		LocalPath:  filepath.Join(dir, "kubeconfig"),
+		RemotePath: "/root/.kube/config",
+	}
+	if !rsf.detectSingleFile() {
+		t.Fatal("expected a single file")
+	}
+	rsf.singleFile = true
+	if got, expected := rsf.mountpoint(), "/root/.kube/.config.sshocker"; got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if got, expected := rsf.singleFileLinkTarget(), ".config.sshocker/kubeconfig"; got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	fsys, err := rsf.singleFileFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, ent := range entries {
+		names = append(names, ent.Name())
+	}
+	if expected := []string{"kubeconfig"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+	if b, err := fs.ReadFile(fsys, "kubeconfig"); err != nil || string(b) != "config" {
+		t.Errorf("unexpected content: %q, %v", string(b), err)
+	}
+	for _, name := range []string{"other", "sub/file"} {
+		if _, err := fs.Stat(fsys, name); err == nil {
+			t.Errorf("%q should be hidden", name)
+		}
+	}
+	wfs, ok := fsys.(vfs.WritableFS)
+	if !ok {
+		t.Fatal("expected a writable filesystem")
+	}
+	f, err := wfs.OpenFile("kubeconfig", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("new config"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wfs.Truncate("kubeconfig", 3); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "kubeconfig")); err != nil || string(b) != "new" {
+		t.Errorf("unexpected content: %q, %v", string(b), err)
+	}
+	// The remote cannot replace the file with a symbolic link to another local file
+	if err := wfs.Remove("kubeconfig"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected ErrPermission for removing the file, got %v", err)
+	}
+	if err := wfs.Rename("kubeconfig", "other"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected ErrPermission for renaming the file, got %v", err)
+	}
+	for _, name := range []string{"kubeconfig", "link"} {
+		if err := wfs.Symlink(filepath.Join(dir, "other"), name); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("expected ErrPermission for creating a symlink %q, got %v", name, err)
+		}
+	}
+	if _, err := wfs.OpenFile("new", os.O_WRONLY|os.O_CREATE, 0o644); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected ErrPermission for creating a file, got %v", err)
+	}
+	if runtime.GOOS != "windows" {
+		// Replaced by a symbolic link on the local host: never followed
+		if err := os.Remove(filepath.Join(dir, "kubeconfig")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("other", filepath.Join(dir, "kubeconfig")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.ReadFile(fsys, "kubeconfig"); err == nil {
+			t.Error("expected an error for reading the file replaced by a symbolic link")
+		}
+	}
+
+	if (&ReverseSSHFS{LocalPath: dir}).detectSingleFile() {
+		t.Error("a directory should not be detected as a single file")
+	}
+}
+
+func TestAncestors(t *testing.T) {
+	testCases := map[string][]string{
+		"/":           nil,
+		"/mnt":        {"/mnt"},
+		"/mnt/a b/c/": {"/mnt", "/mnt/a b", "/mnt/a b/c"},
+	}
+	for p, expected := range testCases {
+		if got := ancestors(p); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%q: expected %v, got %v", p, expected, got)
+		}
+	}
+}
+
+func TestSubmounts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses Unix paths")
+	}
+	rsf := &ReverseSSHFS{
+		RemotePath: "/mnt/.sshocker-mux",
+		Submounts: []Submount{
+			{LocalPath: "/home/user/src/foo", RemotePath: "/mnt/foo"},
+			{LocalPath: "/home/user/work/", RemotePath: "/mnt/work"},
+			{LocalPath: "/home/user/src/bar", RemotePath: "/srv/bar"},
+		},
+	}
+	root, names, err := rsf.submounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != "/home/user" {
+		t.Errorf("expected %q, got %q", "/home/user", root)
+	}
+	if expected := []string{"src/foo", "work", "src/bar"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+	links, err := rsf.links()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (link{file: "/srv/bar", target: "/mnt/.sshocker-mux/src/bar"}); links[2] != expected {
+		t.Errorf("expected %+v, got %+v", expected, links[2])
+	}
+
+	for _, subs := range [][]Submount{
+		{{LocalPath: "/a", RemotePath: "/mnt/a"}, {LocalPath: "/b", RemotePath: "/mnt/a/b"}},
+		{{LocalPath: "/a", RemotePath: "/mnt/.sshocker-mux/a"}},
+		{{LocalPath: "a", RemotePath: "/mnt/a"}},
+	} {
+		rsf.Submounts = subs
+		if _, _, err := rsf.submounts(); err == nil {
+			t.Errorf("%+v: expected an error", subs)
+		}
+	}
+}
+
+func TestSubmountsDriver(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses Unix paths")
+	}
+	rsf := &ReverseSSHFS{
+		SSHConfig:  &ssh.SSHConfig{},
+		Driver:     DriverOpensshSftpServer + ":/usr/lib/openssh/sftp-server",
+		RemotePath: "/mnt/.sshocker-mux",
+		Submounts: []Submount{
+			{LocalPath: t.TempDir(), RemotePath: "/mnt/a"},
+			{LocalPath: t.TempDir(), RemotePath: "/mnt/b"},
+		},
+	}
+	// The driver would serve the common ancestor without the sandbox
+	if err := rsf.Start(); err == nil || !strings.Contains(err.Error(), "require Sandbox") {
+		t.Errorf("expected an error about Sandbox, got %v", err)
+	}
+}
+
+func TestStaleMountScript(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs /bin/sh")
+	}
+	binDir := t.TempDir()
+	fakes := map[string]string{
+		"mount":      "#!/bin/sh\necho \"$FAKE_MOUNT_ENTRY\"\n",
+		"fusermount": "#!/bin/sh\nexit 0\n",
+	}
+	for name, content := range fakes {
+		if err := os.WriteFile(filepath.Join(binDir, name), []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	live := t.TempDir()
+	dead := filepath.Join(t.TempDir(), "dead mount")
+	type testCase struct {
+		mountpoint string
+		entry      string
+		stdout     string
+		fails      bool
+	}
+	testCases := []testCase{
+		{mountpoint: live, entry: "/dev/sda1 on / type ext4 (rw)"},
+		{mountpoint: live, entry: "/dev/sdb1 on " + live + " type ext4 (rw)", fails: true},
+		{mountpoint: live, entry: "foo@example.com:/src on " + live + " type fuse.sshfs (rw)", fails: true},
+		{mountpoint: live, entry: ":/ on " + live + " type fuse.sshfs (rw)", fails: true},
+		{mountpoint: dead, entry: ":/ on " + strings.ReplaceAll(dead, " ", "\\040") + " type fuse.sshfs (rw)", stdout: "unmounted:" + dead + "\n"},
+		{mountpoint: dead, entry: "127.0.0.1:/ on " + dead + " type fuse.sshfs (rw)", stdout: "unmounted:" + dead + "\n"},
+	}
+	for i, tc := range testCases {
+		cmd := exec.Command("/bin/sh", "-c", "set -eu\n"+fmt.Sprintf(staleMountScript, util.ShellQuote(tc.mountpoint)))
+		cmd.Env = append(os.Environ(), "PATH="+binDir+":"+os.Getenv("PATH"), "FAKE_MOUNT_ENTRY="+tc.entry)
+		out, err := cmd.Output()
+		if tc.fails {
+			if err == nil {
+				t.Errorf("#%d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		if string(out) != tc.stdout {
+			t.Errorf("#%d: expected %q, got %q", i, tc.stdout, string(out))
+		}
+	}
+}
+
+func TestSessionSSHArgs(t *testing.T) {
+	rsf := &ReverseSSHFS{
+		SSHConfig: &ssh.SSHConfig{
+			ConfigFile:     "/ssh_config",
+			AdditionalArgs: []string{"-o", "Compression=no"},
+		},
+	}
+	if expected := rsf.SSHConfig.Args(); !reflect.DeepEqual(rsf.sessionSSHArgs(), expected) {
+		t.Errorf("expected %v, got %v", expected, rsf.sessionSSHArgs())
+	}
+	rsf.SSHAdditionalArgs = []string{"-o", "Compression=yes", "-o", "Ciphers=aes128-ctr"}
+	expected := []string{
+		"-F", "/ssh_config",
+		"-o", "Compression=no",
+		"-o", "Compression=yes", "-o", "Ciphers=aes128-ctr",
+		"-o", "ControlMaster=no", "-o", "ControlPath=none",
+	}
+	if got := rsf.sessionSSHArgs(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	// The master is never bypassed, so SSHAdditionalArgs are ignored
+	for _, c := range []ssh.SSHConfig{
+		{ConfigFile: "/ssh_config", ControlPath: "/master.sock"},
+		{ConfigFile: "/ssh_config", Persist: true},
+	} {
+		rsf.SSHConfig = &c
+		if expected := c.Args(); !reflect.DeepEqual(rsf.sessionSSHArgs(), expected) {
+			t.Errorf("expected %v for %+v, got %v", expected, c, rsf.sessionSSHArgs())
+		}
+	}
+}
+
+func TestPresets(t *testing.T) {
+	names := PresetNames()
+	if expected := []string{"build-output", "media", "source-code", "strict-consistency"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+	p, ok := LookupPreset("strict-consistency")
+	if !ok {
+		t.Fatal("strict-consistency not found")
+	}
+	if got := p.SSHFSArgs(); len(got) == 0 || got[0] != "-o" || got[1] != "cache=no" {
+		t.Errorf("unexpected sshfs args %v", got)
+	}
+	if got := p.SSHArgs(); got != nil {
+		t.Errorf("expected no ssh args, got %v", got)
+	}
+	if _, ok := LookupPreset("unknown"); ok {
+		t.Error("unknown preset should not be found")
+	}
+}
+
+func TestPreflightScript(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("user_allow_other is checked only on Linux")
+	}
+	binDir := t.TempDir()
+	fakes := map[string]string{
+		// A non-root user
+		"id":    "#!/bin/sh\ncase \"$1\" in\n-u) echo 1000 ;;\n*) echo user ;;\nesac\n",
+		"sudo":  "#!/bin/sh\n[ \"$FAKE_SUDO\" = 1 ] || exit 1\nshift\nexec \"$@\"\n",
+		"sshfs": "#!/bin/sh\nexit 0\n",
+	}
+	for name, content := range fakes {
+		if err := os.WriteFile(filepath.Join(binDir, name), []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	confDir := t.TempDir()
+	oldFuseConf := fuseConf
+	t.Cleanup(func() {
+		fuseConf = oldFuseConf
+	})
+	type testCase struct {
+		allowOther bool
+		remoteSudo bool
+		conf       string // Not created if empty
+		sudo       bool
+		expected   string // Expected in stderr, empty for success
+	}
+	testCases := []testCase{
+		{allowOther: true, conf: "# comment\nuser_allow_other\n"},
+		{allowOther: true, conf: "#user_allow_other\n", expected: "user_allow_other"},
+		{allowOther: true, expected: "user_allow_other"},
+		{remoteSudo: true, sudo: true},
+		{remoteSudo: true, conf: "user_allow_other\n", expected: "NOPASSWD"},
+	}
+	for i, tc := range testCases {
+		fuseConf = filepath.Join(confDir, fmt.Sprintf("fuse-%d.conf", i))
+		if tc.conf != "" {
+			if err := os.WriteFile(fuseConf, []byte(tc.conf), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		rsf := &ReverseSSHFS{AllowOther: tc.allowOther, RemoteSudo: tc.remoteSudo}
+		cmd := exec.Command("/bin/sh", "-c", rsf.preflightScript())
+		cmd.Env = append(os.Environ(), "PATH="+binDir+":"+os.Getenv("PATH"), "FAKE_SUDO="+map[bool]string{true: "1", false: "0"}[tc.sudo])
+		var stderr strings.Builder
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		if tc.expected == "" {
+			if err != nil {
+				t.Errorf("#%d: %v: %q", i, err, stderr.String())
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("#%d: expected an error", i)
+		} else if !strings.Contains(stderr.String(), tc.expected) {
+			t.Errorf("#%d: expected %q in stderr, got %q", i, tc.expected, stderr.String())
+		}
+	}
+}
+
+func TestCloseEmitsMountClosed(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sleep(1)")
+	}
+	var (
+		mu     sync.Mutex
+		closed []events.Event
+	)
+	rsf := &ReverseSSHFS{
+		RemotePath: "/mnt/foo",
+		EventHandler: func(ev events.Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			closed = append(closed, ev)
+		},
+		sshCmd: exec.Command("sleep", "60"),
+	}
+	if err := rsf.sshCmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	rsf.watcherDone = make(chan struct{})
+	go rsf.watchSSHCmd()
+	if err := rsf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(closed) != 1 || closed[0].Type != events.TypeMountClosed || closed[0].Error != "" {
+		t.Errorf("expected a mount-closed event without an error on returning from Close, got %+v", closed)
+	}
+}
@@ -0,0 +1,31 @@
+// Package sandbox executes the commands with the restricted filesystem access.
+//
+// The sandbox is implemented with Landlock (Linux 5.13 or later), and does not need any privilege.
+// The sandbox is unavailable on the other platforms.
+package sandbox
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// ErrUnsupported is returned by [Start] when the sandbox is unavailable on the host.
+var ErrUnsupported = errors.New("sandbox is unsupported")
+
+// Rule allows access to the files beneath Path.
+// Read access is always allowed.
+type Rule struct {
+	Path  string
+	Write bool // Allow creating, modifying, and removing the files
+	Exec  bool // Allow executing the files
+}
+
+// Start starts cmd with the access to the filesystem restricted to rules.
+// Rules with nonexistent paths are ignored.
+// Returns an error wrapping [ErrUnsupported] without starting cmd, when the sandbox is unavailable.
+//
+// The access from the children of cmd is restricted too.
+// The metadata of the files (e.g., stat(2)) remains accessible.
+func Start(cmd *exec.Cmd, rules []Rule) error {
+	return start(cmd, rules)
+}
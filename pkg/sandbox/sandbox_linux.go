@@ -0,0 +1,146 @@
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// accessFile is the access rights applicable to the files (ABI 1)
+	accessFile = unix.LANDLOCK_ACCESS_FS_EXECUTE |
+		unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE
+	// accessRead is the read access rights (ABI 1)
+	accessRead = unix.LANDLOCK_ACCESS_FS_READ_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_DIR
+	// accessWrite is the write access rights (ABI 1)
+	accessWrite = unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM
+)
+
+// abiVersion returns the Landlock ABI version.
+func abiVersion() (int, error) {
+	v, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		if errno == unix.ENOSYS || errno == unix.EOPNOTSUPP {
+			return 0, fmt.Errorf("%w: Landlock is not enabled on the kernel: %w", ErrUnsupported, errno)
+		}
+		return 0, fmt.Errorf("failed to get the Landlock ABI version: %w", errno)
+	}
+	return int(v), nil
+}
+
+// handledAccess returns the access rights to be restricted, and the ones for Rule.Write.
+func handledAccess(abi int) (handled, write uint64) {
+	handled = accessRead | accessWrite | unix.LANDLOCK_ACCESS_FS_EXECUTE
+	write = accessWrite
+	if abi >= 2 {
+		// Renaming and linking across the directories
+		handled |= unix.LANDLOCK_ACCESS_FS_REFER
+		write |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		handled |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+		write |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	return handled, write
+}
+
+func start(cmd *exec.Cmd, rules []Rule) error {
+	abi, err := abiVersion()
+	if err != nil {
+		return err
+	}
+	handled, write := handledAccess(abi)
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	rulesetFd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET,
+		uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to create a Landlock ruleset: %w", errno)
+	}
+	defer unix.Close(int(rulesetFd))
+	for _, rule := range rules {
+		allowed := uint64(accessRead)
+		if rule.Write {
+			allowed |= write
+		}
+		if rule.Exec {
+			allowed |= unix.LANDLOCK_ACCESS_FS_EXECUTE
+		}
+		if err := addRule(int(rulesetFd), rule.Path, allowed); err != nil {
+			return err
+		}
+	}
+	// exec.Cmd opens /dev/null for the nil stdio, which has to be done before the restriction
+	if cmd.Stdin == nil || cmd.Stdout == nil || cmd.Stderr == nil {
+		devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		defer devNull.Close()
+		if cmd.Stdin == nil {
+			cmd.Stdin = devNull
+		}
+		if cmd.Stdout == nil {
+			cmd.Stdout = devNull
+		}
+		if cmd.Stderr == nil {
+			cmd.Stderr = devNull
+		}
+	}
+	errCh := make(chan error)
+	go func() {
+		// The thread is never unlocked, so that it is terminated with the goroutine,
+		// as the restriction cannot be removed from the thread.
+		// The child process is forked from this thread, and inherits the restriction.
+		runtime.LockOSThread()
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			errCh <- fmt.Errorf("failed to set no_new_privs: %w", err)
+			return
+		}
+		if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, rulesetFd, 0, 0); errno != 0 {
+			errCh <- fmt.Errorf("failed to enforce the Landlock ruleset: %w", errno)
+			return
+		}
+		errCh <- cmd.Start()
+	}()
+	return <-errCh
+}
+
+func addRule(rulesetFd int, path string, allowed uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return nil
+		}
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer unix.Close(fd)
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return &os.PathError{Op: "fstat", Path: path, Err: err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		allowed &= accessFile | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	attr := unix.LandlockPathBeneathAttr{Allowed_access: allowed, Parent_fd: int32(fd)}
+	if _, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(rulesetFd), unix.LANDLOCK_RULE_PATH_BENEATH,
+		uintptr(unsafe.Pointer(&attr)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to add a Landlock rule for %q: %w", path, errno)
+	}
+	return nil
+}
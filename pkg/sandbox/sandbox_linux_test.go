@@ -0,0 +1,50 @@
+package sandbox
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestStart(t *testing.T) {
+	allowed := t.TempDir()
+	denied := t.TempDir()
+	for _, dir := range []string{allowed, denied} {
+		if err := os.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rules := []Rule{
+		{Path: allowed},
+		{Path: "/usr", Exec: true},
+		{Path: "/bin", Exec: true},
+		{Path: "/lib", Exec: true},
+		{Path: "/lib64", Exec: true},
+		{Path: "/etc"},
+	}
+	run := func(args ...string) error {
+		cmd := exec.Command(args[0], args[1:]...)
+		if err := Start(cmd, rules); err != nil {
+			if errors.Is(err, ErrUnsupported) {
+				t.Skip(err)
+			}
+			t.Fatal(err)
+		}
+		return cmd.Wait()
+	}
+	if err := run("cat", filepath.Join(allowed, "file")); err != nil {
+		t.Errorf("expected to be able to read the allowed file: %v", err)
+	}
+	if err := run("cat", filepath.Join(denied, "file")); err == nil {
+		t.Error("expected to be unable to read the denied file")
+	}
+	if err := run("touch", filepath.Join(allowed, "new")); err == nil {
+		t.Error("expected to be unable to write the read-only directory")
+	}
+	// The current process is not restricted
+	if _, err := os.ReadFile(filepath.Join(denied, "file")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+func start(*exec.Cmd, []Rule) error {
+	return fmt.Errorf("%w on %s", ErrUnsupported, runtime.GOOS)
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package sftpserver
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// sysOwner returns the UID and the GID of fi, if available.
+func sysOwner(fi fs.FileInfo) (uint32, uint32, bool) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Uid, st.Gid, true
+	}
+	return 0, 0, false
+}
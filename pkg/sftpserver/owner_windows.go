@@ -0,0 +1,8 @@
+package sftpserver
+
+import "io/fs"
+
+// sysOwner returns the UID and the GID of fi, if available.
+func sysOwner(fs.FileInfo) (uint32, uint32, bool) {
+	return 0, 0, false
+}
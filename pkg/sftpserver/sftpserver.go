@@ -0,0 +1,402 @@
+// Package sftpserver implements the SFTP request handlers for the builtin driver,
+// on top of the filesystem abstraction defined in package vfs.
+package sftpserver
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/lima-vm/sshocker/pkg/audit"
+	"github.com/lima-vm/sshocker/pkg/vfs"
+	"github.com/pkg/sftp"
+)
+
+// Options is the options for [NewHandlersWithOptions].
+type Options struct {
+	Readonly bool          // fsys has to implement [vfs.WritableFS] unless Readonly is true
+	Audit    audit.Handler // Optional. Receives the audit records.
+	UID      *uint32       // Optional. The UID reported as the owner of the files.
+	GID      *uint32       // Optional. The GID reported as the owner of the files.
+	Umask    fs.FileMode   // Masks the reported modes and the modes of the created files.
+}
+
+// NewHandlers returns the SFTP request handlers for fsys.
+// fsys has to implement [vfs.WritableFS] unless readonly is true.
+func NewHandlers(fsys fs.FS, readonly bool) sftp.Handlers {
+	return NewHandlersWithOptions(fsys, Options{Readonly: readonly})
+}
+
+// NewHandlersWithOptions returns the SFTP request handlers for fsys.
+func NewHandlersWithOptions(fsys fs.FS, opts Options) sftp.Handlers {
+	h := &handlers{
+		fsys:     fsys,
+		readonly: opts.Readonly,
+		audit:    opts.Audit,
+		uid:      opts.UID,
+		gid:      opts.GID,
+		umask:    opts.Umask.Perm(),
+	}
+	return sftp.Handlers{
+		FileGet:  h,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h,
+	}
+}
+
+type handlers struct {
+	fsys     fs.FS
+	readonly bool
+	audit    audit.Handler
+	uid      *uint32
+	gid      *uint32
+	umask    fs.FileMode
+}
+
+// name converts the SFTP path into the fs.FS name.
+func name(p string) string {
+	n := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if n == "" {
+		return "."
+	}
+	return n
+}
+
+// cleanPath cleans the SFTP path for the audit records.
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func (h *handlers) writable() (vfs.WritableFS, error) {
+	if h.readonly {
+		return nil, os.ErrPermission
+	}
+	wfs, ok := h.fsys.(vfs.WritableFS)
+	if !ok {
+		return nil, os.ErrPermission
+	}
+	return wfs, nil
+}
+
+// Fileread implements [sftp.FileReader].
+func (h *handlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := h.fsys.Open(name(r.Filepath))
+	if err == nil {
+		var ra vfs.ReaderAtCloser
+		ra, err = vfs.NewReaderAt(f)
+		if err == nil {
+			if h.audit == nil {
+				return ra, nil
+			}
+			return &auditFile{ReaderAt: ra, Closer: ra, h: h.audit, path: cleanPath(r.Filepath), defaultOp: audit.OpRead}, nil
+		}
+		_ = f.Close()
+	}
+	audit.Emit(h.audit, audit.Record{Op: audit.OpRead, Path: cleanPath(r.Filepath)}, err)
+	return nil, err
+}
+
+func openFlags(pflags sftp.FileOpenFlags) int {
+	var flag int
+	switch {
+	case pflags.Read && pflags.Write:
+		flag = os.O_RDWR
+	case pflags.Write:
+		flag = os.O_WRONLY
+	default:
+		flag = os.O_RDONLY
+	}
+	// O_APPEND is not set, as it conflicts with WriteAt.
+	// The clients specify the offsets of the end of the files.
+	if pflags.Creat {
+		flag |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flag |= os.O_EXCL
+	}
+	return flag
+}
+
+// Filewrite implements [sftp.FileWriter].
+func (h *handlers) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return h.OpenFile(r)
+}
+
+// OpenFile implements [sftp.OpenFileWriter].
+func (h *handlers) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	f, err := h.openFile(r)
+	if err != nil {
+		audit.Emit(h.audit, audit.Record{Op: audit.OpWrite, Path: cleanPath(r.Filepath)}, err)
+		return nil, err
+	}
+	if h.audit == nil {
+		return f, nil
+	}
+	return &auditFile{ReaderAt: f, WriterAt: f, Closer: f, h: h.audit, path: cleanPath(r.Filepath), defaultOp: audit.OpWrite}, nil
+}
+
+func (h *handlers) openFile(r *sftp.Request) (vfs.File, error) {
+	wfs, err := h.writable()
+	if err != nil {
+		return nil, err
+	}
+	return wfs.OpenFile(name(r.Filepath), openFlags(r.Pflags()), 0o666&^h.umask)
+}
+
+// cmdOps maps the methods of Filecmd to the audit ops.
+var cmdOps = map[string]audit.Op{
+	"Setstat": audit.OpSetstat,
+	"Rename":  audit.OpRename,
+	"Rmdir":   audit.OpRmdir,
+	"Remove":  audit.OpRemove,
+	"Mkdir":   audit.OpMkdir,
+	"Symlink": audit.OpSymlink,
+}
+
+// Filecmd implements [sftp.FileCmder].
+func (h *handlers) Filecmd(r *sftp.Request) error {
+	err := h.filecmd(r)
+	if op, ok := cmdOps[r.Method]; ok {
+		rec := audit.Record{Op: op, Path: cleanPath(r.Filepath)}
+		switch r.Method {
+		case "Rename":
+			rec.Target = cleanPath(r.Target)
+		case "Symlink":
+			rec.Path, rec.Target = cleanPath(r.Target), r.Filepath
+		}
+		audit.Emit(h.audit, rec, err)
+	}
+	return err
+}
+
+func (h *handlers) filecmd(r *sftp.Request) error {
+	wfs, err := h.writable()
+	if err != nil {
+		return err
+	}
+	n := name(r.Filepath)
+	switch r.Method {
+	case "Setstat":
+		return setstat(wfs, n, r)
+	case "Rename":
+		// SSH_FXP_RENAME does not overwrite the existing file
+		if _, err := wfs.Lstat(name(r.Target)); err == nil {
+			return os.ErrExist
+		}
+		return wfs.Rename(n, name(r.Target))
+	case "Rmdir":
+		fi, err := wfs.Lstat(n)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return syscall.ENOTDIR
+		}
+		return wfs.Remove(n)
+	case "Remove":
+		fi, err := wfs.Lstat(n)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return syscall.EISDIR
+		}
+		return wfs.Remove(n)
+	case "Mkdir":
+		return wfs.Mkdir(n, 0o777&^h.umask)
+	case "Symlink":
+		// r.Filepath is the target, and r.Target is the link path
+		return wfs.Symlink(r.Filepath, name(r.Target))
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func setstat(wfs vfs.WritableFS, n string, r *sftp.Request) error {
+	attrFlags := r.AttrFlags()
+	attrs := r.Attributes()
+	if attrFlags.Size {
+		if err := wfs.Truncate(n, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if attrFlags.Permissions {
+		if err := wfs.Chmod(n, attrs.FileMode()); err != nil {
+			return err
+		}
+	}
+	if attrFlags.Acmodtime {
+		if err := wfs.Chtimes(n, attrs.AccessTime(), attrs.ModTime()); err != nil {
+			return err
+		}
+	}
+	// UidGid is ignored
+	return nil
+}
+
+// PosixRename implements [sftp.PosixRenameFileCmder].
+func (h *handlers) PosixRename(r *sftp.Request) error {
+	wfs, err := h.writable()
+	if err == nil {
+		err = wfs.Rename(name(r.Filepath), name(r.Target))
+	}
+	audit.Emit(h.audit, audit.Record{Op: audit.OpRename, Path: cleanPath(r.Filepath), Target: cleanPath(r.Target)}, err)
+	return err
+}
+
+// StatVFS implements [sftp.StatVFSFileCmder].
+func (h *handlers) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	sfs, ok := h.fsys.(vfs.StatVFSFS)
+	if !ok {
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+	return sfs.StatVFS(name(r.Filepath))
+}
+
+// Filelist implements [sftp.FileLister].
+func (h *handlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	n := name(r.Filepath)
+	switch r.Method {
+	case "List":
+		entries, err := fs.ReadDir(h.fsys, n)
+		audit.Emit(h.audit, audit.Record{Op: audit.OpList, Path: cleanPath(r.Filepath)}, err)
+		if err != nil {
+			return nil, err
+		}
+		infos := make([]fs.FileInfo, 0, len(entries))
+		for _, ent := range entries {
+			fi, err := ent.Info()
+			if err != nil {
+				// The file may have been removed after ReadDir
+				continue
+			}
+			infos = append(infos, h.mapFileInfo(fi))
+		}
+		return listerAt(infos), nil
+	case "Stat":
+		fi, err := fs.Stat(h.fsys, n)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{h.mapFileInfo(fi)}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// Lstat implements [sftp.LstatFileLister].
+func (h *handlers) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	fi, err := vfs.Lstat(h.fsys, name(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{h.mapFileInfo(fi)}, nil
+}
+
+// Readlink implements [sftp.ReadlinkFileLister].
+func (h *handlers) Readlink(p string) (string, error) {
+	return vfs.Readlink(h.fsys, name(p))
+}
+
+// RealPath implements [sftp.RealPathFileLister].
+func (h *handlers) RealPath(p string) (string, error) {
+	return cleanPath(p), nil
+}
+
+// mapFileInfo applies the UID, the GID, and the umask to fi.
+func (h *handlers) mapFileInfo(fi fs.FileInfo) fs.FileInfo {
+	if h.uid == nil && h.gid == nil && h.umask == 0 {
+		return fi
+	}
+	mfi := &mappedFileInfo{FileInfo: fi, umask: h.umask}
+	uid, gid, ok := sysOwner(fi)
+	if h.uid != nil {
+		uid, ok = *h.uid, true
+	}
+	if h.gid != nil {
+		gid, ok = *h.gid, true
+	}
+	if ok {
+		mfi.owner = &[2]uint32{uid, gid}
+		return &mappedFileInfoUidGid{mfi}
+	}
+	return mfi
+}
+
+// mappedFileInfo masks the mode with umask.
+type mappedFileInfo struct {
+	fs.FileInfo
+	owner *[2]uint32 // UID and GID
+	umask fs.FileMode
+}
+
+func (fi *mappedFileInfo) Mode() fs.FileMode {
+	return fi.FileInfo.Mode() &^ fi.umask
+}
+
+// mappedFileInfoUidGid implements [sftp.FileInfoUidGid].
+type mappedFileInfoUidGid struct {
+	*mappedFileInfo
+}
+
+func (fi *mappedFileInfoUidGid) Uid() uint32 {
+	return fi.owner[0]
+}
+
+func (fi *mappedFileInfoUidGid) Gid() uint32 {
+	return fi.owner[1]
+}
+
+var _ sftp.FileInfoUidGid = (*mappedFileInfoUidGid)(nil)
+
+type listerAt []fs.FileInfo
+
+func (l listerAt) ListAt(ls []fs.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// auditFile counts the bytes transferred, and emits the audit records on Close.
+type auditFile struct {
+	io.ReaderAt
+	io.WriterAt // nil for Fileread
+	io.Closer
+	h         audit.Handler
+	path      string
+	defaultOp audit.Op
+	read      atomic.Int64
+	written   atomic.Int64
+}
+
+func (f *auditFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.ReaderAt.ReadAt(p, off)
+	f.read.Add(int64(n))
+	return n, err
+}
+
+func (f *auditFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.WriterAt == nil {
+		return 0, os.ErrPermission
+	}
+	n, err := f.WriterAt.WriteAt(p, off)
+	f.written.Add(int64(n))
+	return n, err
+}
+
+func (f *auditFile) Close() error {
+	err := f.Closer.Close()
+	audit.EmitTransfer(f.h, f.path, f.read.Load(), f.written.Load(), f.defaultOp, err)
+	return err
+}
@@ -0,0 +1,226 @@
+package sftpserver
+
+import (
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/lima-vm/sshocker/pkg/audit"
+	"github.com/lima-vm/sshocker/pkg/vfs"
+	"github.com/pkg/sftp"
+)
+
+func newTestClient(t *testing.T, fsys fs.FS, opts Options) *sftp.Client {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	server := sftp.NewRequestServer(serverConn, NewHandlersWithOptions(fsys, opts))
+	go server.Serve() //nolint:errcheck
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client
+}
+
+func TestHandlersReadOnlyFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"foo/bar.txt": &fstest.MapFile{Data: []byte("hello"), Mode: 0o644},
+	}
+	client := newTestClient(t, fsys, Options{Readonly: true})
+	f, err := client.Open("/foo/bar.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("expected %q, got %q", "hello", string(b))
+	}
+	infos, err := client.ReadDir("/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Name() != "bar.txt" {
+		t.Errorf("unexpected entries: %v", infos)
+	}
+	if _, err := client.Create("/foo/baz.txt"); err == nil {
+		t.Error("expected an error for writing to a read-only FS")
+	}
+	if _, err := client.Stat("/../../etc/passwd"); err == nil {
+		t.Error("expected an error for a path outside the FS")
+	}
+}
+
+func TestHandlersDirFS(t *testing.T) {
+	dir := t.TempDir()
+	client := newTestClient(t, vfs.DirFS(dir), Options{})
+	if err := client.Mkdir("/sub"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := client.Create("/sub/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PosixRename("/sub/a.txt", "/sub/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" {
+		if err := client.Symlink("b.txt", "/sub/c.txt"); err != nil {
+			t.Fatal(err)
+		}
+		target, err := client.ReadLink("/sub/c.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != "b.txt" {
+			t.Errorf("expected %q, got %q", "b.txt", target)
+		}
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "sub", "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("expected %q, got %q", "hello", string(b))
+	}
+	if err := client.Remove("/sub"); err == nil {
+		t.Error("expected an error for removing a non-empty directory")
+	}
+}
+
+func TestHandlersAudit(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu   sync.Mutex
+		recs []audit.Record
+	)
+	h := func(rec audit.Record) {
+		mu.Lock()
+		defer mu.Unlock()
+		recs = append(recs, audit.Record{Op: rec.Op, Path: rec.Path, Target: rec.Target, Bytes: rec.Bytes, Result: rec.Result})
+	}
+	client := newTestClient(t, vfs.DirFS(dir), Options{Audit: h})
+	f, err := client.Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = client.Create("/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Mkdir("/a.txt"); err == nil {
+		t.Fatal("expected an error for creating an existing directory")
+	}
+	if err := client.PosixRename("/b.txt", "/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	// Close the session so that all the requests are processed
+	_ = client.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []audit.Record{
+		{Op: audit.OpRead, Path: "/a.txt", Bytes: 5, Result: audit.ResultOK},
+		{Op: audit.OpWrite, Path: "/b.txt", Bytes: 2, Result: audit.ResultOK},
+		{Op: audit.OpMkdir, Path: "/a.txt"},
+		{Op: audit.OpRename, Path: "/b.txt", Target: "/c.txt", Result: audit.ResultOK},
+	}
+	if len(recs) != len(expected) {
+		t.Fatalf("expected %d records, got %+v", len(expected), recs)
+	}
+	for i := range expected {
+		if i == 2 {
+			// The error string depends on the OS
+			if recs[i].Op != expected[i].Op || recs[i].Path != expected[i].Path || recs[i].Result == audit.ResultOK {
+				t.Errorf("#%d: expected a failed %+v, got %+v", i, expected[i], recs[i])
+			}
+			continue
+		}
+		if recs[i] != expected[i] {
+			t.Errorf("#%d: expected %+v, got %+v", i, expected[i], recs[i])
+		}
+	}
+}
+
+func TestHandlersOwnership(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	uid, gid := uint32(1234), uint32(5678)
+	client := newTestClient(t, vfs.DirFS(dir), Options{UID: &uid, GID: &gid, Umask: 0o077})
+	fi, err := client.Stat("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("expected mode %o, got %o", 0o600, fi.Mode().Perm())
+	}
+	st := fi.Sys().(*sftp.FileStat)
+	if st.UID != uid || st.GID != gid {
+		t.Errorf("expected %d:%d, got %d:%d", uid, gid, st.UID, st.GID)
+	}
+	infos, err := client.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Sys().(*sftp.FileStat).UID != uid {
+		t.Errorf("unexpected entries: %v", infos)
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+	if err := client.Mkdir("/sub"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := client.Create("/sub/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]fs.FileMode{"sub": 0o700, "sub/b.txt": 0o600} {
+		fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != expected {
+			t.Errorf("%s: expected mode %o, got %o", name, expected, fi.Mode().Perm())
+		}
+	}
+}
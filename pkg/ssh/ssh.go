@@ -7,9 +7,11 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 
+	"github.com/pkg/sftp"
 	"github.com/sirupsen/logrus"
 )
 
@@ -17,6 +19,9 @@ type SSHConfig struct {
 	ConfigFile     string
 	Persist        bool
 	AdditionalArgs []string
+	// ControlPath is the socket of an existing master to be reused.
+	// Ignored when Persist is true.
+	ControlPath string
 }
 
 func (c *SSHConfig) Binary() string {
@@ -35,6 +40,11 @@ func (c *SSHConfig) Args() []string {
 			"-o", "ControlPath=~/.ssh/sshocker-%r@%h:%p-"+strconv.Itoa(os.Getpid()),
 			"-o", "ControlPersist=yes",
 		)
+	} else if c.ControlPath != "" {
+		args = append(args,
+			"-o", "ControlMaster=no",
+			"-o", "ControlPath="+c.ControlPath,
+		)
 	}
 	args = append(args, c.AdditionalArgs...)
 	return args
@@ -60,6 +70,145 @@ func ExitMaster(host string, port int, c *SSHConfig) error {
 	return nil
 }
 
+// FindMaster finds the master of a running sshocker session for the host.
+// Returns an empty string when no master is found.
+func FindMaster(host string, port int, c *SSHConfig) (string, error) {
+	if c == nil {
+		return "", errors.New("got nil SSHConfig")
+	}
+	var baseArgs []string
+	if c.ConfigFile != "" {
+		baseArgs = append(baseArgs, "-F", c.ConfigFile)
+	}
+	baseArgs = append(baseArgs, c.AdditionalArgs...)
+	if port != 0 {
+		baseArgs = append(baseArgs, "-p", strconv.Itoa(port))
+	}
+	// Resolve %r, %h, and %p in the ControlPath
+	args := append(append([]string{}, baseArgs...), "-G", host)
+	cmd := exec.Command(c.Binary(), args...)
+	logrus.Debugf("executing ssh for resolving the config: %s %v", cmd.Path, cmd.Args)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to execute `%s -G %s`: %w", c.Binary(), host, err)
+	}
+	resolved := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		if k, v, ok := strings.Cut(sc.Text(), " "); ok {
+			resolved[k] = v
+		}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	pattern := filepath.Join(home, ".ssh", fmt.Sprintf("sshocker-%s@%s:%s-*", resolved["user"], resolved["hostname"], resolved["port"]))
+	candidates, err := filepath.Glob(pattern)
+	if err != nil {
+		return "", err
+	}
+	for _, cand := range candidates {
+		checkArgs := append(append([]string{}, baseArgs...), "-o", "ControlPath="+cand, "-O", "check", host)
+		checkCmd := exec.Command(c.Binary(), checkArgs...)
+		logrus.Debugf("executing ssh for checking the master: %s %v", checkCmd.Path, checkCmd.Args)
+		if err := checkCmd.Run(); err == nil {
+			return cand, nil
+		}
+	}
+	return "", nil
+}
+
+// StartMaster executes `ssh -f -N` to start the master in the background.
+// c.Persist must be true.
+func StartMaster(host string, port int, c *SSHConfig) error {
+	if c == nil {
+		return errors.New("got nil SSHConfig")
+	}
+	if !c.Persist {
+		return errors.New("ControlPersist is not enabled")
+	}
+	args := c.Args()
+	args = append(args, "-f", "-N")
+	if port != 0 {
+		args = append(args, "-p", strconv.Itoa(port))
+	}
+	args = append(args, host)
+	cmd := exec.Command(c.Binary(), args...)
+	// Do not capture the output, as the backgrounded master keeps holding the stdio.
+	cmd.Stderr = os.Stderr
+	logrus.Debugf("executing ssh for starting the master: %s %v", cmd.Path, cmd.Args)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to execute `%s -f -N -p %d %s`: %w", c.Binary(), port, host, err)
+	}
+	return nil
+}
+
+// Forward executes `ssh -O forward -L forward` to request the master to forward the port.
+// forward conforms to the `ssh -L` syntax.
+func Forward(host string, port int, c *SSHConfig, forward string) error {
+	if c == nil {
+		return errors.New("got nil SSHConfig")
+	}
+	args := c.Args()
+	args = append(args, "-O", "forward", "-L", forward)
+	if port != 0 {
+		args = append(args, "-p", strconv.Itoa(port))
+	}
+	args = append(args, host)
+	cmd := exec.Command(c.Binary(), args...)
+	logrus.Debugf("executing ssh for forwarding %q: %s %v", forward, cmd.Path, cmd.Args)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to execute `%s -O forward -L %s -p %d %s`, out=%q: %w", c.Binary(), forward, port, host, string(out), err)
+	}
+	return nil
+}
+
+// RemoteForward executes `ssh -O forward -R remoteSocket:localSocket` to request the master to forward
+// the remote Unix socket to the local Unix socket.
+// The remote socket is created by sshd with the mode specified by StreamLocalBindMask (default: 0600).
+func RemoteForward(host string, port int, c *SSHConfig, remoteSocket, localSocket string) error {
+	if c == nil {
+		return errors.New("got nil SSHConfig")
+	}
+	forward := remoteSocket + ":" + localSocket
+	args := c.Args()
+	args = append(args, "-O", "forward", "-R", forward)
+	if port != 0 {
+		args = append(args, "-p", strconv.Itoa(port))
+	}
+	args = append(args, host)
+	cmd := exec.Command(c.Binary(), args...)
+	logrus.Debugf("executing ssh for remote forwarding %q: %s %v", forward, cmd.Path, cmd.Args)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to execute `%s -O forward -R %s -p %d %s`, out=%q: %w", c.Binary(), forward, port, host, string(out), err)
+	}
+	return nil
+}
+
+// CancelRemoteForward executes `ssh -O cancel -R remoteSocket:localSocket` to cancel the forward requested by RemoteForward.
+func CancelRemoteForward(host string, port int, c *SSHConfig, remoteSocket, localSocket string) error {
+	if c == nil {
+		return errors.New("got nil SSHConfig")
+	}
+	forward := remoteSocket + ":" + localSocket
+	args := c.Args()
+	args = append(args, "-O", "cancel", "-R", forward)
+	if port != 0 {
+		args = append(args, "-p", strconv.Itoa(port))
+	}
+	args = append(args, host)
+	cmd := exec.Command(c.Binary(), args...)
+	logrus.Debugf("executing ssh for canceling the remote forward %q: %s %v", forward, cmd.Path, cmd.Args)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to execute `%s -O cancel -R %s -p %d %s`, out=%q: %w", c.Binary(), forward, port, host, string(out), err)
+	}
+	return nil
+}
+
 // ParseScriptInterpreter extracts "#!/bin/sh" interpreter string from the script.
 // The result does not contain the "#!" prefix.
 func ParseScriptInterpreter(script string) (string, error) {
@@ -110,3 +259,42 @@ func ExecuteScript(host string, port int, c *SSHConfig, script, scriptName strin
 	}
 	return string(out), stderr.String(), nil
 }
+
+// NewSFTPClient executes `ssh -s HOST sftp` and returns the SFTP client on it.
+// The returned function closes the client and waits for ssh to exit.
+func NewSFTPClient(host string, port int, c *SSHConfig) (*sftp.Client, func() error, error) {
+	if c == nil {
+		return nil, nil, errors.New("got nil SSHConfig")
+	}
+	args := c.Args()
+	if port != 0 {
+		args = append(args, "-p", strconv.Itoa(port))
+	}
+	args = append(args, "-s", host, "sftp")
+	cmd := exec.Command(c.Binary(), args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	logrus.Debugf("executing ssh for SFTP client: %s %v", cmd.Path, cmd.Args)
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	client, err := sftp.NewClientPipe(stdout, stdin)
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, nil, fmt.Errorf("failed to start SFTP client on `%s -s %s sftp`: %w", c.Binary(), host, err)
+	}
+	closeFn := func() error {
+		cErr := client.Close()
+		wErr := cmd.Wait()
+		return errors.Join(cErr, wErr)
+	}
+	return client, closeFn, nil
+}
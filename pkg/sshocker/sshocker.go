@@ -1,15 +1,28 @@
 package sshocker
 
 import (
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/lima-vm/sshocker/pkg/events"
+	"github.com/lima-vm/sshocker/pkg/forward"
+	"github.com/lima-vm/sshocker/pkg/inspect"
+	"github.com/lima-vm/sshocker/pkg/metrics"
 	"github.com/lima-vm/sshocker/pkg/mount"
+	"github.com/lima-vm/sshocker/pkg/notify"
+	"github.com/lima-vm/sshocker/pkg/remotepath"
 	"github.com/lima-vm/sshocker/pkg/reversesshfs"
 	"github.com/lima-vm/sshocker/pkg/ssh"
+	"github.com/lima-vm/sshocker/pkg/syncmount"
+	"github.com/lima-vm/sshocker/pkg/transfer"
+	"github.com/lima-vm/sshocker/pkg/vfs"
 	"github.com/sirupsen/logrus"
 )
 
@@ -23,16 +36,142 @@ type Sshocker struct {
 	SSHFSAdditionalArgs     []string
 	Driver                  reversesshfs.Driver
 	OpensshSftpServerBinary string
+	EventHandler            events.Handler         // Optional
+	CopyOuts                []CopyOut              // Optional
+	CopyOutAlways           bool                   // Copy out even when Command failed
+	OverlayCommit           bool                   // Apply the changes on the overlay mounts to the local directories on exit
+	KeepMountpoint          bool                   // Do not remove the remote mountpoints created for the reverse-sshfs mounts
+	Sandbox                 bool                   // Confine the SFTP server processes to the mount sources
+	Multiplex               bool                   // Serve the plain reverse-sshfs mounts in a single session. See multiplexGroups.
+	Transport               reversesshfs.Transport // Transport of the reverse-sshfs mounts. Empty means reversesshfs.TransportStdio.
+	RemoteSudo              bool                   // Execute sshfs via `sudo -n` for the reverse-sshfs mounts. See reversesshfs.ReverseSSHFS.RemoteSudo.
+	Metrics                 *metrics.Registry      // Optional. Collects the metrics of the mounts, and of the forwards served by forward.Proxy.
+	ForwardProxy            bool                   // Serve the forwards by forward.Proxy instead of `ssh -L`, e.g., for their metrics.
+	ForwardUpstreamLimit    int64                  // Optional. Max bytes per second from the local clients, per forward.
+	ForwardDownstreamLimit  int64                  // Optional. Max bytes per second to the local clients, per forward.
+	mu                      sync.Mutex             // Protects Mounts and requestedDestinations for Inspect
+	requestedDestinations   map[int]string         // The destinations of Mounts before resolveDestinations, by the index
+}
+
+// CopyOut specifies the remote files to be copied out after executing the command.
+type CopyOut struct {
+	RemoteGlob string
+	LocalDir   string
+}
+
+func (x *Sshocker) emit(ev events.Event) {
+	ev.Host = x.Host
+	ev.Port = x.Port
+	events.Emit(x.EventHandler, ev)
+}
+
+// useForwardProxy returns true if the forwards have to be served by forward.Proxy instead of `ssh -L`.
+func (x *Sshocker) useForwardProxy() bool {
+	return x.ForwardProxy || x.ForwardUpstreamLimit > 0 || x.ForwardDownstreamLimit > 0
+}
+
+// Inspect returns the state of the session for `sshocker inspect`.
+// Inspect may be called concurrently with Run.
+func (x *Sshocker) Inspect() inspect.State {
+	st := inspect.State{
+		PID:      os.Getpid(),
+		Host:     x.Host,
+		Port:     x.Port,
+		Command:  x.Command,
+		Mounts:   []inspect.Mount{},
+		Forwards: append([]string{}, x.LForwards...),
+		Metrics:  x.Metrics.Snapshot(),
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for i, m := range x.Mounts {
+		typ := "reverse-sshfs"
+		if m.Type == mount.MountTypeSync {
+			typ = "sync"
+		}
+		st.Mounts = append(st.Mounts, inspect.Mount{
+			Type:                 typ,
+			Source:               m.Source,
+			Destination:          m.Destination,
+			RequestedDestination: x.requestedDestinations[i],
+			Readonly:             m.Readonly,
+		})
+	}
+	return st
+}
+
+// resolveDestinations resolves "~", "$HOME", and the templates in the mount destinations.
+// The remote host is queried only once, and only when needed.
+func (x *Sshocker) resolveDestinations() error {
+	var vars *remotepath.Vars
+	for i := range x.Mounts {
+		m := &x.Mounts[i]
+		if !remotepath.NeedsResolve(m.Destination) {
+			continue
+		}
+		if vars == nil {
+			var err error
+			vars, err = remotepath.Query(x.Host, x.Port, x.SSHConfig)
+			if err != nil {
+				return fmt.Errorf("failed to query the remote home directory for resolving %q: %w", m.Destination, err)
+			}
+		}
+		resolved, err := remotepath.Resolve(m.Destination, *vars)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Resolved %q (remote) to %q", m.Destination, resolved)
+		x.mu.Lock()
+		if x.requestedDestinations == nil {
+			x.requestedDestinations = make(map[int]string)
+		}
+		x.requestedDestinations[i] = m.Destination
+		m.Destination = resolved
+		x.mu.Unlock()
+	}
+	return nil
+}
+
+// needsMaster returns true when the master has to be started explicitly before the main ssh,
+// i.e., when the events are emitted, or when the forwards are requested to the master with `ssh -O forward`.
+func (x *Sshocker) needsMaster() bool {
+	return x.EventHandler != nil || (len(x.LForwards) > 0 && !x.useForwardProxy())
 }
 
 func (x *Sshocker) Run() error {
 	if x.SSHConfig == nil {
 		return errors.New("got nil SSHConfig")
 	}
+	if x.SSHConfig.Persist {
+		masterStarted := x.needsMaster()
+		if masterStarted {
+			// Start the master explicitly, so that the forwards can be set up on the master
+			// and the events can be emitted.
+			// Otherwise the master is started implicitly by the first ssh (ControlMaster=auto).
+			if err := ssh.StartMaster(x.Host, x.Port, x.SSHConfig); err != nil {
+				return err
+			}
+			x.emit(events.Event{Type: events.TypeMasterStarted})
+		}
+		defer func() {
+			if emErr := ssh.ExitMaster(x.Host, x.Port, x.SSHConfig); emErr != nil {
+				logrus.WithError(emErr).Error("failed to exit the master")
+				return
+			}
+			if masterStarted {
+				x.emit(events.Event{Type: events.TypeMasterExited})
+			}
+		}()
+	}
+	if err := x.resolveDestinations(); err != nil {
+		return err
+	}
 	sshBinary := x.SSHConfig.Binary()
 	args := x.SSHConfig.Args()
-	for _, l := range x.LForwards {
-		args = append(args, "-L", l)
+	if !x.SSHConfig.Persist && !x.useForwardProxy() {
+		for _, l := range x.LForwards {
+			args = append(args, "-L", l)
+		}
 	}
 	if x.Port != 0 {
 		args = append(args, "-p", strconv.Itoa(x.Port))
@@ -46,9 +185,49 @@ func (x *Sshocker) Run() error {
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Env = os.Environ()
-	for _, m := range x.Mounts {
+	mounts := x.Mounts
+	if x.Multiplex {
+		if err := x.validateMultiplex(); err != nil {
+			return err
+		}
+		var groups [][]mount.Mount
+		groups, mounts = multiplexGroups(x.Mounts)
+		for _, g := range groups {
+			rsf, err := x.startMultiplexed(g)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if cErr := rsf.Close(); cErr != nil {
+					logrus.WithError(cErr).Warnf("failed to unmount %q (remote)", rsf.RemotePath)
+				}
+			}()
+		}
+	}
+	for _, m := range mounts {
+		mountEvent := func(typ events.Type, err error) {
+			ev := events.Event{
+				Type:       typ,
+				LocalPath:  m.Source,
+				RemotePath: m.Destination,
+			}
+			if err != nil {
+				ev.Error = err.Error()
+			}
+			x.emit(ev)
+		}
+		if fi, err := os.Stat(m.Source); err == nil && fi.Mode().IsRegular() {
+			// A single file is supported only by the reverse-sshfs mounts without overlay and notify
+			if m.Type != mount.MountTypeReverseSSHFS || m.Overlay || m.Notify {
+				return fmt.Errorf("cannot mount %q (local): \"type=sync\", \"overlay\", and \"notify\" require a directory", m.Source)
+			}
+		}
 		switch m.Type {
 		case mount.MountTypeReverseSSHFS:
+			sshfsArgs, sshArgs, err := x.presetArgs(m)
+			if err != nil {
+				return err
+			}
 			rsf := &reversesshfs.ReverseSSHFS{
 				Driver:                  x.Driver,
 				OpensshSftpServerBinary: x.OpensshSftpServerBinary,
@@ -58,35 +237,365 @@ func (x *Sshocker) Run() error {
 				Port:                    x.Port,
 				RemotePath:              m.Destination,
 				Readonly:                m.Readonly,
-				SSHFSAdditionalArgs:     x.SSHFSAdditionalArgs,
+				Include:                 m.Include,
+				Exclude:                 m.Exclude,
+				Gitignore:               m.Gitignore,
+				AuditLog:                m.AuditLog,
+				AuditLogMaxSize:         m.AuditLogMaxSize,
+				AuditLogMaxBackups:      m.AuditLogMaxBackups,
+				SSHFSAdditionalArgs:     sshfsArgs,
+				SSHAdditionalArgs:       sshArgs,
+				KeepMountpoint:          x.KeepMountpoint,
+				Sandbox:                 x.Sandbox,
+				Transport:               x.Transport,
+				EventHandler:            x.EventHandler,
+				Metrics:                 x.Metrics.NewMount(m.Source, m.Destination),
+				ReadLimit:               m.ReadLimit,
+				WriteLimit:              m.WriteLimit,
+				UIDMap:                  m.UIDMap,
+				GIDMap:                  m.GIDMap,
+				Umask:                   m.Umask,
+				Squash:                  m.Squash,
+				AllowOther:              m.AllowOther,
+				RemoteSudo:              x.RemoteSudo,
+				DeniedRequests:          m.SFTPDeny,
+				AllowedRequests:         m.SFTPAllow,
+			}
+			if m.Overlay {
+				upperDir, err := os.MkdirTemp("", "sshocker-overlay-")
+				if err != nil {
+					return err
+				}
+				lower, err := vfs.OpenRootFS(m.Source)
+				if err != nil {
+					_ = os.RemoveAll(upperDir)
+					return err
+				}
+				defer lower.Close()
+				upper, err := vfs.OpenRootFS(upperDir)
+				if err != nil {
+					_ = os.RemoveAll(upperDir)
+					return err
+				}
+				defer upper.Close()
+				ov := vfs.NewOverlayFS(lower, upper)
+				rsf.FS = ov
+				// Registered before rsf.Close, so that it runs after unmounting
+				defer x.closeOverlay(ov, m.Source, upperDir)
 			}
+			mountEvent(events.TypeMountStarting, nil)
 			if err := rsf.Prepare(); err != nil {
-				return fmt.Errorf("failed to prepare mounting %q (local) onto %q (remote): %w", rsf.LocalPath, rsf.RemotePath, err)
+				err = fmt.Errorf("failed to prepare mounting %q (local) onto %q (remote): %w", rsf.LocalPath, rsf.RemotePath, err)
+				mountEvent(events.TypeMountFailed, err)
+				return err
 			}
 			if err := rsf.Start(); err != nil {
-				return fmt.Errorf("failed to mount %q (local) onto %q (remote): %w", rsf.LocalPath, rsf.RemotePath, err)
+				err = fmt.Errorf("failed to mount %q (local) onto %q (remote): %w", rsf.LocalPath, rsf.RemotePath, err)
+				mountEvent(events.TypeMountFailed, err)
+				return err
 			}
+			mountEvent(events.TypeMountReady, nil)
 			defer func() {
 				if cErr := rsf.Close(); cErr != nil {
 					logrus.WithError(cErr).Warnf("failed to unmount %q (remote)", rsf.RemotePath)
 				}
 			}()
+			if m.Notify {
+				n := &notify.Notifier{
+					SSHConfig:  x.SSHConfig,
+					LocalPath:  m.Source,
+					Host:       x.Host,
+					Port:       x.Port,
+					RemotePath: m.Destination,
+					// The hidden paths do not need notifications
+					Ignore: append(append([]string{}, m.NotifyIgnore...), m.Exclude...),
+				}
+				if err := n.Start(); err != nil {
+					return fmt.Errorf("failed to watch %q (local) for notifications: %w", n.LocalPath, err)
+				}
+				defer func() {
+					if cErr := n.Close(); cErr != nil {
+						logrus.WithError(cErr).Warnf("failed to stop watching %q (local)", n.LocalPath)
+					}
+				}()
+			}
+		case mount.MountTypeSync:
+			sm := &syncmount.Sync{
+				SSHConfig:  x.SSHConfig,
+				LocalPath:  m.Source,
+				Host:       x.Host,
+				Port:       x.Port,
+				RemotePath: m.Destination,
+				Exclude:    m.Exclude,
+				PullBack:   m.PullBack,
+			}
+			mountEvent(events.TypeMountStarting, nil)
+			if err := sm.Start(); err != nil {
+				err = fmt.Errorf("failed to sync %q (local) onto %q (remote): %w", sm.LocalPath, sm.RemotePath, err)
+				mountEvent(events.TypeMountFailed, err)
+				return err
+			}
+			mountEvent(events.TypeMountReady, nil)
+			defer func() {
+				if cErr := sm.Close(); cErr != nil {
+					logrus.WithError(cErr).Warnf("failed to stop syncing %q (remote)", sm.RemotePath)
+				}
+				mountEvent(events.TypeMountClosed, nil)
+			}()
 		case mount.MountTypeInvalid:
 			return fmt.Errorf("invalid mount type %v", m.Type)
 		default:
 			return fmt.Errorf("unknown mount type %v", m.Type)
 		}
 	}
-	defer func() {
-		if x.SSHConfig.Persist {
-			if emErr := ssh.ExitMaster(x.Host, x.Port, x.SSHConfig); emErr != nil {
-				logrus.WithError(emErr).Error("failed to exit the master")
+	switch {
+	case x.useForwardProxy():
+		for _, l := range x.LForwards {
+			p := &forward.Proxy{
+				SSHConfig: x.SSHConfig,
+				Host:      x.Host,
+				Port:      x.Port,
+				Forward:   l,
+				Metrics:   x.Metrics.NewForward(l),
+				// Each forward has its own limits
+				UpstreamLimit:   x.ForwardUpstreamLimit,
+				DownstreamLimit: x.ForwardDownstreamLimit,
 			}
+			if err := p.Start(); err != nil {
+				return err
+			}
+			defer func() {
+				if cErr := p.Close(); cErr != nil {
+					logrus.WithError(cErr).Warnf("failed to stop forwarding %q", l)
+				}
+			}()
+			x.emit(events.Event{Type: events.TypeForwardReady, Forward: l})
 		}
-	}()
+	case x.SSHConfig.Persist:
+		for _, l := range x.LForwards {
+			if err := ssh.Forward(x.Host, x.Port, x.SSHConfig, l); err != nil {
+				return err
+			}
+			x.emit(events.Event{Type: events.TypeForwardReady, Forward: l})
+		}
+	}
 	logrus.Debugf("executing main SSH: %s %v", cmd.Path, cmd.Args)
-	if err := cmd.Run(); err != nil {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if !x.SSHConfig.Persist && !x.useForwardProxy() {
+		// Without the master, the forwards are set up by the main SSH itself,
+		// and their readiness cannot be known precisely.
+		for _, l := range x.LForwards {
+			x.emit(events.Event{Type: events.TypeForwardReady, Forward: l})
+		}
+	}
+	err := cmd.Wait()
+	exitCode := cmd.ProcessState.ExitCode()
+	ev := events.Event{Type: events.TypeCommandExited, ExitCode: &exitCode}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	x.emit(ev)
+	if len(x.CopyOuts) > 0 {
+		if err == nil || x.CopyOutAlways {
+			if coErr := x.copyOut(); coErr != nil {
+				return errors.Join(err, coErr)
+			}
+		} else {
+			logrus.Warn("Skipping copying out, as the command failed")
+		}
+	}
+	return err
+}
+
+func (x *Sshocker) copyOut() error {
+	client, closeClient, err := ssh.NewSFTPClient(x.Host, x.Port, x.SSHConfig)
+	if err != nil {
 		return err
 	}
+	defer func() {
+		if cErr := closeClient(); cErr != nil {
+			logrus.WithError(cErr).Warn("failed to close the SFTP client")
+		}
+	}()
+	var (
+		total transfer.Stat
+		errs  []error
+	)
+	begin := time.Now()
+	for _, co := range x.CopyOuts {
+		st, err := transfer.CopyOut(client, co.RemoteGlob, co.LocalDir)
+		total.Files += st.Files
+		total.Bytes += st.Bytes
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to copy out %q (remote) to %q (local): %w", co.RemoteGlob, co.LocalDir, err))
+			continue
+		}
+		logrus.Infof("Copied out %q (remote) to %q (local): %v", co.RemoteGlob, co.LocalDir, st)
+	}
+	logrus.Infof("Copied out %v in total, in %v", total, time.Since(begin).Round(time.Millisecond))
+	return errors.Join(errs...)
+}
+
+// closeOverlay reports the changes made on the overlay, commits them to localPath
+// if x.OverlayCommit is set, and removes upperDir.
+func (x *Sshocker) closeOverlay(ov *vfs.OverlayFS, localPath, upperDir string) {
+	defer func() {
+		if err := os.RemoveAll(upperDir); err != nil {
+			logrus.WithError(err).Warnf("failed to remove the overlay directory %q", upperDir)
+		}
+	}()
+	changes, err := ov.Changes()
+	if err != nil {
+		logrus.WithError(err).Warnf("failed to list the changes on the overlay of %q (local)", localPath)
+		return
+	}
+	if len(changes) == 0 {
+		return
+	}
+	for _, c := range changes {
+		logrus.Infof("overlay %q (local): %s", localPath, c)
+	}
+	if !x.OverlayCommit {
+		logrus.Infof("discarded %d changes on the overlay of %q (local) (hint: use --overlay-commit to apply them)", len(changes), localPath)
+		return
+	}
+	if err := ov.Commit(); err != nil {
+		logrus.WithError(err).Warnf("failed to commit the changes on the overlay of %q (local)", localPath)
+		return
+	}
+	logrus.Infof("committed %d changes on the overlay of %q (local)", len(changes), localPath)
+}
+
+// multiplexable returns true if m can be multiplexed with other mounts.
+// The mounts with the options that need their own sessions are not multiplexable.
+func multiplexable(m mount.Mount) bool {
+	if m.Type != mount.MountTypeReverseSSHFS || m.Overlay || m.Notify || len(m.Include) > 0 || len(m.Exclude) > 0 || m.Gitignore ||
+		m.AuditLog != "" || m.ReadLimit != 0 || m.WriteLimit != 0 ||
+		m.UIDMap != "" || m.GIDMap != "" || m.Umask != "" || m.Squash || len(m.SFTPDeny) > 0 || len(m.SFTPAllow) > 0 || m.Preset != "" || m.AllowOther {
+		return false
+	}
+	fi, err := os.Stat(m.Source)
+	return err == nil && fi.IsDir()
+}
+
+// presetArgs returns the sshfs and ssh arguments for the preset of m.
+// The preset is layered under x.SSHFSAdditionalArgs, so that the explicit options take precedence.
+func (x *Sshocker) presetArgs(m mount.Mount) ([]string, []string, error) {
+	if m.Preset == "" {
+		return x.SSHFSAdditionalArgs, nil, nil
+	}
+	p, ok := reversesshfs.LookupPreset(m.Preset)
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown preset %q for %q (local), should be one of %v", m.Preset, m.Source, reversesshfs.PresetNames())
+	}
+	return append(p.SSHFSArgs(), x.SSHFSAdditionalArgs...), p.SSHArgs(), nil
+}
+
+// validateMultiplex rejects the drivers that would serve the common ancestor of the multiplexed mounts
+// (e.g., the home directory) without the sandbox.
+func (x *Sshocker) validateMultiplex() error {
+	driverName, _ := reversesshfs.ParseDriver(x.Driver)
+	if driverName == "" || driverName == reversesshfs.DriverAuto {
+		// Chosen as DriverBuiltin for the multiplexed mounts
+		return nil
+	}
+	driverInfo, ok := reversesshfs.LookupDriver(driverName)
+	if !ok {
+		return fmt.Errorf("unknown driver %q, should be one of %v", driverName, reversesshfs.Drivers())
+	}
+	if !driverInfo.SupportsFS && !(x.Sandbox && driverInfo.SupportsSandbox) {
+		return fmt.Errorf("--multiplex with driver %q requires --sandbox, as the driver serves the common ancestor of the mounts", driverName)
+	}
 	return nil
 }
+
+// multiplexGroups splits mounts into the groups to be multiplexed, and the rest.
+// The read-only mounts and the read-write mounts are multiplexed in separate sessions,
+// so that the read-only mounts are enforced by the SFTP server regardless of the driver.
+// A group needs two or more mounts.
+func multiplexGroups(mounts []mount.Mount) ([][]mount.Mount, []mount.Mount) {
+	var rw, ro, rest []mount.Mount
+	for _, m := range mounts {
+		switch {
+		case !multiplexable(m):
+			rest = append(rest, m)
+		case m.Readonly:
+			ro = append(ro, m)
+		default:
+			rw = append(rw, m)
+		}
+	}
+	var groups [][]mount.Mount
+	for _, g := range [][]mount.Mount{rw, ro} {
+		if len(g) >= 2 {
+			groups = append(groups, g)
+		} else {
+			rest = append(rest, g...)
+		}
+	}
+	return groups, rest
+}
+
+// multiplexMountpoint returns the hidden remote directory to mount the multiplexed session of mounts,
+// next to the destination of the first mount, e.g., "/mnt/.sshocker-mux-0123456789ab".
+// The name is derived from the mounts, so that a stale mount left by a crashed sshocker can be detected.
+func multiplexMountpoint(mounts []mount.Mount) string {
+	h := sha256.New()
+	for _, m := range mounts {
+		fmt.Fprintf(h, "%s\x00%s\x00%v\x00", m.Source, m.Destination, m.Readonly)
+	}
+	return path.Join(path.Dir(mounts[0].Destination), fmt.Sprintf(".sshocker-mux-%x", h.Sum(nil)[:6]))
+}
+
+// startMultiplexed mounts the group of mounts in a single session.
+func (x *Sshocker) startMultiplexed(mounts []mount.Mount) (*reversesshfs.ReverseSSHFS, error) {
+	rsf := &reversesshfs.ReverseSSHFS{
+		Driver:                  x.Driver,
+		OpensshSftpServerBinary: x.OpensshSftpServerBinary,
+		SSHConfig:               x.SSHConfig,
+		Host:                    x.Host,
+		Port:                    x.Port,
+		RemotePath:              multiplexMountpoint(mounts),
+		Readonly:                mounts[0].Readonly,
+		SSHFSAdditionalArgs:     x.SSHFSAdditionalArgs,
+		KeepMountpoint:          x.KeepMountpoint,
+		Sandbox:                 x.Sandbox,
+		Transport:               x.Transport,
+		RemoteSudo:              x.RemoteSudo,
+		EventHandler:            x.EventHandler,
+		// The metrics are collected per session
+		Metrics: x.Metrics.NewMount(mounts[0].Source, multiplexMountpoint(mounts)),
+	}
+	for _, m := range mounts {
+		rsf.Submounts = append(rsf.Submounts, reversesshfs.Submount{LocalPath: m.Source, RemotePath: m.Destination})
+	}
+	mountEvent := func(typ events.Type, err error) {
+		for _, m := range mounts {
+			ev := events.Event{
+				Type:       typ,
+				LocalPath:  m.Source,
+				RemotePath: m.Destination,
+			}
+			if err != nil {
+				ev.Error = err.Error()
+			}
+			x.emit(ev)
+		}
+	}
+	logrus.Infof("Multiplexing %d mounts in %q (remote)", len(mounts), rsf.RemotePath)
+	mountEvent(events.TypeMountStarting, nil)
+	if err := rsf.Prepare(); err != nil {
+		err = fmt.Errorf("failed to prepare the multiplexed mount %q (remote): %w", rsf.RemotePath, err)
+		mountEvent(events.TypeMountFailed, err)
+		return nil, err
+	}
+	if err := rsf.Start(); err != nil {
+		err = fmt.Errorf("failed to start the multiplexed mount %q (remote): %w", rsf.RemotePath, err)
+		mountEvent(events.TypeMountFailed, err)
+		return nil, err
+	}
+	mountEvent(events.TypeMountReady, nil)
+	return rsf, nil
+}
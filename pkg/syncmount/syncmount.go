@@ -0,0 +1,319 @@
+// Package syncmount implements the sync-based mount, as an alternative to reverse sshfs.
+//
+// The local directory is uploaded over SFTP at startup, and the local changes are uploaded incrementally.
+// Optionally, the remote changes are pulled back on exit.
+// Unlike reverse sshfs, FUSE is not needed on the remote.
+package syncmount
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lima-vm/sshocker/pkg/fswatch"
+	"github.com/lima-vm/sshocker/pkg/pathfilter"
+	"github.com/lima-vm/sshocker/pkg/ssh"
+	"github.com/lima-vm/sshocker/pkg/transfer"
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+)
+
+// Conflict is a file modified on both the local and the remote.
+type Conflict struct {
+	Path   string // Slash-separated path relative to the mount
+	Reason string
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s: %s", c.Path, c.Reason)
+}
+
+// state is the state of a file at the time of the last synchronization.
+type state struct {
+	localSize   int64
+	localMtime  int64 // Unix time
+	remoteSize  int64
+	remoteMtime int64 // Unix time
+}
+
+// newSFTPClient is replaced in the tests.
+var newSFTPClient = ssh.NewSFTPClient
+
+type Sync struct {
+	*ssh.SSHConfig
+	LocalPath  string
+	Host       string
+	Port       int
+	RemotePath string
+	Exclude    []string // gitignore-style patterns
+	PullBack   bool     // Pull back the remote changes on Close
+
+	client      *sftp.Client
+	closeClient func() error
+	filter      *pathfilter.Filter
+	watcher     *fswatch.Watcher
+	mu          sync.Mutex
+	states      map[string]state
+	conflicts   []Conflict
+}
+
+func (s *Sync) Start() error {
+	if !filepath.IsAbs(s.LocalPath) {
+		return fmt.Errorf("unexpected relative path: %q", s.LocalPath)
+	}
+	if !path.IsAbs(s.RemotePath) {
+		return fmt.Errorf("unexpected relative path: %q", s.RemotePath)
+	}
+	var err error
+	s.filter, err = pathfilter.New(s.Exclude)
+	if err != nil {
+		return err
+	}
+	s.states = make(map[string]state)
+	s.client, s.closeClient, err = newSFTPClient(s.Host, s.Port, s.SSHConfig)
+	if err != nil {
+		return err
+	}
+	if err := s.client.MkdirAll(s.RemotePath); err != nil {
+		_ = s.closeClient()
+		return fmt.Errorf("failed to mkdir %q (remote): %w", s.RemotePath, err)
+	}
+	begin := time.Now()
+	var uploaded int
+	err = filepath.WalkDir(s.LocalPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.LocalPath, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if s.filter.Match(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ok, err := s.push(rel)
+		if ok {
+			uploaded++
+		}
+		return err
+	})
+	if err != nil {
+		_ = s.closeClient()
+		return fmt.Errorf("failed to upload %q (local) onto %q (remote): %w", s.LocalPath, s.RemotePath, err)
+	}
+	logrus.Infof("Uploaded %d files from %q (local) onto %q (remote) in %v", uploaded, s.LocalPath, s.RemotePath, time.Since(begin).Round(time.Millisecond))
+	s.watcher = &fswatch.Watcher{
+		Root:     s.LocalPath,
+		Filter:   s.filter,
+		Callback: s.pushChanges,
+	}
+	if err := s.watcher.Start(); err != nil {
+		_ = s.closeClient()
+		return err
+	}
+	return nil
+}
+
+func (s *Sync) pushChanges(paths []string) {
+	for _, rel := range paths {
+		if _, err := s.push(rel); err != nil {
+			logrus.WithError(err).Warnf("failed to sync %q onto %q (remote)", rel, s.RemotePath)
+		}
+	}
+}
+
+func (s *Sync) addConflict(rel, reason string) {
+	c := Conflict{Path: rel, Reason: reason}
+	logrus.Warnf("Conflict in %q (remote): %s", s.RemotePath, c)
+	s.conflicts = append(s.conflicts, c)
+}
+
+// push pushes the local path to the remote.
+// Returns true if a file was transferred.
+func (s *Sync) push(rel string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lp := filepath.Join(s.LocalPath, filepath.FromSlash(rel))
+	rp := path.Join(s.RemotePath, rel)
+	lst, err := os.Lstat(lp)
+	if errors.Is(err, os.ErrNotExist) {
+		for k := range s.states {
+			if k == rel || strings.HasPrefix(k, rel+"/") {
+				delete(s.states, k)
+			}
+		}
+		if err := s.client.RemoveAll(rp); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, fmt.Errorf("failed to remove %q (remote): %w", rp, err)
+		}
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	switch {
+	case lst.IsDir():
+		if err := s.client.MkdirAll(rp); err != nil {
+			return false, fmt.Errorf("failed to mkdir %q (remote): %w", rp, err)
+		}
+		return false, s.client.Chmod(rp, lst.Mode().Perm())
+	case lst.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(lp)
+		if err != nil {
+			return false, err
+		}
+		if existing, err := s.client.ReadLink(rp); err == nil && existing == target {
+			return false, nil
+		}
+		_ = s.client.Remove(rp)
+		return false, s.client.Symlink(target, rp)
+	case lst.Mode().IsRegular():
+		rst, rErr := s.client.Lstat(rp)
+		if rErr == nil && rst.Mode().IsRegular() && rst.Size() == lst.Size() && rst.ModTime().Unix() == lst.ModTime().Unix() {
+			s.states[rel] = newState(lst, rst)
+			return false, nil
+		}
+		if st, ok := s.states[rel]; ok && rErr == nil && (rst.Size() != st.remoteSize || rst.ModTime().Unix() != st.remoteMtime) {
+			s.addConflict(rel, "modified on both the local and the remote, overwritten with the local version")
+		}
+		if rErr == nil && rst.IsDir() {
+			if err := s.client.RemoveAll(rp); err != nil {
+				return false, fmt.Errorf("failed to remove %q (remote): %w", rp, err)
+			}
+		}
+		if _, err := transfer.Upload(s.client, lp, rp); err != nil {
+			return false, err
+		}
+		rst, err = s.client.Lstat(rp)
+		if err != nil {
+			return true, fmt.Errorf("failed to stat %q (remote): %w", rp, err)
+		}
+		s.states[rel] = newState(lst, rst)
+		return true, nil
+	default:
+		logrus.Debugf("ignoring special file %q", lp)
+		return false, nil
+	}
+}
+
+func newState(lst, rst os.FileInfo) state {
+	return state{
+		localSize:   lst.Size(),
+		localMtime:  lst.ModTime().Unix(),
+		remoteSize:  rst.Size(),
+		remoteMtime: rst.ModTime().Unix(),
+	}
+}
+
+// pull pulls back the remote changes to the local.
+// Files modified on both sides are not pulled back, and reported as conflicts.
+// Files removed on the remote are not removed on the local.
+// The local paths are resolved in os.Root, so that the local symbolic links
+// (e.g., pushed "lnk -> ~/.ssh" replaced with a directory on the remote) are never followed to the outside of LocalPath.
+func (s *Sync) pull() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	root, err := os.OpenRoot(s.LocalPath)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	var pulled int
+	seen := make(map[string]struct{})
+	walker := s.client.Walk(s.RemotePath)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			logrus.WithError(err).Warnf("failed to walk %q (remote)", walker.Path())
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), s.RemotePath), "/")
+		if rel == "" {
+			continue
+		}
+		rst := walker.Stat()
+		if s.filter.Match(rel, rst.IsDir()) {
+			if rst.IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+		seen[rel] = struct{}{}
+		lp := filepath.FromSlash(rel)
+		switch {
+		case rst.IsDir():
+			if err := root.MkdirAll(lp, rst.Mode().Perm()); err != nil {
+				return err
+			}
+		case rst.Mode().IsRegular():
+			st, known := s.states[rel]
+			if known && rst.Size() == st.remoteSize && rst.ModTime().Unix() == st.remoteMtime {
+				continue
+			}
+			lst, lErr := root.Lstat(lp)
+			if lErr == nil {
+				if !known {
+					s.addConflict(rel, "created on both the local and the remote, not pulled back")
+					continue
+				}
+				if lst.Size() != st.localSize || lst.ModTime().Unix() != st.localMtime {
+					s.addConflict(rel, "modified on both the local and the remote, not pulled back")
+					continue
+				}
+			}
+			if _, err := transfer.DownloadRoot(s.client, walker.Path(), root, lp); err != nil {
+				return err
+			}
+			pulled++
+		default:
+			logrus.Debugf("ignoring non-regular file %q (remote)", walker.Path())
+		}
+	}
+	for rel := range s.states {
+		if _, ok := seen[rel]; !ok {
+			logrus.Infof("%q was removed on the remote, but not removed on the local", rel)
+		}
+	}
+	logrus.Infof("Pulled back %d files from %q (remote) onto %q (local)", pulled, s.RemotePath, s.LocalPath)
+	return nil
+}
+
+// Conflicts returns the conflicts detected so far.
+func (s *Sync) Conflicts() []Conflict {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Conflict(nil), s.conflicts...)
+}
+
+func (s *Sync) Close() error {
+	var errs []error
+	if s.watcher != nil {
+		if err := s.watcher.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if s.client != nil {
+		if s.PullBack {
+			if err := s.pull(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to pull back %q (remote) onto %q (local): %w", s.RemotePath, s.LocalPath, err))
+			}
+		}
+		if conflicts := s.Conflicts(); len(conflicts) > 0 {
+			logrus.Warnf("%d conflicts were detected in %q (remote)", len(conflicts), s.RemotePath)
+		}
+		if err := s.closeClient(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,181 @@
+package syncmount
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/lima-vm/sshocker/pkg/ssh"
+	"github.com/pkg/sftp"
+)
+
+// newTestSync returns a Sync between the temporary local and remote directories,
+// with an in-process SFTP server for the remote.
+func newTestSync(t *testing.T, files map[string]string) (*Sync, string, string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the remote paths are Unix paths")
+	}
+	orig := newSFTPClient
+	t.Cleanup(func() { newSFTPClient = orig })
+	newSFTPClient = func(string, int, *ssh.SSHConfig) (*sftp.Client, func() error, error) {
+		serverConn, clientConn := net.Pipe()
+		server, err := sftp.NewServer(serverConn)
+		if err != nil {
+			return nil, nil, err
+		}
+		go server.Serve() //nolint:errcheck
+		client, err := sftp.NewClientPipe(clientConn, clientConn)
+		if err != nil {
+			_ = server.Close()
+			return nil, nil, err
+		}
+		return client, func() error {
+			_ = client.Close()
+			return server.Close()
+		}, nil
+	}
+	localDir, remoteDir := t.TempDir(), filepath.Join(t.TempDir(), "remote")
+	for name, content := range files {
+		writeFile(t, filepath.Join(localDir, filepath.FromSlash(name)), content)
+	}
+	s := &Sync{
+		SSHConfig:  &ssh.SSHConfig{},
+		LocalPath:  localDir,
+		RemotePath: remoteDir,
+		Exclude:    []string{".env"},
+		PullBack:   true,
+	}
+	return s, localDir, remoteDir
+}
+
+func writeFile(t *testing.T, p, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Distinguishable from the modification times set by writeRemote, as they are compared in seconds
+	mtime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, p string) string {
+	t.Helper()
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestSyncPushPull(t *testing.T) {
+	s, localDir, remoteDir := newTestSync(t, map[string]string{
+		"a.txt":     "a",
+		"dir/b.txt": "b",
+		".env":      "SECRET=1",
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(remoteDir, "dir", "b.txt")); got != "b" {
+		t.Errorf("expected %q, got %q", "b", got)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, ".env")); !os.IsNotExist(err) {
+		t.Errorf("the excluded file should not be pushed: %v", err)
+	}
+
+	// The remote changes, to be pulled back
+	writeRemote(t, filepath.Join(remoteDir, "dir", "b.txt"), "modified on the remote")
+	writeRemote(t, filepath.Join(remoteDir, "new", "c.txt"), "created on the remote")
+	writeRemote(t, filepath.Join(remoteDir, ".env"), "SECRET=2")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"a.txt":     "a",
+		"dir/b.txt": "modified on the remote",
+		"new/c.txt": "created on the remote",
+		".env":      "SECRET=1",
+	} {
+		if got := readFile(t, filepath.Join(localDir, filepath.FromSlash(name))); got != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, got)
+		}
+	}
+	if conflicts := s.Conflicts(); len(conflicts) != 0 {
+		t.Errorf("unexpected conflicts: %v", conflicts)
+	}
+}
+
+// writeRemote writes the remote file with a modification time different from the pushed one.
+func writeRemote(t *testing.T, p, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncConflict(t *testing.T) {
+	s, localDir, remoteDir := newTestSync(t, map[string]string{
+		"a.txt": "a",
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	writeRemote(t, filepath.Join(remoteDir, "a.txt"), "modified on the remote")
+	local := filepath.Join(localDir, "a.txt")
+	if err := os.WriteFile(local, []byte("modified on the local"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(2 * time.Hour)
+	if err := os.Chtimes(local, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Either pushed by the watcher (overwritten with the local version), or not pulled back on Close
+	conflicts := s.Conflicts()
+	if len(conflicts) != 1 || conflicts[0].Path != "a.txt" {
+		t.Errorf("expected a conflict for a.txt, got %v", conflicts)
+	}
+	if got := readFile(t, local); got != "modified on the local" {
+		t.Errorf("the local file should not be overwritten, got %q", got)
+	}
+}
+
+func TestSyncPullSymlinkEscape(t *testing.T) {
+	s, localDir, remoteDir := newTestSync(t, nil)
+	outsideDir := t.TempDir()
+	if err := os.Symlink(outsideDir, filepath.Join(localDir, "lnk")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// The pushed symbolic link is replaced with a directory on the remote
+	if err := os.Remove(filepath.Join(remoteDir, "lnk")); err != nil {
+		t.Fatal(err)
+	}
+	writeRemote(t, filepath.Join(remoteDir, "lnk", "authorized_keys"), "ssh-ed25519 AAAA attacker")
+	if err := s.Close(); err == nil {
+		t.Error("expected an error for pulling back into the symbolic link")
+	}
+	if entries, err := os.ReadDir(outsideDir); err != nil || len(entries) != 0 {
+		t.Errorf("the outside of the local directory was modified: %v, %v", entries, err)
+	}
+}
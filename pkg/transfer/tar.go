@@ -0,0 +1,204 @@
+package transfer
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lima-vm/sshocker/pkg/ssh"
+	"github.com/lima-vm/sshocker/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+func sshCommand(host string, port int, c *ssh.SSHConfig, script string) *exec.Cmd {
+	args := c.Args()
+	if port != 0 {
+		args = append(args, "-p", strconv.Itoa(port))
+	}
+	args = append(args, host, "--", "sh", "-c", util.ShellQuote(script))
+	cmd := exec.Command(c.Binary(), args...)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// UploadDir streams the local directory as a tar archive onto the remote, akin to `cp -r`.
+// When remoteDst is an existing directory, the directory is copied under remoteDst.
+func UploadDir(host string, port int, c *ssh.SSHConfig, localDir, remoteDst string) (Stat, error) {
+	var st Stat
+	if c == nil {
+		return st, errors.New("got nil SSHConfig")
+	}
+	script := fmt.Sprintf(`set -e; dst=%s; if [ -d "$dst" ]; then dst="$dst"/%s; fi; mkdir -p "$dst"; tar -x -f - -C "$dst"`,
+		util.ShellQuote(remoteDst), util.ShellQuote(filepath.Base(localDir)))
+	cmd := sshCommand(host, port, c, script)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return st, err
+	}
+	logrus.Debugf("executing ssh for extracting tar: %s %v", cmd.Path, cmd.Args)
+	if err := cmd.Start(); err != nil {
+		return st, err
+	}
+	tw := tar.NewWriter(stdin)
+	walkErr := filepath.WalkDir(localDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		} else if !fi.IsDir() && !fi.Mode().IsRegular() {
+			logrus.Warnf("ignoring special file %q", p)
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			n, err := io.Copy(tw, f)
+			_ = f.Close()
+			st.Bytes += n
+			if err != nil {
+				return err
+			}
+			st.Files++
+		}
+		return nil
+	})
+	closeErr := errors.Join(tw.Close(), stdin.Close())
+	waitErr := cmd.Wait()
+	if err := errors.Join(walkErr, closeErr, waitErr); err != nil {
+		return st, fmt.Errorf("failed to upload %q (local) to %q (remote): %w", localDir, remoteDst, err)
+	}
+	return st, nil
+}
+
+// DownloadDir streams the remote directory as a tar archive onto the local, akin to `cp -r`.
+// When localDst is an existing directory, the directory is copied under localDst.
+func DownloadDir(host string, port int, c *ssh.SSHConfig, remoteDir, localDst string) (Stat, error) {
+	var st Stat
+	if c == nil {
+		return st, errors.New("got nil SSHConfig")
+	}
+	if fi, err := os.Stat(localDst); err == nil && fi.IsDir() {
+		localDst = filepath.Join(localDst, path.Base(remoteDir))
+	}
+	if err := os.MkdirAll(localDst, 0o755); err != nil {
+		return st, err
+	}
+	script := fmt.Sprintf(`set -e; tar -c -f - -C %s .`, util.ShellQuote(remoteDir))
+	cmd := sshCommand(host, port, c, script)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return st, err
+	}
+	logrus.Debugf("executing ssh for creating tar: %s %v", cmd.Path, cmd.Args)
+	if err := cmd.Start(); err != nil {
+		return st, err
+	}
+	extractErr := extractTar(stdout, localDst, &st)
+	if extractErr != nil {
+		_ = cmd.Process.Kill()
+	}
+	waitErr := cmd.Wait()
+	if err := errors.Join(extractErr, waitErr); err != nil {
+		return st, fmt.Errorf("failed to download %q (remote) to %q (local): %w", remoteDir, localDst, err)
+	}
+	return st, nil
+}
+
+// extractTar extracts the tar archive into dir.
+// Entries escaping from dir are rejected.
+func extractTar(r io.Reader, dir string, st *Stat) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if name == "." {
+			continue
+		}
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid tar entry %q", hdr.Name)
+		}
+		localName := filepath.FromSlash(name)
+		perm := hdr.FileInfo().Mode().Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := root.Mkdir(localName, perm|0o700); err != nil && !errors.Is(err, os.ErrExist) {
+				return err
+			}
+		case tar.TypeReg:
+			f, err := root.OpenFile(localName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+			if err != nil {
+				return err
+			}
+			n, err := io.Copy(f, tr)
+			st.Bytes += n
+			if err != nil {
+				_ = f.Close()
+				return err
+			}
+			if err := errors.Join(f.Chmod(perm), f.Close()); err != nil {
+				return err
+			}
+			if err := root.Chtimes(localName, hdr.ModTime, hdr.ModTime); err != nil {
+				return err
+			}
+			st.Files++
+		case tar.TypeSymlink:
+			// Ensure that the parent does not escape from the root
+			if parent, err := root.Stat(filepath.Dir(localName)); err != nil || !parent.IsDir() {
+				return fmt.Errorf("invalid tar entry %q: invalid parent: %w", hdr.Name, err)
+			}
+			if err := root.Symlink(hdr.Linkname, localName); err != nil {
+				logrus.WithError(err).Warnf("failed to create symlink %q", hdr.Name)
+			}
+		default:
+			logrus.Warnf("ignoring tar entry %q (type %q)", hdr.Name, hdr.Typeflag)
+		}
+	}
+}
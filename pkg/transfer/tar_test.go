@@ -0,0 +1,90 @@
+package transfer
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestExtractTar(t *testing.T) {
+	writeTar := func(t *testing.T, names ...string) *bytes.Buffer {
+		var b bytes.Buffer
+		tw := tar.NewWriter(&b)
+		for _, name := range names {
+			hdr := &tar.Header{Name: name, Mode: 0o644, Typeflag: tar.TypeReg, Size: int64(len(name))}
+			if name[len(name)-1] == '/' {
+				hdr = &tar.Header{Name: name, Mode: 0o755, Typeflag: tar.TypeDir}
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				if _, err := tw.Write([]byte(name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return &b
+	}
+
+	dir := t.TempDir()
+	var st Stat
+	if err := extractTar(writeTar(t, "./", "./foo/", "./foo/bar"), dir, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Files != 1 || st.Bytes != int64(len("./foo/bar")) {
+		t.Errorf("unexpected stat: %v", st)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "foo", "bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "./foo/bar" {
+		t.Errorf("unexpected content %q", string(b))
+	}
+
+	for _, name := range []string{"../evil", "/evil"} {
+		if err := extractTar(writeTar(t, name), t.TempDir(), &st); err == nil {
+			t.Errorf("error is expected for %q", name)
+		}
+	}
+}
+
+func TestExtractTarSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on Windows")
+	}
+	outside := t.TempDir()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, hdr := range []*tar.Header{
+		{Name: "link", Linkname: "foo", Typeflag: tar.TypeSymlink},
+		{Name: "escape", Linkname: outside, Typeflag: tar.TypeSymlink},
+		{Name: "escape/link", Linkname: "foo", Typeflag: tar.TypeSymlink},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	var st Stat
+	if err := extractTar(&b, dir, &st); err == nil {
+		t.Error("error is expected for the entry under the escaping symlink")
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "link")); err != nil || target != "foo" {
+		t.Errorf("expected symlink to %q, got %q (%v)", "foo", target, err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "link")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be created outside, got %v", err)
+	}
+}
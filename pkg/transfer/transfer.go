@@ -0,0 +1,240 @@
+// Package transfer provides helpers for transferring files over SFTP,
+// with preserving the permissions and the modification times.
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+)
+
+// Upload copies the local regular file onto the remote.
+// Returns the number of the transferred bytes.
+func Upload(client *sftp.Client, localPath, remotePath string) (int64, error) {
+	lf, err := os.Open(localPath)
+	if err != nil {
+		return 0, err
+	}
+	defer lf.Close()
+	st, err := lf.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if !st.Mode().IsRegular() {
+		return 0, fmt.Errorf("%q is not a regular file", localPath)
+	}
+	rf, err := client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %q (remote): %w", remotePath, err)
+	}
+	n, err := io.Copy(rf, lf)
+	if err != nil {
+		_ = rf.Close()
+		return n, fmt.Errorf("failed to write %q (remote): %w", remotePath, err)
+	}
+	if err := rf.Close(); err != nil {
+		return n, fmt.Errorf("failed to close %q (remote): %w", remotePath, err)
+	}
+	if err := client.Chmod(remotePath, st.Mode().Perm()); err != nil {
+		return n, fmt.Errorf("failed to chmod %q (remote): %w", remotePath, err)
+	}
+	if err := client.Chtimes(remotePath, st.ModTime(), st.ModTime()); err != nil {
+		return n, fmt.Errorf("failed to chtimes %q (remote): %w", remotePath, err)
+	}
+	return n, nil
+}
+
+// Download copies the remote regular file onto the local.
+// An existing read-only local file is overwritten.
+// Returns the number of the transferred bytes.
+func Download(client *sftp.Client, remotePath, localPath string) (int64, error) {
+	return download(client, remotePath, osFS{}, localPath)
+}
+
+// DownloadRoot is like Download, but localName is resolved in root,
+// so that the symbolic links pointing to the outside of root are never followed.
+func DownloadRoot(client *sftp.Client, remotePath string, root *os.Root, localName string) (int64, error) {
+	return download(client, remotePath, root, localName)
+}
+
+// localFS is implemented by [os.Root] and osFS.
+type localFS interface {
+	OpenFile(name string, flag int, perm fs.FileMode) (*os.File, error)
+	Lstat(name string) (fs.FileInfo, error)
+	Chmod(name string, mode fs.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// osFS is localFS for the local paths.
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm fs.FileMode) (*os.File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFS) Chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (osFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+var (
+	_ localFS = (*os.Root)(nil)
+	_ localFS = osFS{}
+)
+
+// openForWrite opens the local file for writing.
+// A read-only regular file (e.g., left by a previous download) is made writable first.
+func openForWrite(lfs localFS, name string, perm fs.FileMode) (*os.File, error) {
+	const flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	f, err := lfs.OpenFile(name, flag, perm)
+	if !errors.Is(err, fs.ErrPermission) {
+		return f, err
+	}
+	fi, lErr := lfs.Lstat(name)
+	if lErr != nil || !fi.Mode().IsRegular() || fi.Mode().Perm()&0o200 != 0 {
+		return nil, err
+	}
+	if err := lfs.Chmod(name, fi.Mode().Perm()|0o200); err != nil {
+		return nil, err
+	}
+	return lfs.OpenFile(name, flag, perm)
+}
+
+func download(client *sftp.Client, remotePath string, lfs localFS, localName string) (int64, error) {
+	rf, err := client.Open(remotePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %q (remote): %w", remotePath, err)
+	}
+	defer rf.Close()
+	st, err := rf.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat %q (remote): %w", remotePath, err)
+	}
+	if !st.Mode().IsRegular() {
+		return 0, fmt.Errorf("%q (remote) is not a regular file", remotePath)
+	}
+	lf, err := openForWrite(lfs, localName, st.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(lf, rf)
+	if err != nil {
+		_ = lf.Close()
+		return n, fmt.Errorf("failed to read %q (remote): %w", remotePath, err)
+	}
+	if err := lf.Close(); err != nil {
+		return n, err
+	}
+	if err := lfs.Chmod(localName, st.Mode().Perm()); err != nil {
+		return n, err
+	}
+	if err := lfs.Chtimes(localName, st.ModTime(), st.ModTime()); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// Stat is the statistics of the transfer.
+type Stat struct {
+	Files int
+	Bytes int64
+}
+
+func (st Stat) String() string {
+	return fmt.Sprintf("%d files, %d bytes", st.Files, st.Bytes)
+}
+
+// globBase returns the longest directory of the glob without wildcards, e.g., "/build" for "/build/*/dist".
+// The parent directory is returned for a glob without wildcards.
+func globBase(glob string) string {
+	elems := strings.Split(glob, "/")
+	for i, elem := range elems {
+		if strings.ContainsAny(elem, `*?[\`) {
+			if base := strings.Join(elems[:i], "/"); base != "" {
+				return base
+			}
+			if path.IsAbs(glob) {
+				return "/"
+			}
+			return "."
+		}
+	}
+	return path.Dir(glob)
+}
+
+// CopyOut downloads the remote files matching remoteGlob into localDir.
+// The local paths are relative to the directory of remoteGlob without wildcards,
+// e.g., "/build/*/dist" is downloaded as "LOCALDIR/foo/dist", "LOCALDIR/bar/dist", and so on.
+// Directories are downloaded recursively. Symbolic links and special files are ignored.
+// The local paths are resolved in localDir with [os.Root], so the existing symbolic links in localDir
+// pointing to the outside of localDir are never followed.
+func CopyOut(client *sftp.Client, remoteGlob, localDir string) (Stat, error) {
+	var st Stat
+	matches, err := client.Glob(remoteGlob)
+	if err != nil {
+		return st, fmt.Errorf("failed to glob %q (remote): %w", remoteGlob, err)
+	}
+	if len(matches) == 0 {
+		return st, fmt.Errorf("no file matches %q (remote)", remoteGlob)
+	}
+	if err := os.MkdirAll(localDir, 0o755); err != nil {
+		return st, err
+	}
+	root, err := os.OpenRoot(localDir)
+	if err != nil {
+		return st, err
+	}
+	defer root.Close()
+	base := globBase(path.Clean(remoteGlob))
+	for _, match := range matches {
+		walker := client.Walk(match)
+		for walker.Step() {
+			if err := walker.Err(); err != nil {
+				return st, fmt.Errorf("failed to walk %q (remote): %w", walker.Path(), err)
+			}
+			rel := walker.Path()
+			if base != "." {
+				rel = strings.TrimPrefix(strings.TrimPrefix(rel, base), "/")
+			}
+			if rel == "" {
+				rel = "."
+			}
+			name := filepath.FromSlash(rel)
+			lp := filepath.Join(localDir, name)
+			fi := walker.Stat()
+			switch {
+			case fi.IsDir():
+				if err := root.MkdirAll(name, fi.Mode().Perm()|0o700); err != nil {
+					return st, err
+				}
+			case fi.Mode().IsRegular():
+				n, err := DownloadRoot(client, walker.Path(), root, name)
+				st.Bytes += n
+				if err != nil {
+					return st, err
+				}
+				st.Files++
+				logrus.Debugf("copied out %q (remote) to %q (local), %d bytes", walker.Path(), lp, n)
+			default:
+				logrus.Warnf("ignoring non-regular file %q (remote)", walker.Path())
+			}
+		}
+	}
+	return st, nil
+}
@@ -0,0 +1,155 @@
+package transfer
+
+import (
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestGlobBase(t *testing.T) {
+	testCases := map[string]string{
+		"/build/*/dist":          "/build",
+		"/build/dist/*.tar.gz":   "/build/dist",
+		"/build/dist":            "/build",
+		"/*/dist":                "/",
+		"build/[ab]/dist":        "build",
+		"*.log":                  ".",
+		"/build/foo?/bar/*/dist": "/build",
+	}
+	for glob, expected := range testCases {
+		if got := globBase(glob); got != expected {
+			t.Errorf("%q: expected %q, got %q", glob, expected, got)
+		}
+	}
+}
+
+// newTestClient returns a client for an in-process SFTP server serving the local filesystem.
+func newTestClient(t *testing.T) *sftp.Client {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	server, err := sftp.NewServer(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve() //nolint:errcheck
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client
+}
+
+func TestCopyOut(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the remote paths are Unix paths")
+	}
+	remoteDir := t.TempDir()
+	for _, name := range []string{"foo/dist/a.txt", "bar/dist/a.txt", "bar/dist/sub/b.txt"} {
+		p := filepath.Join(remoteDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		// Read-only, so that the second run overwrites the read-only local files
+		if err := os.WriteFile(p, []byte(name), 0o444); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := newTestClient(t)
+	localDir := t.TempDir()
+	for range 2 {
+		st, err := CopyOut(client, remoteDir+"/*/dist", localDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Files != 3 {
+			t.Errorf("expected 3 files, got %d", st.Files)
+		}
+		// The matches do not overwrite each other
+		for _, name := range []string{"foo/dist/a.txt", "bar/dist/a.txt", "bar/dist/sub/b.txt"} {
+			p := filepath.Join(localDir, filepath.FromSlash(name))
+			b, err := os.ReadFile(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != name {
+				t.Errorf("%s: expected %q, got %q", name, name, string(b))
+			}
+			fi, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm := fi.Mode().Perm(); perm != 0o444 {
+				t.Errorf("%s: expected the mode 0444, got %o", name, perm)
+			}
+		}
+	}
+}
+
+func TestCopyOutSymlinkEscape(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the remote paths are Unix paths")
+	}
+	remoteDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(remoteDir, "dist", "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(remoteDir, "dist", "sub", "a.txt"), []byte("remote"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t)
+	localDir, outsideDir := t.TempDir(), t.TempDir()
+	if err := os.MkdirAll(filepath.Join(localDir, "dist"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// A symlink in the local destination, pointing to the outside
+	if err := os.Symlink(outsideDir, filepath.Join(localDir, "dist", "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CopyOut(client, remoteDir+"/dist", localDir); err == nil {
+		t.Error("expected an error for copying out via the symlink to the outside")
+	}
+	if _, err := os.Stat(filepath.Join(outsideDir, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written outside the local directory, got %v", err)
+	}
+}
+
+// permFS is osFS that checks the write permission even for root.
+type permFS struct {
+	osFS
+}
+
+func (p permFS) OpenFile(name string, flag int, perm fs.FileMode) (*os.File, error) {
+	if fi, err := os.Lstat(name); err == nil && flag&(os.O_WRONLY|os.O_RDWR) != 0 && fi.Mode().Perm()&0o200 == 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return p.osFS.OpenFile(name, flag, perm)
+}
+
+func TestOpenForWriteReadOnly(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(p, []byte("old"), 0o444); err != nil {
+		t.Fatal(err)
+	}
+	f, err := openForWrite(permFS{}, p, 0o444)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(p); err != nil || string(b) != "new" {
+		t.Errorf("expected %q, got %q (%v)", "new", string(b), err)
+	}
+}
@@ -2,7 +2,11 @@ package util
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"strconv"
+	"strings"
 )
 
 // RWC composes io.ReadCloser and io.WriteCloser into io.ReadWriteCloser
@@ -24,3 +28,38 @@ func (rwc *RWC) Close() error {
 	}
 	return nil
 }
+
+// ShellQuote quotes the string for POSIX shell scripts.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// ParseSize parses a size in bytes with an optional binary suffix, e.g., "512", "64K", "10MiB", "1G".
+func ParseSize(s string) (int64, error) {
+	num := strings.TrimRight(s, "KMGTiBkmgtb")
+	suffix := strings.ToUpper(strings.TrimSuffix(strings.TrimSuffix(s[len(num):], "B"), "b"))
+	suffix = strings.TrimSuffix(suffix, "I")
+	var mul int64
+	switch suffix {
+	case "":
+		mul = 1
+	case "K":
+		mul = 1 << 10
+	case "M":
+		mul = 1 << 20
+	case "G":
+		mul = 1 << 30
+	case "T":
+		mul = 1 << 40
+	default:
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(num), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64/mul {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n * mul, nil
+}
@@ -0,0 +1,37 @@
+package util
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	testCases := map[string]int64{
+		"0":     0,
+		"512":   512,
+		"64K":   64 << 10,
+		"64KB":  64 << 10,
+		"10MiB": 10 << 20,
+		"1g":    1 << 30,
+		"2T":    2 << 40,
+		"":      -1,
+		"K":     -1,
+		"-1":    -1,
+		"1.5M":  -1,
+		"1X":    -1,
+		"1P":    -1,
+	}
+	for s, expected := range testCases {
+		got, err := ParseSize(s)
+		if expected < 0 {
+			if err == nil {
+				t.Errorf("error is expected for %q, got %d", s, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed to parse %q: %v", s, err)
+			continue
+		}
+		if got != expected {
+			t.Errorf("expected %d, got %d for %q", expected, got, s)
+		}
+	}
+}
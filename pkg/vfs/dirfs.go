@@ -0,0 +1,132 @@
+package vfs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DirFS returns a [WritableFS] for the local directory.
+//
+// NOTE: as in OpenSSH's `sftp-server -d`, symbolic links are followed,
+// even when they point to the outside of the directory.
+func DirFS(dir string) WritableFS {
+	return &dirFS{dir: dir}
+}
+
+type dirFS struct {
+	dir string
+}
+
+func (d *dirFS) join(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(name)), nil
+}
+
+func (d *dirFS) Open(name string) (fs.File, error) {
+	return d.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (d *dirFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	p, err := d.join("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, flag, perm)
+}
+
+func (d *dirFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := d.join("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (d *dirFS) Lstat(name string) (fs.FileInfo, error) {
+	p, err := d.join("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(p)
+}
+
+func (d *dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := d.join("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(p)
+}
+
+func (d *dirFS) Readlink(name string) (string, error) {
+	p, err := d.join("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(p)
+}
+
+func (d *dirFS) Mkdir(name string, perm fs.FileMode) error {
+	p, err := d.join("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(p, perm)
+}
+
+func (d *dirFS) Remove(name string) error {
+	p, err := d.join("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (d *dirFS) Rename(oldname, newname string) error {
+	oldp, err := d.join("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newp, err := d.join("rename", newname)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldp, newp)
+}
+
+func (d *dirFS) Chmod(name string, mode fs.FileMode) error {
+	p, err := d.join("chmod", name)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(p, mode)
+}
+
+func (d *dirFS) Chtimes(name string, atime, mtime time.Time) error {
+	p, err := d.join("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(p, atime, mtime)
+}
+
+func (d *dirFS) Truncate(name string, size int64) error {
+	p, err := d.join("truncate", name)
+	if err != nil {
+		return err
+	}
+	return os.Truncate(p, size)
+}
+
+func (d *dirFS) Symlink(oldname, newname string) error {
+	newp, err := d.join("symlink", newname)
+	if err != nil {
+		return err
+	}
+	// oldname is not joined, as it is the content of the symbolic link
+	return os.Symlink(oldname, newp)
+}
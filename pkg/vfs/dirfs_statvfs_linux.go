@@ -0,0 +1,52 @@
+package vfs
+
+import (
+	"io/fs"
+	"syscall"
+
+	"github.com/pkg/sftp"
+)
+
+func (d *dirFS) StatVFS(name string) (*sftp.StatVFS, error) {
+	p, err := d.join("statvfs", name)
+	if err != nil {
+		return nil, err
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return nil, err
+	}
+	return statVFS(&st), nil
+}
+
+func (r *RootFS) StatVFS(name string) (*sftp.StatVFS, error) {
+	p, err := r.local("statvfs", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := r.root.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var st syscall.Statfs_t
+	if err := syscall.Fstatfs(int(f.Fd()), &st); err != nil {
+		return nil, &fs.PathError{Op: "statvfs", Path: name, Err: err}
+	}
+	return statVFS(&st), nil
+}
+
+func statVFS(st *syscall.Statfs_t) *sftp.StatVFS {
+	return &sftp.StatVFS{
+		Bsize:   uint64(st.Bsize),
+		Frsize:  uint64(st.Frsize),
+		Blocks:  st.Blocks,
+		Bfree:   st.Bfree,
+		Bavail:  st.Bavail,
+		Files:   st.Files,
+		Ffree:   st.Ffree,
+		Favail:  st.Ffree,
+		Flag:    uint64(st.Flags),
+		Namemax: uint64(st.Namelen),
+	}
+}
@@ -0,0 +1,128 @@
+package vfs
+
+import (
+	"io/fs"
+	"os"
+	"time"
+)
+
+// FileFS returns a [WritableFS] that serves the local regular file as ".",
+// typically combined with [NewMultiFS] to serve the file under its name.
+//
+// Only reading, writing, and truncating the file are allowed.
+// Symbolic links are never followed: opening the file fails if it has been replaced by a symbolic link
+// or by another file type, and creating, removing, renaming, and symbolic links fail with [fs.ErrPermission].
+func FileFS(file string) WritableFS {
+	return &fileFS{file: file}
+}
+
+type fileFS struct {
+	file string
+}
+
+func (f *fileFS) check(op, name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name != "." {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+func (f *fileFS) Open(name string) (fs.File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the file without following symbolic links.
+// O_CREATE is ignored, as the file always exists.
+func (f *fileFS) OpenFile(name string, flag int, _ fs.FileMode) (File, error) {
+	return f.open("open", name, flag)
+}
+
+func (f *fileFS) open(op, name string, flag int) (*os.File, error) {
+	if err := f.check(op, name); err != nil {
+		return nil, err
+	}
+	if flag&os.O_EXCL != 0 {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrExist}
+	}
+	fi, err := f.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(f.file, flag&^os.O_CREATE, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Detect the replacement of the file between Lstat and OpenFile
+	if opened, err := file.Stat(); err != nil || !os.SameFile(fi, opened) {
+		_ = file.Close()
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+	return file, nil
+}
+
+func (f *fileFS) Stat(name string) (fs.FileInfo, error) {
+	return f.Lstat(name)
+}
+
+// Lstat fails with [fs.ErrPermission] if the file is no longer a regular file.
+func (f *fileFS) Lstat(name string) (fs.FileInfo, error) {
+	if err := f.check("lstat", name); err != nil {
+		return nil, err
+	}
+	fi, err := os.Lstat(f.file)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrPermission}
+	}
+	return fi, nil
+}
+
+func (f *fileFS) Readlink(name string) (string, error) {
+	if err := f.check("readlink", name); err != nil {
+		return "", err
+	}
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+}
+
+func (f *fileFS) Truncate(name string, size int64) error {
+	file, err := f.open("truncate", name, os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(size); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (f *fileFS) Mkdir(name string, _ fs.FileMode) error {
+	return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+}
+
+func (f *fileFS) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+}
+
+func (f *fileFS) Rename(oldname, _ string) error {
+	return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrPermission}
+}
+
+func (f *fileFS) Chmod(name string, _ fs.FileMode) error {
+	return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrPermission}
+}
+
+func (f *fileFS) Chtimes(name string, _, _ time.Time) error {
+	return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrPermission}
+}
+
+func (f *fileFS) Symlink(_, newname string) error {
+	return &fs.PathError{Op: "symlink", Path: newname, Err: fs.ErrPermission}
+}
+
+var _ WritableFS = (*fileFS)(nil)
@@ -0,0 +1,358 @@
+package vfs
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lima-vm/sshocker/pkg/pathfilter"
+	"github.com/pkg/sftp"
+)
+
+// NewFilterFS returns a filesystem that hides the paths filtered out by include and exclude.
+// Hidden paths do not appear in ReadDir, and return [fs.ErrNotExist] on Open and Stat.
+// Creating a hidden path fails with [fs.ErrPermission].
+//
+// When include is not empty, only the files matching include are visible.
+// Directories remain visible so that the included files can be reached.
+// exclude takes precedence over include.
+// Either include or exclude may be nil.
+//
+// The returned filesystem implements [WritableFS] if fsys implements [WritableFS].
+//
+// Symbolic links inside fsys are resolved, and each component of the resolved name is checked,
+// so that a hidden path cannot be reached via a symbolic link such as "d -> .".
+// Creating a symbolic link to an absolute path or to the outside of fsys fails with [fs.ErrPermission].
+// Existing symbolic links to such paths are not checked, as their targets are not in fsys.
+// Renaming a directory fails with [fs.ErrPermission] when it would make a hidden descendant visible.
+//
+// The names are checked before the operations of fsys, so fsys should not follow the symbolic links
+// to the outside, such as [RootFS].
+func NewFilterFS(fsys fs.FS, include, exclude *pathfilter.Filter) fs.FS {
+	f := &filterFS{fsys: fsys, include: include, exclude: exclude}
+	if wfs, ok := fsys.(WritableFS); ok {
+		return &writableFilterFS{filterFS: f, wfs: wfs}
+	}
+	return f
+}
+
+type filterFS struct {
+	fsys    fs.FS
+	include *pathfilter.Filter
+	exclude *pathfilter.Filter
+}
+
+func (f *filterFS) hidden(name string, isDir bool) bool {
+	if name == "." {
+		return false
+	}
+	if f.exclude.Match(name, isDir) {
+		return true
+	}
+	return !isDir && !f.include.Empty() && !f.include.Match(name, false)
+}
+
+// check returns nil if each component of name is visible, and returns the resolved name.
+// The symbolic links in the intermediate components are followed.
+// The symbolic link in the last component is followed only when follow is true.
+// Nonexistent names are considered to be files, unless isDir is true.
+// Symbolic links to absolute paths or to the outside of fsys are not resolved,
+// and the resolved name is returned as the name via the symbolic link.
+func (f *filterFS) check(op, name string, isDir, follow bool) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return name, nil
+	}
+	done, rest := ".", strings.Split(name, "/")
+	links := 0
+	for len(rest) > 0 {
+		cur := path.Join(done, rest[0])
+		rest = rest[1:]
+		curIsDir := len(rest) > 0 || isDir
+		fi, err := Lstat(f.fsys, cur)
+		if err == nil {
+			curIsDir = fi.IsDir()
+		}
+		if f.hidden(cur, curIsDir) {
+			return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if err != nil {
+			// The rest does not exist either
+			resolved := path.Join(append([]string{cur}, rest...)...)
+			if f.hidden(resolved, isDir) {
+				return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+			}
+			return resolved, nil
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 && (len(rest) > 0 || follow) {
+			if links++; links > maxSymlinks {
+				return "", &fs.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+			}
+			target, err := Readlink(f.fsys, cur)
+			if err != nil {
+				return "", err
+			}
+			resolved := path.Join(append([]string{done, target}, rest...)...)
+			if path.IsAbs(target) || !fs.ValidPath(resolved) {
+				// Points to the outside of fsys
+				return path.Join(append([]string{cur}, rest...)...), nil
+			}
+			done, rest = ".", strings.Split(resolved, "/")
+			if resolved == "." {
+				return resolved, nil
+			}
+			continue
+		}
+		done = cur
+	}
+	return done, nil
+}
+
+// visible returns nil if name and its symlink target are visible.
+func (f *filterFS) visible(op, name string, isDir bool) error {
+	_, err := f.check(op, name, isDir, true)
+	return err
+}
+
+// creatable returns nil if name can be created, and returns the resolved name.
+func (f *filterFS) creatable(op, name string, isDir, follow bool) (string, error) {
+	resolved, err := f.check(op, name, isDir, follow)
+	if err != nil {
+		if pe, ok := err.(*fs.PathError); ok && pe.Err == fs.ErrNotExist {
+			pe.Err = fs.ErrPermission
+		}
+		return "", err
+	}
+	return resolved, nil
+}
+
+// revealsHidden returns true if renaming the directory oldDir to newDir would make any of its hidden descendants visible,
+// e.g., "config" to "config2" with the exclude pattern "config/secret.txt".
+// oldDir and newDir are the resolved names.
+func (f *filterFS) revealsHidden(oldDir, newDir string) (bool, error) {
+	type state struct{ oldHidden, newHidden bool }
+	states := map[string]state{".": {}}
+	var reveals bool
+	err := fs.WalkDir(f.fsys, oldDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == oldDir {
+			return nil
+		}
+		rel := strings.TrimPrefix(p, oldDir+"/")
+		if oldDir == "." {
+			rel = p
+		}
+		parent := states[path.Dir(rel)]
+		st := state{
+			oldHidden: parent.oldHidden || f.hidden(p, d.IsDir()),
+			newHidden: parent.newHidden || f.hidden(path.Join(newDir, rel), d.IsDir()),
+		}
+		if st.oldHidden && !st.newHidden {
+			reveals = true
+			return fs.SkipAll
+		}
+		if d.IsDir() {
+			if st.newHidden {
+				// The descendants remain hidden
+				return fs.SkipDir
+			}
+			states[rel] = st
+		}
+		return nil
+	})
+	return reveals, err
+}
+
+func (f *filterFS) Open(name string) (fs.File, error) {
+	resolved, err := f.check("open", name, false, true)
+	if err != nil {
+		return nil, err
+	}
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if rdf, ok := file.(fs.ReadDirFile); ok {
+		return &filterDirFile{ReadDirFile: rdf, f: f, name: resolved}, nil
+	}
+	return file, nil
+}
+
+func (f *filterFS) Stat(name string) (fs.FileInfo, error) {
+	if err := f.visible("stat", name, false); err != nil {
+		return nil, err
+	}
+	return fs.Stat(f.fsys, name)
+}
+
+func (f *filterFS) Lstat(name string) (fs.FileInfo, error) {
+	if _, err := f.check("lstat", name, false, false); err != nil {
+		return nil, err
+	}
+	return Lstat(f.fsys, name)
+}
+
+func (f *filterFS) Readlink(name string) (string, error) {
+	if _, err := f.Lstat(name); err != nil {
+		return "", err
+	}
+	return Readlink(f.fsys, name)
+}
+
+func (f *filterFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	resolved, err := f.check("readdir", name, true, true)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.ReadDir(f.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	return f.filterEntries(resolved, entries), nil
+}
+
+func (f *filterFS) filterEntries(dir string, entries []fs.DirEntry) []fs.DirEntry {
+	res := make([]fs.DirEntry, 0, len(entries))
+	for _, ent := range entries {
+		if !f.hidden(path.Join(dir, ent.Name()), ent.IsDir()) {
+			res = append(res, ent)
+		}
+	}
+	return res
+}
+
+func (f *filterFS) StatVFS(name string) (*sftp.StatVFS, error) {
+	if err := f.visible("statvfs", name, false); err != nil {
+		return nil, err
+	}
+	sfs, ok := f.fsys.(StatVFSFS)
+	if !ok {
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+	return sfs.StatVFS(name)
+}
+
+// filterDirFile hides the filtered entries from ReadDir of the directory file.
+type filterDirFile struct {
+	fs.ReadDirFile
+	f    *filterFS
+	name string
+}
+
+func (d *filterDirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries, err := d.ReadDirFile.ReadDir(n)
+		return d.f.filterEntries(d.name, entries), err
+	}
+	for {
+		entries, err := d.ReadDirFile.ReadDir(n)
+		filtered := d.f.filterEntries(d.name, entries)
+		if len(filtered) > 0 || err != nil {
+			return filtered, err
+		}
+	}
+}
+
+type writableFilterFS struct {
+	*filterFS
+	wfs WritableFS
+}
+
+func (f *writableFilterFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if _, err := f.creatable("open", name, false, true); err != nil {
+		return nil, err
+	}
+	return f.wfs.OpenFile(name, flag, perm)
+}
+
+func (f *writableFilterFS) Mkdir(name string, perm fs.FileMode) error {
+	if _, err := f.creatable("mkdir", name, true, false); err != nil {
+		return err
+	}
+	return f.wfs.Mkdir(name, perm)
+}
+
+func (f *writableFilterFS) Remove(name string) error {
+	if _, err := f.Lstat(name); err != nil {
+		return err
+	}
+	return f.wfs.Remove(name)
+}
+
+func (f *writableFilterFS) Rename(oldname, newname string) error {
+	oldResolved, err := f.check("rename", oldname, false, false)
+	if err != nil {
+		return err
+	}
+	fi, err := Lstat(f.fsys, oldname)
+	if err != nil {
+		return err
+	}
+	newResolved, err := f.creatable("rename", newname, fi.IsDir(), false)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		reveals, err := f.revealsHidden(oldResolved, newResolved)
+		if err != nil {
+			return err
+		}
+		if reveals {
+			return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrPermission}
+		}
+	}
+	return f.wfs.Rename(oldname, newname)
+}
+
+func (f *writableFilterFS) Chmod(name string, mode fs.FileMode) error {
+	if err := f.visible("chmod", name, false); err != nil {
+		return err
+	}
+	return f.wfs.Chmod(name, mode)
+}
+
+func (f *writableFilterFS) Chtimes(name string, atime, mtime time.Time) error {
+	if err := f.visible("chtimes", name, false); err != nil {
+		return err
+	}
+	return f.wfs.Chtimes(name, atime, mtime)
+}
+
+func (f *writableFilterFS) Truncate(name string, size int64) error {
+	if err := f.visible("truncate", name, false); err != nil {
+		return err
+	}
+	return f.wfs.Truncate(name, size)
+}
+
+func (f *writableFilterFS) Symlink(oldname, newname string) error {
+	if _, err := f.creatable("symlink", newname, false, false); err != nil {
+		return err
+	}
+	// Do not allow creating a symlink to a path that cannot be checked
+	dir, err := f.check("symlink", path.Dir(newname), true, true)
+	if err != nil {
+		return err
+	}
+	target := path.Join(dir, oldname)
+	if path.IsAbs(oldname) || !fs.ValidPath(target) {
+		return &fs.PathError{Op: "symlink", Path: newname, Err: fs.ErrPermission}
+	}
+	// Do not allow creating a symlink to a hidden path
+	if _, err := f.creatable("symlink", target, false, true); err != nil {
+		return err
+	}
+	return f.wfs.Symlink(oldname, newname)
+}
+
+var (
+	_ SymlinkFS  = (*filterFS)(nil)
+	_ StatVFSFS  = (*filterFS)(nil)
+	_ WritableFS = (*writableFilterFS)(nil)
+)
@@ -0,0 +1,241 @@
+package vfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"testing/fstest"
+
+	"github.com/lima-vm/sshocker/pkg/pathfilter"
+)
+
+func TestFilterFS(t *testing.T) {
+	exclude, err := pathfilter.New([]string{".env", "secrets/", ".git/objects"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := NewFilterFS(fstest.MapFS{
+		".env":            {Data: []byte("SECRET=1")},
+		"main.go":         {Data: []byte("package main")},
+		"secrets/key":     {Data: []byte("key")},
+		".git/HEAD":       {Data: []byte("ref")},
+		".git/objects/aa": {Data: []byte("obj")},
+	}, nil, exclude)
+	if _, ok := fsys.(WritableFS); ok {
+		t.Fatal("expected a read-only filesystem")
+	}
+	for _, name := range []string{".env", "secrets", "secrets/key", ".git/objects", ".git/objects/aa"} {
+		if _, err := fs.Stat(fsys, name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected ErrNotExist for %q, got %v", name, err)
+		}
+		if _, err := fsys.Open(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected ErrNotExist for opening %q, got %v", name, err)
+		}
+	}
+	if err := fstest.TestFS(fsys, "main.go", ".git/HEAD"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, ent := range entries {
+		names = append(names, ent.Name())
+	}
+	if expected := []string{".git", "main.go"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+}
+
+func TestFilterFSInclude(t *testing.T) {
+	include, err := pathfilter.New([]string{"*.go", "docs/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := NewFilterFS(fstest.MapFS{
+		"main.go":         {Data: []byte("package main")},
+		"main.bin":        {Data: []byte("bin")},
+		"pkg/foo/foo.go":  {Data: []byte("package foo")},
+		"pkg/foo/foo.txt": {Data: []byte("foo")},
+		"docs/README":     {Data: []byte("docs")},
+	}, include, nil)
+	if err := fstest.TestFS(fsys, "main.go", "pkg/foo/foo.go", "docs/README"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"main.bin", "pkg/foo/foo.txt"} {
+		if _, err := fs.Stat(fsys, name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected ErrNotExist for %q, got %v", name, err)
+		}
+	}
+}
+
+func TestFilterFSWritable(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".env"), []byte("SECRET=1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	exclude, err := pathfilter.New([]string{".env", "secrets/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wfs, ok := NewFilterFS(DirFS(dir), nil, exclude).(WritableFS)
+	if !ok {
+		t.Fatal("expected a writable filesystem")
+	}
+	if _, err := wfs.OpenFile(".env", os.O_WRONLY|os.O_TRUNC, 0); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected ErrPermission for opening .env, got %v", err)
+	}
+	if err := wfs.Mkdir("secrets", 0o755); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected ErrPermission for mkdir secrets, got %v", err)
+	}
+	if err := wfs.Remove(".env"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist for removing .env, got %v", err)
+	}
+	f, err := wfs.OpenFile("foo", os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wfs.Rename("foo", ".env"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected ErrPermission for renaming to .env, got %v", err)
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks are not tested on Windows")
+	}
+	if err := wfs.Symlink(".env", "link"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected ErrPermission for creating a symlink to .env, got %v", err)
+	}
+	if err := os.Symlink(".env", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadFile(wfs, "link"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist for reading the symlink to .env, got %v", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, ".env")); err != nil || string(b) != "SECRET=1" {
+		t.Errorf("expected .env to be untouched, got %q (%v)", string(b), err)
+	}
+}
+
+func TestFilterFSSymlinkBypass(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks are not tested on Windows")
+	}
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		".env":            "SECRET=1",
+		".git/HEAD":       "ref",
+		".git/objects/aa": "obj",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exclude, err := pathfilter.New([]string{".env", ".git/objects"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wfs, ok := NewFilterFS(DirFS(dir), nil, exclude).(WritableFS)
+	if !ok {
+		t.Fatal("expected a writable filesystem")
+	}
+	for _, target := range []string{filepath.Join(dir, ".env"), "../" + filepath.Base(dir) + "/.env", "/"} {
+		if err := wfs.Symlink(target, "y"); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("expected ErrPermission for creating a symlink to %q, got %v", target, err)
+		}
+	}
+	if err := wfs.Symlink(".", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := wfs.Symlink(".git", "g"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"d/.env", "d/.git/objects/aa", "g/objects/aa", "d/g/objects"} {
+		if _, err := fs.ReadFile(wfs, name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected ErrNotExist for reading %q, got %v", name, err)
+		}
+		if _, err := wfs.Lstat(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected ErrNotExist for lstat %q, got %v", name, err)
+		}
+	}
+	if err := wfs.Symlink("objects", "g/o"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected ErrPermission for creating a symlink to .git/objects, got %v", err)
+	}
+	if _, err := wfs.OpenFile("d/.git/objects/bb", os.O_WRONLY|os.O_CREATE, 0o644); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected ErrPermission for creating d/.git/objects/bb, got %v", err)
+	}
+	entries, err := fs.ReadDir(wfs, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, ent := range entries {
+		names = append(names, ent.Name())
+	}
+	if expected := []string{"HEAD"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+	if b, err := fs.ReadFile(wfs, "d/.git/HEAD"); err != nil || string(b) != "ref" {
+		t.Errorf("expected d/.git/HEAD to be readable, got %q (%v)", string(b), err)
+	}
+}
+
+func TestFilterFSRenameReveal(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"config/secret.txt":    "SECRET",
+		"config/app.conf":      "app",
+		"data/.env":            "SECRET=1",
+		"data/x":               "x",
+		"nested/a/private/key": "KEY",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exclude, err := pathfilter.New([]string{"config/secret.txt", ".env", "nested/a/private"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rfs, err := OpenRootFS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rfs.Close()
+	wfs, ok := NewFilterFS(rfs, nil, exclude).(WritableFS)
+	if !ok {
+		t.Fatal("expected a writable filesystem")
+	}
+	for _, tc := range [][2]string{{"config", "config2"}, {"nested", "nested2"}, {"nested/a", "nested/b"}} {
+		if err := wfs.Rename(tc[0], tc[1]); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("expected ErrPermission for renaming %q to %q, got %v", tc[0], tc[1], err)
+		}
+	}
+	if _, err := fs.ReadFile(wfs, "config2/secret.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist for reading config2/secret.txt, got %v", err)
+	}
+	// .env remains hidden in the new directory
+	if err := wfs.Rename("data", "data2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadFile(wfs, "data2/.env"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist for reading data2/.env, got %v", err)
+	}
+	if b, err := fs.ReadFile(wfs, "data2/x"); err != nil || string(b) != "x" {
+		t.Errorf("expected data2/x to be readable, got %q (%v)", string(b), err)
+	}
+}
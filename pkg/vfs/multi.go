@@ -0,0 +1,387 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// NewMultiFS returns a [WritableFS] that serves each of subs under its name,
+// e.g., {"src": DirFS("/home/user/src"), "work/data": DirFS("/data")}.
+//
+// The names are slash-separated, unrooted paths as in [fs.FS].
+// A name may be nested in another name; the longest one is used.
+// The name "." serves the sub filesystem as the root.
+// The ancestor directories of the names (e.g., "work") are synthesized as read-only directories.
+// Renaming across the sub filesystems fails with [syscall.EXDEV].
+func NewMultiFS(subs map[string]WritableFS) WritableFS {
+	m := &multiFS{
+		subs:    subs,
+		modTime: time.Now(),
+	}
+	for name := range subs {
+		m.names = append(m.names, name)
+	}
+	// The longest names first
+	slices.SortFunc(m.names, func(a, b string) int {
+		return len(b) - len(a)
+	})
+	return m
+}
+
+type multiFS struct {
+	subs    map[string]WritableFS
+	names   []string // Sorted from the longest
+	modTime time.Time
+}
+
+// entry returns the name of the sub filesystem that contains name, and the name in it.
+func (m *multiFS) entry(name string) (string, string, bool) {
+	for _, n := range m.names {
+		if n == "." {
+			return n, name, true
+		}
+		if name == n {
+			return n, ".", true
+		}
+		if rest, ok := strings.CutPrefix(name, n+"/"); ok {
+			return n, rest, true
+		}
+	}
+	return "", "", false
+}
+
+// resolve returns the sub filesystem and the name in it.
+// A nil filesystem is returned for a synthesized directory or a non-existent path.
+func (m *multiFS) resolve(op, name string) (WritableFS, string, error) {
+	if !fs.ValidPath(name) {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	n, subName, ok := m.entry(name)
+	if !ok {
+		return nil, "", nil
+	}
+	return m.subs[n], subName, nil
+}
+
+// children returns the sorted entries of the synthesized directory dir,
+// or false if dir is not a synthesized directory.
+func (m *multiFS) children(dir string) ([]string, bool) {
+	var res []string
+	found := false
+	for _, n := range m.names {
+		rest := n
+		if dir != "." {
+			var ok bool
+			if rest, ok = strings.CutPrefix(n, dir+"/"); !ok {
+				continue
+			}
+		}
+		found = true
+		child, _, _ := strings.Cut(rest, "/")
+		if !slices.Contains(res, child) {
+			res = append(res, child)
+		}
+	}
+	slices.Sort(res)
+	return res, found
+}
+
+// synthesized returns the directory for name, or an error if name does not exist.
+func (m *multiFS) synthesized(op, name string) (*multiDir, error) {
+	children, ok := m.children(name)
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return &multiDir{m: m, name: name, children: children}, nil
+}
+
+// writable returns the sub filesystem and the name in it, for the write operations.
+// The synthesized directories are read-only.
+func (m *multiFS) writable(op, name string) (WritableFS, string, error) {
+	sub, subName, err := m.resolve(op, name)
+	if err != nil {
+		return nil, "", err
+	}
+	if sub == nil {
+		// Including the creation of a new file next to the sub filesystems
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+	return sub, subName, nil
+}
+
+func (m *multiFS) Open(name string) (fs.File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *multiFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	sub, subName, err := m.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if sub != nil {
+		f, err := sub.OpenFile(subName, flag, perm)
+		if err != nil {
+			return nil, renamePathError(err, name)
+		}
+		return f, nil
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return m.synthesized("open", name)
+}
+
+func (m *multiFS) Stat(name string) (fs.FileInfo, error) {
+	sub, subName, err := m.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if sub != nil {
+		fi, err := fs.Stat(sub, subName)
+		if err != nil {
+			return nil, renamePathError(err, name)
+		}
+		return renamedFileInfo{FileInfo: fi, name: path.Base(name)}, nil
+	}
+	d, err := m.synthesized("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return d.Stat()
+}
+
+func (m *multiFS) Lstat(name string) (fs.FileInfo, error) {
+	sub, subName, err := m.resolve("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	if sub != nil {
+		// The root of a sub filesystem is always followed
+		if subName == "." {
+			return m.Stat(name)
+		}
+		fi, err := sub.Lstat(subName)
+		if err != nil {
+			return nil, renamePathError(err, name)
+		}
+		return fi, nil
+	}
+	return m.Stat(name)
+}
+
+func (m *multiFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	sub, subName, err := m.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if sub != nil {
+		entries, err := fs.ReadDir(sub, subName)
+		if err != nil {
+			return nil, renamePathError(err, name)
+		}
+		return entries, nil
+	}
+	d, err := m.synthesized("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return d.ReadDir(-1)
+}
+
+func (m *multiFS) Readlink(name string) (string, error) {
+	sub, subName, err := m.resolve("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if sub == nil || subName == "." {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return sub.Readlink(subName)
+}
+
+func (m *multiFS) StatVFS(name string) (*sftp.StatVFS, error) {
+	sub, subName, err := m.resolve("statvfs", name)
+	if err != nil {
+		return nil, err
+	}
+	if sub == nil {
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+	sfs, ok := sub.(StatVFSFS)
+	if !ok {
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+	return sfs.StatVFS(subName)
+}
+
+func (m *multiFS) Mkdir(name string, perm fs.FileMode) error {
+	sub, subName, err := m.writable("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return sub.Mkdir(subName, perm)
+}
+
+// Remove does not allow removing the root of a sub filesystem.
+func (m *multiFS) Remove(name string) error {
+	sub, subName, err := m.writable("remove", name)
+	if err != nil {
+		return err
+	}
+	if subName == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	return sub.Remove(subName)
+}
+
+func (m *multiFS) Rename(oldname, newname string) error {
+	oldSub, oldSubName, err := m.writable("rename", oldname)
+	if err != nil {
+		return err
+	}
+	_, newSubName, err := m.writable("rename", newname)
+	if err != nil {
+		return err
+	}
+	if oldSubName == "." || newSubName == "." {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrPermission}
+	}
+	// The sub filesystems are compared by their names, as WritableFS may not be comparable
+	oldEntry, _, _ := m.entry(oldname)
+	newEntry, _, _ := m.entry(newname)
+	if oldEntry != newEntry {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: syscall.EXDEV}
+	}
+	return oldSub.Rename(oldSubName, newSubName)
+}
+
+func (m *multiFS) Chmod(name string, mode fs.FileMode) error {
+	sub, subName, err := m.writable("chmod", name)
+	if err != nil {
+		return err
+	}
+	return sub.Chmod(subName, mode)
+}
+
+func (m *multiFS) Chtimes(name string, atime, mtime time.Time) error {
+	sub, subName, err := m.writable("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return sub.Chtimes(subName, atime, mtime)
+}
+
+func (m *multiFS) Truncate(name string, size int64) error {
+	sub, subName, err := m.writable("truncate", name)
+	if err != nil {
+		return err
+	}
+	return sub.Truncate(subName, size)
+}
+
+// Symlink creates a symbolic link in a sub filesystem. oldname is not interpreted.
+func (m *multiFS) Symlink(oldname, newname string) error {
+	sub, subName, err := m.writable("symlink", newname)
+	if err != nil {
+		return err
+	}
+	return sub.Symlink(oldname, subName)
+}
+
+// renamePathError replaces the path of err with the name in the multiFS.
+func renamePathError(err error, name string) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return &fs.PathError{Op: pathErr.Op, Path: name, Err: pathErr.Err}
+	}
+	return err
+}
+
+// renamedFileInfo is fs.FileInfo with another name, for the roots of the sub filesystems.
+// fs.FileInfo is embedded so that Sys remains available.
+type renamedFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi renamedFileInfo) Name() string {
+	return fi.name
+}
+
+// multiDir is a synthesized directory of multiFS.
+type multiDir struct {
+	m        *multiFS
+	name     string
+	children []string
+	offset   int
+}
+
+func (d *multiDir) Name() string {
+	return path.Base(d.name)
+}
+
+func (d *multiDir) Size() int64 {
+	return 0
+}
+
+func (d *multiDir) Mode() fs.FileMode {
+	return fs.ModeDir | 0o555
+}
+
+func (d *multiDir) ModTime() time.Time {
+	return d.m.modTime
+}
+
+func (d *multiDir) IsDir() bool {
+	return true
+}
+
+func (d *multiDir) Sys() any {
+	return nil
+}
+
+func (d *multiDir) Stat() (fs.FileInfo, error) {
+	return d, nil
+}
+
+func (d *multiDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *multiDir) ReadAt([]byte, int64) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *multiDir) WriteAt([]byte, int64) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: d.name, Err: fs.ErrPermission}
+}
+
+func (d *multiDir) Close() error {
+	return nil
+}
+
+// ReadDir implements [fs.ReadDirFile].
+// The entries whose sub filesystems cannot be accessed are omitted.
+func (d *multiDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	var res []fs.DirEntry
+	for ; d.offset < len(d.children) && (n <= 0 || len(res) < n); d.offset++ {
+		fi, err := d.m.Stat(path.Join(d.name, d.children[d.offset]))
+		if err != nil {
+			continue
+		}
+		res = append(res, fs.FileInfoToDirEntry(fi))
+	}
+	if n > 0 && len(res) == 0 {
+		return nil, io.EOF
+	}
+	return res, nil
+}
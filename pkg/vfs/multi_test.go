@@ -0,0 +1,84 @@
+package vfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestMultiFS(t *testing.T) {
+	srcDir, dataDir := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "main.go"), []byte("package main"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "data.txt"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m := NewMultiFS(map[string]WritableFS{
+		"src":       DirFS(srcDir),
+		"work/data": DirFS(dataDir),
+	})
+
+	names := func(dir string) []string {
+		t.Helper()
+		entries, err := fs.ReadDir(m, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res []string
+		for _, e := range entries {
+			res = append(res, e.Name())
+		}
+		return res
+	}
+	if got, expected := names("."), []string{"src", "work"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if got, expected := names("work"), []string{"data"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if got, expected := names("work/data"), []string{"data.txt"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	b, err := fs.ReadFile(m, "src/main.go")
+	if err != nil || string(b) != "package main" {
+		t.Errorf("unexpected content %q (%v)", string(b), err)
+	}
+	if fi, err := m.Lstat("work/data"); err != nil || !fi.IsDir() || fi.Name() != "data" {
+		t.Errorf("unexpected stat %v (%v)", fi, err)
+	}
+	if _, err := fs.Stat(m, "foo"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+
+	f, err := m.OpenFile("src/new.go", os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(srcDir, "new.go")); err != nil {
+		t.Error(err)
+	}
+	if err := m.Rename("src/new.go", "src/renamed.go"); err != nil {
+		t.Error(err)
+	}
+	if err := m.Rename("src/renamed.go", "work/data/renamed.go"); !errors.Is(err, syscall.EXDEV) {
+		t.Errorf("expected EXDEV, got %v", err)
+	}
+	for _, name := range []string{"new.txt", "work/new.txt"} {
+		if _, err := m.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0o644); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("%q: expected ErrPermission, got %v", name, err)
+		}
+	}
+	for _, name := range []string{"src", "work"} {
+		if err := m.Remove(name); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("%q: expected ErrPermission, got %v", name, err)
+		}
+	}
+}
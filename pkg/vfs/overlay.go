@@ -0,0 +1,767 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// maxSymlinks is the maximum number of symbolic links followed in a path resolution.
+const maxSymlinks = 40
+
+// ChangeKind is the kind of a [Change], akin to `docker diff`.
+type ChangeKind = string
+
+const (
+	ChangeAdded    = ChangeKind("A")
+	ChangeModified = ChangeKind("C")
+	ChangeDeleted  = ChangeKind("D")
+)
+
+// Change is a change made on an [OverlayFS].
+type Change struct {
+	Kind ChangeKind
+	Path string
+}
+
+func (c Change) String() string {
+	return c.Kind + " " + c.Path
+}
+
+// OverlayFS is a copy-on-write [WritableFS].
+// Reads come from the lower layer, unless the file has been written to the upper layer.
+// Writes, renames, and removals are applied to the upper layer, and the lower layer is never modified
+// until Commit is called.
+type OverlayFS struct {
+	lower WritableFS
+	upper WritableFS
+	mu    sync.Mutex
+	// whiteouts are the removed names of the lower layer.
+	whiteouts map[string]struct{}
+	// opaques are the directories of the upper layer that hide the lower layer.
+	opaques map[string]struct{}
+	// dirty are the names of the upper layer opened for writing, truncated, or changed the mode or the timestamps.
+	// The size and the modification time cannot tell whether a file was modified, as they may be unchanged.
+	dirty map[string]struct{}
+}
+
+// NewOverlayFS returns an [OverlayFS].
+// upper is expected to be an empty directory, such as [RootFS] for a temporary directory.
+func NewOverlayFS(lower, upper WritableFS) *OverlayFS {
+	return &OverlayFS{
+		lower:     lower,
+		upper:     upper,
+		whiteouts: make(map[string]struct{}),
+		opaques:   make(map[string]struct{}),
+		dirty:     make(map[string]struct{}),
+	}
+}
+
+// ancestors returns the ancestors of the name, excluding "." and the name itself.
+func ancestors(name string) []string {
+	var res []string
+	for i, c := range name {
+		if c == '/' {
+			res = append(res, name[:i])
+		}
+	}
+	return res
+}
+
+func pathErr(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// lowerVisible returns true if the name of the lower layer is not hidden by the whiteouts and the opaques.
+func (o *OverlayFS) lowerVisible(name string) bool {
+	if name == "." {
+		return true
+	}
+	if _, ok := o.whiteouts[name]; ok {
+		return false
+	}
+	for _, a := range ancestors(name) {
+		if _, ok := o.whiteouts[a]; ok {
+			return false
+		}
+		if _, ok := o.opaques[a]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (o *OverlayFS) inUpper(name string) bool {
+	_, err := o.upper.Lstat(name)
+	return err == nil
+}
+
+// layer returns the layer that holds the name.
+func (o *OverlayFS) layer(op, name string) (WritableFS, fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, nil, pathErr(op, name, fs.ErrInvalid)
+	}
+	if fi, err := o.upper.Lstat(name); err == nil {
+		return o.upper, fi, nil
+	}
+	if !o.lowerVisible(name) {
+		return nil, nil, pathErr(op, name, fs.ErrNotExist)
+	}
+	fi, err := o.lower.Lstat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return o.lower, fi, nil
+}
+
+// resolve follows the symbolic links of the name, including the intermediate components,
+// so that the name returned for a layer never contains symbolic links.
+// Symbolic links with absolute targets, or targets outside the root, are not followed,
+// and returned as they are (with the rest of the name), with abs=true.
+// On [fs.ErrNotExist], the resolved name is still returned, so that it can be created.
+func (o *OverlayFS) resolve(op, name string) (WritableFS, string, fs.FileInfo, bool, error) {
+	if !fs.ValidPath(name) {
+		return nil, "", nil, false, pathErr(op, name, fs.ErrInvalid)
+	}
+	if name == "." {
+		l, fi, err := o.layer(op, name)
+		return l, name, fi, false, err
+	}
+	done, rest := ".", strings.Split(name, "/")
+	links := 0
+	for len(rest) > 0 {
+		cur := path.Join(done, rest[0])
+		rest = rest[1:]
+		l, fi, err := o.layer(op, cur)
+		if err != nil {
+			return nil, path.Join(append([]string{cur}, rest...)...), nil, false, err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if links++; links > maxSymlinks {
+				return nil, "", nil, false, pathErr(op, name, syscall.ELOOP)
+			}
+			target, err := l.Readlink(cur)
+			if err != nil {
+				return nil, "", nil, false, err
+			}
+			resolved := path.Join(append([]string{done, target}, rest...)...)
+			if path.IsAbs(target) || !fs.ValidPath(resolved) {
+				return l, path.Join(append([]string{cur}, rest...)...), fi, true, nil
+			}
+			done, rest = ".", strings.Split(resolved, "/")
+			if resolved == "." {
+				rest = nil
+			}
+			continue
+		}
+		if len(rest) > 0 && !fi.IsDir() {
+			return nil, "", nil, false, pathErr(op, name, syscall.ENOTDIR)
+		}
+		done = cur
+		if len(rest) == 0 {
+			return l, done, fi, false, nil
+		}
+	}
+	// The name was resolved to the root
+	l, fi, err := o.layer(op, done)
+	return l, done, fi, false, err
+}
+
+// resolveForWrite is like resolve, but rejects the symbolic links that are not followed,
+// so that the writes never escape from the upper layer.
+// On [fs.ErrNotExist], the resolved name is returned with the error.
+func (o *OverlayFS) resolveForWrite(op, name string) (string, fs.FileInfo, error) {
+	_, resolved, fi, abs, err := o.resolve(op, name)
+	if err != nil {
+		return resolved, nil, err
+	}
+	if abs {
+		return "", nil, pathErr(op, name, fs.ErrPermission)
+	}
+	return resolved, fi, nil
+}
+
+// resolveParent resolves the parent directory of the name, but not the name itself,
+// for the operations that do not follow the last component, such as Lstat and Remove.
+func (o *OverlayFS) resolveParent(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", pathErr(op, name, fs.ErrInvalid)
+	}
+	if name == "." {
+		return name, nil
+	}
+	dir, base := path.Split(name)
+	if dir == "" {
+		return name, nil
+	}
+	resolved, fi, err := o.resolveForWrite(op, path.Clean(dir))
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", pathErr(op, name, syscall.ENOTDIR)
+	}
+	return path.Join(resolved, base), nil
+}
+
+func (o *OverlayFS) Open(name string) (fs.File, error) {
+	return o.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (o *OverlayFS) Stat(name string) (fs.FileInfo, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	l, resolved, _, abs, err := o.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if abs {
+		return fs.Stat(l, resolved)
+	}
+	return l.Lstat(resolved)
+}
+
+func (o *OverlayFS) Lstat(name string) (fs.FileInfo, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	resolved, err := o.resolveParent("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	_, fi, err := o.layer("lstat", resolved)
+	return fi, err
+}
+
+func (o *OverlayFS) Readlink(name string) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	resolved, err := o.resolveParent("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	l, _, err := o.layer("readlink", resolved)
+	if err != nil {
+		return "", err
+	}
+	return l.Readlink(resolved)
+}
+
+// ReadDir merges the entries of the upper layer and the lower layer.
+func (o *OverlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.readDir(name)
+}
+
+func (o *OverlayFS) readDir(name string) ([]fs.DirEntry, error) {
+	_, resolved, fi, abs, err := o.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if abs {
+		return nil, pathErr("readdir", name, fs.ErrPermission)
+	}
+	if !fi.IsDir() {
+		return nil, pathErr("readdir", name, syscall.ENOTDIR)
+	}
+	m := make(map[string]fs.DirEntry)
+	if o.inUpper(resolved) {
+		ents, err := fs.ReadDir(o.upper, resolved)
+		if err != nil {
+			return nil, err
+		}
+		for _, ent := range ents {
+			m[ent.Name()] = ent
+		}
+	}
+	if _, opaque := o.opaques[resolved]; !opaque && o.lowerVisible(resolved) {
+		if ents, err := fs.ReadDir(o.lower, resolved); err == nil {
+			for _, ent := range ents {
+				if _, ok := m[ent.Name()]; ok {
+					continue
+				}
+				if _, ok := o.whiteouts[path.Join(resolved, ent.Name())]; ok {
+					continue
+				}
+				m[ent.Name()] = ent
+			}
+		}
+	}
+	res := make([]fs.DirEntry, 0, len(m))
+	for _, ent := range m {
+		res = append(res, ent)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name() < res[j].Name() })
+	return res, nil
+}
+
+// copyFile copies the regular file, with its mode and its modification time.
+func copyFile(dst, src WritableFS, name string, fi fs.FileInfo) error {
+	sf, err := src.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	df, err := dst.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.NewOffsetWriter(df, 0), sf); err != nil {
+		_ = df.Close()
+		return err
+	}
+	if err := df.Close(); err != nil {
+		return err
+	}
+	if err := dst.Chmod(name, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return dst.Chtimes(name, fi.ModTime(), fi.ModTime())
+}
+
+// copyEntry copies a directory (without its children), a symbolic link, or a regular file.
+func copyEntry(dst, src WritableFS, name string, fi fs.FileInfo) error {
+	switch {
+	case fi.IsDir():
+		if err := dst.Mkdir(name, fi.Mode().Perm()|0o700); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		return dst.Chmod(name, fi.Mode().Perm())
+	case fi.Mode()&fs.ModeSymlink != 0:
+		target, err := src.Readlink(name)
+		if err != nil {
+			return err
+		}
+		return dst.Symlink(target, name)
+	case fi.Mode().IsRegular():
+		return copyFile(dst, src, name, fi)
+	}
+	return pathErr("copy", name, errors.ErrUnsupported)
+}
+
+// copyUpParents copies up the ancestors of the name.
+func (o *OverlayFS) copyUpParents(name string) error {
+	for _, a := range ancestors(name) {
+		if err := o.copyUp(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyUp copies up the name from the lower layer to the upper layer, if it is not copied up yet.
+func (o *OverlayFS) copyUp(name string) error {
+	if o.inUpper(name) {
+		return nil
+	}
+	if err := o.copyUpParents(name); err != nil {
+		return err
+	}
+	if !o.lowerVisible(name) {
+		return pathErr("copyup", name, fs.ErrNotExist)
+	}
+	fi, err := o.lower.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if err := copyEntry(o.upper, o.lower, name, fi); err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		// The timestamp of the directory is not meaningful, as its children are not copied up
+		_ = o.upper.Chtimes(name, fi.ModTime(), fi.ModTime())
+	}
+	return nil
+}
+
+// copyUpTree copies up the name recursively.
+func (o *OverlayFS) copyUpTree(name string) error {
+	if err := o.copyUp(name); err != nil {
+		return err
+	}
+	fi, err := o.upper.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return nil
+	}
+	ents, err := o.readDir(name)
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		if err := o.copyUpTree(path.Join(name, ent.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *OverlayFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) == 0 {
+		l, resolved, _, _, err := o.resolve("open", name)
+		if err != nil {
+			return nil, err
+		}
+		return l.OpenFile(resolved, flag, perm)
+	}
+	resolved, _, err := o.resolveForWrite("open", name)
+	switch {
+	case err == nil:
+		if flag&os.O_EXCL != 0 {
+			return nil, pathErr("open", name, fs.ErrExist)
+		}
+		if err := o.copyUp(resolved); err != nil {
+			return nil, err
+		}
+		o.dirty[resolved] = struct{}{}
+		return o.upper.OpenFile(resolved, flag, perm)
+	case errors.Is(err, fs.ErrNotExist) && flag&os.O_CREATE != 0 && resolved != "":
+		if err := o.copyUpParents(resolved); err != nil {
+			return nil, err
+		}
+		f, err := o.upper.OpenFile(resolved, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		delete(o.whiteouts, resolved)
+		o.dirty[resolved] = struct{}{}
+		return f, nil
+	default:
+		return nil, err
+	}
+}
+
+func (o *OverlayFS) Mkdir(name string, perm fs.FileMode) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	name, err := o.resolveParent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if _, _, err := o.layer("mkdir", name); err == nil {
+		return pathErr("mkdir", name, fs.ErrExist)
+	}
+	if err := o.copyUpParents(name); err != nil {
+		return err
+	}
+	if err := o.upper.Mkdir(name, perm); err != nil {
+		return err
+	}
+	if _, ok := o.whiteouts[name]; ok {
+		delete(o.whiteouts, name)
+		o.opaques[name] = struct{}{}
+	}
+	return nil
+}
+
+func (o *OverlayFS) Remove(name string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	name, err := o.resolveParent("remove", name)
+	if err != nil {
+		return err
+	}
+	l, fi, err := o.layer("remove", name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		ents, err := o.readDir(name)
+		if err != nil {
+			return err
+		}
+		if len(ents) > 0 {
+			return pathErr("remove", name, syscall.ENOTEMPTY)
+		}
+	}
+	if l == o.upper {
+		if err := o.upper.Remove(name); err != nil {
+			return err
+		}
+	}
+	if _, err := o.lower.Lstat(name); err == nil && o.lowerVisible(name) {
+		o.whiteouts[name] = struct{}{}
+	}
+	delete(o.opaques, name)
+	delete(o.dirty, name)
+	return nil
+}
+
+func (o *OverlayFS) Rename(oldname, newname string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	oldname, err := o.resolveParent("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newname, err = o.resolveParent("rename", newname)
+	if err != nil {
+		return err
+	}
+	_, oldFi, err := o.layer("rename", oldname)
+	if err != nil {
+		return err
+	}
+	if oldname == newname {
+		return nil
+	}
+	if _, newFi, err := o.layer("rename", newname); err == nil && newFi.IsDir() {
+		if !oldFi.IsDir() {
+			return pathErr("rename", newname, syscall.EISDIR)
+		}
+		ents, err := o.readDir(newname)
+		if err != nil {
+			return err
+		}
+		if len(ents) > 0 {
+			return pathErr("rename", newname, syscall.ENOTEMPTY)
+		}
+	}
+	if err := o.copyUpTree(oldname); err != nil {
+		return err
+	}
+	if err := o.copyUpParents(newname); err != nil {
+		return err
+	}
+	if err := o.upper.Rename(oldname, newname); err != nil {
+		return err
+	}
+	if _, err := o.lower.Lstat(oldname); err == nil && o.lowerVisible(oldname) {
+		o.whiteouts[oldname] = struct{}{}
+	}
+	delete(o.opaques, oldname)
+	delete(o.whiteouts, newname)
+	delete(o.dirty, oldname)
+	o.dirty[newname] = struct{}{}
+	if oldFi.IsDir() {
+		// The children have been copied up by copyUpTree
+		o.opaques[newname] = struct{}{}
+	}
+	return nil
+}
+
+func (o *OverlayFS) Chmod(name string, mode fs.FileMode) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	resolved, _, err := o.resolveForWrite("chmod", name)
+	if err != nil {
+		return err
+	}
+	if err := o.copyUp(resolved); err != nil {
+		return err
+	}
+	o.dirty[resolved] = struct{}{}
+	return o.upper.Chmod(resolved, mode)
+}
+
+func (o *OverlayFS) Chtimes(name string, atime, mtime time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	resolved, _, err := o.resolveForWrite("chtimes", name)
+	if err != nil {
+		return err
+	}
+	if err := o.copyUp(resolved); err != nil {
+		return err
+	}
+	o.dirty[resolved] = struct{}{}
+	return o.upper.Chtimes(resolved, atime, mtime)
+}
+
+func (o *OverlayFS) Truncate(name string, size int64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	resolved, _, err := o.resolveForWrite("truncate", name)
+	if err != nil {
+		return err
+	}
+	if err := o.copyUp(resolved); err != nil {
+		return err
+	}
+	o.dirty[resolved] = struct{}{}
+	return o.upper.Truncate(resolved, size)
+}
+
+func (o *OverlayFS) Symlink(oldname, newname string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	newname, err := o.resolveParent("symlink", newname)
+	if err != nil {
+		return err
+	}
+	if _, _, err := o.layer("symlink", newname); err == nil {
+		return pathErr("symlink", newname, fs.ErrExist)
+	}
+	if err := o.copyUpParents(newname); err != nil {
+		return err
+	}
+	if err := o.upper.Symlink(oldname, newname); err != nil {
+		return err
+	}
+	delete(o.whiteouts, newname)
+	return nil
+}
+
+func (o *OverlayFS) StatVFS(name string) (*sftp.StatVFS, error) {
+	sfs, ok := o.lower.(StatVFSFS)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return sfs.StatVFS(name)
+}
+
+// hiddenByAncestor returns true if an ancestor of the name is whited out or opaque.
+func (o *OverlayFS) hiddenByAncestor(name string) bool {
+	for _, a := range ancestors(name) {
+		if _, ok := o.whiteouts[a]; ok {
+			return true
+		}
+		if _, ok := o.opaques[a]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sameEntry returns true if the entries of the upper layer and the lower layer are considered to be same.
+func (o *OverlayFS) sameEntry(name string, upperFi, lowerFi fs.FileInfo) bool {
+	if _, ok := o.dirty[name]; ok {
+		return false
+	}
+	if upperFi.Mode() != lowerFi.Mode() {
+		return false
+	}
+	switch {
+	case upperFi.IsDir():
+		return true
+	case upperFi.Mode()&fs.ModeSymlink != 0:
+		upperTarget, err1 := o.upper.Readlink(name)
+		lowerTarget, err2 := o.lower.Readlink(name)
+		return err1 == nil && err2 == nil && upperTarget == lowerTarget
+	default:
+		// Not dirty, just copied up
+		return true
+	}
+}
+
+// Changes returns the changes made on the overlay, sorted by the path.
+func (o *OverlayFS) Changes() ([]Change, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var changes []Change
+	err := fs.WalkDir(o.upper, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		upperFi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if lowerFi, err := o.lower.Lstat(name); err == nil && !o.hiddenByAncestor(name) {
+			if !o.sameEntry(name, upperFi, lowerFi) {
+				changes = append(changes, Change{Kind: ChangeModified, Path: name})
+			}
+		} else {
+			changes = append(changes, Change{Kind: ChangeAdded, Path: name})
+		}
+		if _, ok := o.opaques[name]; ok {
+			// Children of the lower layer hidden by the opaque directory
+			if ents, err := fs.ReadDir(o.lower, name); err == nil {
+				for _, ent := range ents {
+					child := path.Join(name, ent.Name())
+					if !o.inUpper(child) {
+						changes = append(changes, Change{Kind: ChangeDeleted, Path: child})
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name := range o.whiteouts {
+		if !o.hiddenByAncestor(name) && !o.inUpper(name) {
+			changes = append(changes, Change{Kind: ChangeDeleted, Path: name})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// Commit applies the changes to the lower layer.
+func (o *OverlayFS) Commit() error {
+	changes, err := o.Changes()
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, c := range changes {
+		if c.Kind == ChangeDeleted {
+			if err := removeAll(o.lower, c.Path); err != nil {
+				return err
+			}
+		}
+	}
+	for _, c := range changes {
+		if c.Kind == ChangeDeleted {
+			continue
+		}
+		upperFi, err := o.upper.Lstat(c.Path)
+		if err != nil {
+			return err
+		}
+		if lowerFi, err := o.lower.Lstat(c.Path); err == nil {
+			if !(upperFi.IsDir() && lowerFi.IsDir()) {
+				if err := removeAll(o.lower, c.Path); err != nil {
+					return err
+				}
+			}
+		}
+		if err := copyEntry(o.lower, o.upper, c.Path, upperFi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeAll removes the name recursively.
+func removeAll(wfs WritableFS, name string) error {
+	fi, err := wfs.Lstat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		ents, err := fs.ReadDir(wfs, name)
+		if err != nil {
+			return err
+		}
+		for _, ent := range ents {
+			if err := removeAll(wfs, path.Join(name, ent.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return wfs.Remove(name)
+}
+
+var _ WritableFS = (*OverlayFS)(nil)
@@ -0,0 +1,296 @@
+package vfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestOverlayFS(t *testing.T) {
+	lowerDir := t.TempDir()
+	for name, content := range map[string]string{
+		"unchanged.txt":    "unchanged",
+		"modified.txt":     "original",
+		"removed.txt":      "removed",
+		"dir/renamed.txt":  "renamed",
+		"removed-dir/file": "file",
+	} {
+		p := filepath.Join(lowerDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o := NewOverlayFS(DirFS(lowerDir), DirFS(t.TempDir()))
+
+	f, err := o.OpenFile("modified.txt", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("modified"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Remove("removed.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Remove("removed-dir"); err == nil {
+		t.Fatal("expected an error for removing a non-empty directory")
+	}
+	if err := o.Remove("removed-dir/file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Remove("removed-dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Mkdir("added", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Rename("dir/renamed.txt", "added/renamed.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := fs.ReadFile(o, "modified.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "modified" {
+		t.Errorf("expected %q, got %q", "modified", string(b))
+	}
+	if _, err := fs.Stat(o, "removed.txt"); err == nil {
+		t.Error("removed.txt should not exist")
+	}
+	ents, err := fs.ReadDir(o, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, ent := range ents {
+		names = append(names, ent.Name())
+	}
+	if expected := []string{"added", "dir", "modified.txt", "unchanged.txt"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+	// The lower layer is not modified
+	if b, err := os.ReadFile(filepath.Join(lowerDir, "modified.txt")); err != nil || string(b) != "original" {
+		t.Errorf("the lower layer was modified: %q, %v", string(b), err)
+	}
+	if _, err := os.Stat(filepath.Join(lowerDir, "removed.txt")); err != nil {
+		t.Errorf("the lower layer was modified: %v", err)
+	}
+
+	changes, err := o.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Change{
+		{Kind: ChangeAdded, Path: "added"},
+		{Kind: ChangeAdded, Path: "added/renamed.txt"},
+		{Kind: ChangeDeleted, Path: "dir/renamed.txt"},
+		{Kind: ChangeModified, Path: "modified.txt"},
+		{Kind: ChangeDeleted, Path: "removed-dir"},
+		{Kind: ChangeDeleted, Path: "removed.txt"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %v, got %v", expected, changes)
+	}
+
+	if err := o.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(lowerDir, "modified.txt")); err != nil || string(b) != "modified" {
+		t.Errorf("unexpected modified.txt after commit: %q, %v", string(b), err)
+	}
+	if b, err := os.ReadFile(filepath.Join(lowerDir, "added", "renamed.txt")); err != nil || string(b) != "renamed" {
+		t.Errorf("unexpected added/renamed.txt after commit: %q, %v", string(b), err)
+	}
+	for _, name := range []string{"removed.txt", "removed-dir", "dir/renamed.txt"} {
+		if _, err := os.Stat(filepath.Join(lowerDir, filepath.FromSlash(name))); err == nil {
+			t.Errorf("%q should have been removed after commit", name)
+		}
+	}
+}
+
+// TestOverlayFSSameSizeRewrite verifies that a rewrite keeping the size and the modification time is not lost.
+func TestOverlayFSSameSizeRewrite(t *testing.T) {
+	lowerDir, upperDir := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(lowerDir, "file"), []byte("original"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	lowerFi, err := os.Stat(filepath.Join(lowerDir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := NewOverlayFS(DirFS(lowerDir), DirFS(upperDir))
+	f, err := o.OpenFile("file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("modified"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Same as a write within the granularity of the modification time
+	if err := os.Chtimes(filepath.Join(upperDir, "file"), lowerFi.ModTime(), lowerFi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := o.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []Change{{Kind: ChangeModified, Path: "file"}}; !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("expected %v, got %v", expected, changes)
+	}
+	if err := o.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(lowerDir, "file")); err != nil || string(b) != "modified" {
+		t.Errorf("expected the lower file to be committed, got %q (%v)", string(b), err)
+	}
+}
+
+func TestOverlayFSSymlinkEscape(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links are not supported on Windows")
+	}
+	victimDir := t.TempDir()
+	victimFile := filepath.Join(victimDir, "f")
+	if err := os.WriteFile(victimFile, []byte("victim"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	lowerDir := filepath.Join(t.TempDir(), "lower")
+	if err := os.Mkdir(lowerDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(lowerDir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	upperDir := t.TempDir()
+	testCases := []struct {
+		name  string
+		upper func(t *testing.T) WritableFS
+	}{
+		{
+			name:  "DirFS",
+			upper: func(t *testing.T) WritableFS { return DirFS(upperDir) },
+		},
+		{
+			name: "RootFS",
+			upper: func(t *testing.T) WritableFS {
+				r, err := OpenRootFS(upperDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { _ = r.Close() })
+				return r
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			o := NewOverlayFS(DirFS(lowerDir), tc.upper(t))
+			for link, target := range map[string]string{
+				"abs":      victimDir,
+				"outside":  "../" + filepath.Base(victimDir),
+				"relative": "sub",
+			} {
+				if err := o.Symlink(target, link); err != nil && !errors.Is(err, fs.ErrExist) {
+					t.Fatal(err)
+				}
+			}
+			for _, link := range []string{"abs", "outside"} {
+				if _, err := o.OpenFile(link+"/f", os.O_WRONLY|os.O_TRUNC, 0); !errors.Is(err, fs.ErrPermission) {
+					t.Errorf("%s: expected fs.ErrPermission for overwriting, got %v", link, err)
+				}
+				if _, err := o.OpenFile(link+"/new", os.O_WRONLY|os.O_CREATE, 0o644); !errors.Is(err, fs.ErrPermission) {
+					t.Errorf("%s: expected fs.ErrPermission for creating, got %v", link, err)
+				}
+				if err := o.Mkdir(link+"/newdir", 0o755); !errors.Is(err, fs.ErrPermission) {
+					t.Errorf("%s: expected fs.ErrPermission for mkdir, got %v", link, err)
+				}
+				if err := o.Symlink("x", link+"/newlink"); !errors.Is(err, fs.ErrPermission) {
+					t.Errorf("%s: expected fs.ErrPermission for symlink, got %v", link, err)
+				}
+			}
+			// Relative symlinks inside the root are resolved in the overlay
+			f, err := o.OpenFile("relative/new", os.O_WRONLY|os.O_CREATE, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Lstat(filepath.Join(upperDir, "sub", "new")); err != nil {
+				t.Errorf("expected sub/new in the upper layer: %v", err)
+			}
+		})
+	}
+	if b, err := os.ReadFile(victimFile); err != nil || string(b) != "victim" {
+		t.Errorf("the file outside the overlay was modified: %q, %v", string(b), err)
+	}
+	ents, err := os.ReadDir(victimDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 1 {
+		t.Errorf("files were created outside the overlay: %v", ents)
+	}
+	if _, err := os.Lstat(filepath.Join(lowerDir, "sub", "new")); err == nil {
+		t.Error("the lower layer was modified")
+	}
+}
+
+func TestRootFS(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links are not supported on Windows")
+	}
+	outsideDir := t.TempDir()
+	dir := t.TempDir()
+	r, err := OpenRootFS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := r.Symlink(outsideDir, "abs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Mkdir("sub", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Symlink("sub", "relative"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.OpenFile("abs/new", os.O_WRONLY|os.O_CREATE, 0o644); err == nil {
+		t.Error("expected an error for creating a file via an absolute symlink")
+	}
+	if err := r.Mkdir("abs/newdir", 0o755); err == nil {
+		t.Error("expected an error for creating a directory via an absolute symlink")
+	}
+	f, err := r.OpenFile("relative/new", os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ents, err := r.ReadDir("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 1 || ents[0].Name() != "new" {
+		t.Errorf("unexpected entries: %v", ents)
+	}
+	if ents, err := os.ReadDir(outsideDir); err != nil || len(ents) != 0 {
+		t.Errorf("the outside directory was modified: %v, %v", ents, err)
+	}
+}
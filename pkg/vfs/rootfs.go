@@ -0,0 +1,163 @@
+package vfs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// RootFS is a [WritableFS] for a local directory, like [DirFS], but the names are resolved with [os.Root].
+// Symbolic links pointing to the outside of the directory are never followed, including the intermediate ones.
+type RootFS struct {
+	root *os.Root
+}
+
+// OpenRootFS opens a [RootFS] for the local directory.
+// The caller has to call Close.
+func OpenRootFS(dir string) (*RootFS, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &RootFS{root: root}, nil
+}
+
+// Close closes the directory.
+func (r *RootFS) Close() error {
+	return r.root.Close()
+}
+
+func (r *RootFS) local(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.FromSlash(name), nil
+}
+
+func (r *RootFS) Open(name string) (fs.File, error) {
+	return r.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (r *RootFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	p, err := r.local("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return r.root.OpenFile(p, flag, perm)
+}
+
+func (r *RootFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := r.local("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return r.root.Stat(p)
+}
+
+func (r *RootFS) Lstat(name string) (fs.FileInfo, error) {
+	p, err := r.local("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return r.root.Lstat(p)
+}
+
+func (r *RootFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := r.local("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := r.root.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ents, err := f.ReadDir(-1)
+	// Sorted as in os.ReadDir
+	slices.SortFunc(ents, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return ents, err
+}
+
+func (r *RootFS) Readlink(name string) (string, error) {
+	p, err := r.local("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	return r.root.Readlink(p)
+}
+
+func (r *RootFS) Mkdir(name string, perm fs.FileMode) error {
+	p, err := r.local("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return r.root.Mkdir(p, perm)
+}
+
+func (r *RootFS) Remove(name string) error {
+	p, err := r.local("remove", name)
+	if err != nil {
+		return err
+	}
+	return r.root.Remove(p)
+}
+
+func (r *RootFS) Rename(oldname, newname string) error {
+	oldp, err := r.local("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newp, err := r.local("rename", newname)
+	if err != nil {
+		return err
+	}
+	return r.root.Rename(oldp, newp)
+}
+
+func (r *RootFS) Chmod(name string, mode fs.FileMode) error {
+	p, err := r.local("chmod", name)
+	if err != nil {
+		return err
+	}
+	return r.root.Chmod(p, mode)
+}
+
+func (r *RootFS) Chtimes(name string, atime, mtime time.Time) error {
+	p, err := r.local("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return r.root.Chtimes(p, atime, mtime)
+}
+
+func (r *RootFS) Truncate(name string, size int64) error {
+	p, err := r.local("truncate", name)
+	if err != nil {
+		return err
+	}
+	f, err := r.root.OpenFile(p, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (r *RootFS) Symlink(oldname, newname string) error {
+	newp, err := r.local("symlink", newname)
+	if err != nil {
+		return err
+	}
+	// oldname is the content of the symbolic link; it is not followed by RootFS
+	return r.root.Symlink(oldname, newp)
+}
+
+var _ WritableFS = (*RootFS)(nil)
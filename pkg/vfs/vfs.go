@@ -0,0 +1,103 @@
+// Package vfs defines the filesystem abstraction served by the builtin SFTP driver.
+//
+// A read-only filesystem is just an [fs.FS], such as [embed.FS] and [testing/fstest.MapFS].
+// A read-write filesystem implements [WritableFS].
+// [DirFS] implements [WritableFS] for a local directory.
+//
+// As in [fs.FS], names are slash-separated, unrooted paths such as "foo/bar".
+// The root is ".".
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// File is a file opened by [WritableFS.OpenFile].
+type File interface {
+	fs.File
+	io.ReaderAt
+	io.WriterAt
+}
+
+// WritableFS is a writable [fs.FS].
+type WritableFS interface {
+	SymlinkFS
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	Mkdir(name string, perm fs.FileMode) error
+	// Remove removes a file or an empty directory.
+	Remove(name string) error
+	// Rename renames oldname to newname, replacing newname if it already exists.
+	Rename(oldname, newname string) error
+	Chmod(name string, mode fs.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Truncate(name string, size int64) error
+	Symlink(oldname, newname string) error
+}
+
+// SymlinkFS is implemented by filesystems that support symbolic links.
+type SymlinkFS interface {
+	fs.FS
+	Lstat(name string) (fs.FileInfo, error)
+	Readlink(name string) (string, error)
+}
+
+// StatVFSFS is implemented by filesystems that support statvfs.
+type StatVFSFS interface {
+	fs.FS
+	StatVFS(name string) (*sftp.StatVFS, error)
+}
+
+// Lstat calls fsys.Lstat if fsys implements [SymlinkFS], otherwise [fs.Stat].
+func Lstat(fsys fs.FS, name string) (fs.FileInfo, error) {
+	if sfs, ok := fsys.(SymlinkFS); ok {
+		return sfs.Lstat(name)
+	}
+	return fs.Stat(fsys, name)
+}
+
+// Readlink calls fsys.Readlink if fsys implements [SymlinkFS].
+func Readlink(fsys fs.FS, name string) (string, error) {
+	if sfs, ok := fsys.(SymlinkFS); ok {
+		return sfs.Readlink(name)
+	}
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.ErrUnsupported}
+}
+
+// ReaderAtCloser is an [io.ReaderAt] with Close.
+type ReaderAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// NewReaderAt returns f as [ReaderAtCloser].
+// If f does not implement [io.ReaderAt] but implements [io.Seeker], ReadAt is emulated with Seek.
+func NewReaderAt(f fs.File) (ReaderAtCloser, error) {
+	switch x := f.(type) {
+	case ReaderAtCloser:
+		return x, nil
+	case io.ReadSeeker:
+		return &seekReaderAt{File: f, rs: x}, nil
+	}
+	return nil, errors.ErrUnsupported
+}
+
+type seekReaderAt struct {
+	fs.File
+	rs io.ReadSeeker
+	mu sync.Mutex
+}
+
+func (r *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(r.rs, p)
+}